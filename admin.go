@@ -0,0 +1,465 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+)
+
+var errDataDirLocked = errors.New("data directory is locked by a running server")
+
+// offlineActor and offlineLevelsActor are who the audit log credits with
+// changes made by the offline admin commands
+const (
+	offlineActor       = "jmaas tokens"
+	offlineLevelsActor = "jmaas levels"
+)
+
+var dataDirLock *os.File
+
+// lockDataDir takes an exclusive lock on the data directory, which the server
+// holds for as long as it runs so the offline admin commands can tell it's up
+func lockDataDir(wait bool) error {
+	f, err := os.OpenFile(dataPath("jmaas.lock"), os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+
+	if err := lockFile(f, wait); err != nil {
+		f.Close()
+		return err
+	}
+
+	f.Truncate(0)
+	fmt.Fprintf(f, "%d\n", os.Getpid())
+	dataDirLock = f
+	return nil
+}
+
+// unlockDataDir lets go of the lock once the store is closed, so a process
+// that was handed the listeners can open it without waiting for us to exit
+func unlockDataDir() {
+	if dataDirLock != nil {
+		dataDirLock.Close()
+		dataDirLock = nil
+	}
+}
+
+const tokensUsage = `Usage: jmaas [flags] tokens <command>
+
+These operate directly on the data directory and refuse to run while a
+server is using it.
+
+Commands:
+  add --note NOTE [--role operator|admin]
+                         Mint a new token and print it
+  list [--show-secrets]  List tokens, redacted unless --show-secrets is given
+  revoke TOKEN           Revoke a token, a unique prefix is enough
+  export [-o FILE]       Write every token as JSON to FILE or stdout
+  import [--replace] FILE
+                         Merge tokens from a JSON export (- for stdin),
+                         replacing the whole list with --replace
+`
+
+// openOfflineStore opens the store for the offline commands, which can't
+// share the data directory with a running server
+func openOfflineStore() error {
+	if err := lockDataDir(false); err != nil {
+		if err == errDataDirLocked {
+			return fmt.Errorf("a server is running on %s, stop it first or use jmaasctl", cfg.DataDir)
+		}
+		return err
+	}
+
+	setupNodeID()
+	var err error
+	if store, err = openStore(); err != nil {
+		return err
+	}
+	events.subscribe("audit", auditEvents)
+	return nil
+}
+
+// closeOfflineStore waits for the audit log to catch up before closing the
+// store
+func closeOfflineStore() {
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	if err := events.drain(ctx); err != nil {
+		fmt.Fprintf(os.Stderr, "could not write the audit log: %s\n", err.Error())
+	}
+	store.Close()
+}
+
+// tokensCommand runs the offline `jmaas tokens` subcommands
+func tokensCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, tokensUsage)
+		os.Exit(2)
+	}
+
+	if err := openOfflineStore(); err != nil {
+		return err
+	}
+	defer closeOfflineStore()
+
+	switch args[0] {
+	case "add":
+		return tokensAdd(args[1:])
+	case "list":
+		return tokensList(args[1:])
+	case "revoke":
+		return tokensRevoke(args[1:])
+	case "export":
+		return tokensExport(args[1:])
+	case "import":
+		return tokensImport(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown tokens command %q\n\n%s", args[0], tokensUsage)
+	os.Exit(2)
+	return nil
+}
+
+func tokensAdd(args []string) error {
+	fs := flag.NewFlagSet("tokens add", flag.ExitOnError)
+	note := fs.String("note", "", "What the token is for, shown in logs")
+	role := fs.String("role", roleOperator, "The token's role, operator or admin")
+	fs.Parse(args)
+
+	if *note == "" {
+		return errors.New("--note is required")
+	}
+	if !isValidRole(*role) {
+		return fmt.Errorf("unknown role %q, expected operator or admin", *role)
+	}
+
+	token, err := addNewAuthedToken(*note, *role)
+	if err != nil {
+		return err
+	}
+	events.publish(tokenCreated{Time: time.Now(), Actor: offlineActor, Token: token, Note: *note, Role: *role})
+
+	fmt.Println(token)
+	return nil
+}
+
+func tokensList(args []string) error {
+	fs := flag.NewFlagSet("tokens list", flag.ExitOnError)
+	showSecrets := fs.Bool("show-secrets", false, "Print whole tokens instead of redacting them")
+	fs.Parse(args)
+
+	tokens, err := store.Tokens()
+	if err != nil {
+		return err
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "TOKEN\tROLE\tLEVEL\tNOTE")
+	for _, k := range tokens.sortedTokens() {
+		attr := tokens[k]
+		if !*showSecrets {
+			k = redactToken(k)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%d\t%s\n", k, attr.role(), attr.Level, attr.Note)
+	}
+	return w.Flush()
+}
+
+func tokensRevoke(args []string) error {
+	if len(args) != 1 {
+		return errors.New("revoke needs exactly one token")
+	}
+
+	tokens, err := store.Tokens()
+	if err != nil {
+		return err
+	}
+	prefix := args[0]
+
+	matches := []string{}
+	for k := range tokens {
+		if k == prefix {
+			matches = []string{k}
+			break
+		}
+		if strings.HasPrefix(k, prefix) {
+			matches = append(matches, k)
+		}
+	}
+
+	switch len(matches) {
+	case 0:
+		return fmt.Errorf("no token matches %q", prefix)
+	case 1:
+	default:
+		return fmt.Errorf("%d tokens match %q, give more of the token", len(matches), prefix)
+	}
+
+	if _, err := store.DeleteToken(matches[0]); err != nil {
+		return err
+	}
+	events.publish(tokenRevoked{Time: time.Now(), Actor: offlineActor, Token: matches[0]})
+
+	fmt.Printf("Revoked %s (%s)\n", redactToken(matches[0]), tokens[matches[0]].Note)
+	return nil
+}
+
+func tokensExport(args []string) error {
+	fs := flag.NewFlagSet("tokens export", flag.ExitOnError)
+	out := fs.String("o", "", "File to write to, defaults to stdout")
+	fs.Parse(args)
+
+	tokens, err := store.Tokens()
+	if err != nil {
+		return err
+	}
+
+	j, err := json.MarshalIndent(tokens, "", "  ")
+	if err != nil {
+		return err
+	}
+	j = append(j, '\n')
+
+	if *out == "" {
+		_, err = os.Stdout.Write(j)
+		return err
+	}
+	return ioutil.WriteFile(*out, j, 0600)
+}
+
+func tokensImport(args []string) error {
+	fs := flag.NewFlagSet("tokens import", flag.ExitOnError)
+	replace := fs.Bool("replace", false, "Replace every existing token instead of merging")
+	fs.Parse(args)
+
+	if fs.NArg() != 1 {
+		return errors.New("import needs a file, or - for stdin")
+	}
+
+	var in io.Reader = os.Stdin
+	if fs.Arg(0) != "-" {
+		f, err := os.Open(fs.Arg(0))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	imported := tokenList{}
+	if err := json.NewDecoder(in).Decode(&imported); err != nil {
+		return fmt.Errorf("could not read export: %s", err.Error())
+	}
+
+	for k, attr := range imported {
+		if k == "" {
+			return errors.New("export contains an empty token")
+		}
+		if attr.Role != "" && !isValidRole(attr.Role) {
+			return fmt.Errorf("token %s has unknown role %q", redactToken(k), attr.Role)
+		}
+	}
+
+	if *replace {
+		existing, err := store.Tokens()
+		if err != nil {
+			return err
+		}
+		for k := range existing {
+			if _, err := store.DeleteToken(k); err != nil {
+				return err
+			}
+		}
+	}
+	for k, attr := range imported {
+		if err := store.PutToken(k, attr); err != nil {
+			return err
+		}
+	}
+	events.publish(tokensImported{Time: time.Now(), Actor: offlineActor, Count: len(imported), Replace: *replace})
+
+	tokens, err := store.Tokens()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("Imported %d tokens, %d total\n", len(imported), len(tokens))
+	return nil
+}
+
+const levelsUsage = `Usage: jmaas [flags] levels <command>
+
+These operate directly on the data directory and refuse to run while a
+server is using it.
+
+Commands:
+  templates              List the built-in templates
+  export [-o FILE] [--template NAME]
+                         Write the levels, or a template, as a bundle to
+                         FILE or stdout
+  import [--dry-run] FILE|--template NAME
+                         Replace the levels with a bundle (- for stdin) or
+                         a template, printing what changes
+`
+
+// levelsCommand runs the offline `jmaas levels` subcommands
+func levelsCommand(args []string) error {
+	if len(args) == 0 {
+		fmt.Fprint(os.Stderr, levelsUsage)
+		os.Exit(2)
+	}
+
+	if args[0] == "templates" {
+		for _, name := range templateNames() {
+			levels, _ := levelTemplate(name)
+			titles := []string{}
+			for _, n := range levels.sortedLevels() {
+				titles = append(titles, levels[n].Title)
+			}
+			fmt.Printf("%-14s %s\n", name, strings.Join(titles, ", "))
+		}
+		return nil
+	}
+
+	if err := openOfflineStore(); err != nil {
+		return err
+	}
+	defer closeOfflineStore()
+
+	switch args[0] {
+	case "export":
+		return levelsExport(args[1:])
+	case "import":
+		return levelsImport(args[1:])
+	}
+
+	fmt.Fprintf(os.Stderr, "unknown levels command %q\n\n%s", args[0], levelsUsage)
+	os.Exit(2)
+	return nil
+}
+
+func levelsExport(args []string) error {
+	fs := flag.NewFlagSet("levels export", flag.ExitOnError)
+	out := fs.String("o", "", "File to write to, defaults to stdout")
+	template := fs.String("template", "", "Export a built-in template instead of the board's levels")
+	fs.Parse(args)
+
+	levels, exists := levelTemplate(*template)
+	if *template == "" {
+		var err error
+		if levels, err = store.Levels(); err != nil {
+			return err
+		}
+	} else if !exists {
+		return fmt.Errorf("unknown template %q, expected one of %s", *template, strings.Join(templateNames(), ", "))
+	}
+
+	j, err := newBundle(levels).encode()
+	if err != nil {
+		return err
+	}
+
+	if *out == "" {
+		_, err = os.Stdout.Write(j)
+		return err
+	}
+	return ioutil.WriteFile(*out, j, 0644)
+}
+
+func levelsImport(args []string) error {
+	fs := flag.NewFlagSet("levels import", flag.ExitOnError)
+	dryRun := fs.Bool("dry-run", false, "Only print what would change")
+	template := fs.String("template", "", "Import a built-in template instead of a bundle")
+	fs.Parse(args)
+
+	var levels levelSet
+	if *template != "" {
+		var exists bool
+		if levels, exists = levelTemplate(*template); !exists {
+			return fmt.Errorf("unknown template %q, expected one of %s", *template, strings.Join(templateNames(), ", "))
+		}
+	} else {
+		if fs.NArg() != 1 {
+			return errors.New("import needs a file, - for stdin, or --template")
+		}
+
+		var in io.Reader = os.Stdin
+		if fs.Arg(0) != "-" {
+			f, err := os.Open(fs.Arg(0))
+			if err != nil {
+				return err
+			}
+			defer f.Close()
+			in = f
+		}
+
+		var err error
+		if levels, err = readBundle(in); err != nil {
+			return err
+		}
+	}
+
+	current, err := store.Levels()
+	if err != nil {
+		return err
+	}
+	changes := diffLevels(current, levels)
+	for _, c := range changes {
+		fmt.Println(c)
+	}
+	if len(changes) == 0 {
+		fmt.Println("No changes")
+		return nil
+	}
+	if *dryRun {
+		return nil
+	}
+
+	// replaceLevels works on the server's state, so load it like startup does
+	state, err := store.State()
+	if err != nil {
+		return err
+	}
+	level = state.Level
+	levelReason = state.Reason
+	pendingLevel = state.Pending
+	levelVersion = state.Version
+	levelEventKey = state.EventKey
+	resetReactions(state.HistoryID, state.EventKey, nil)
+
+	if err := replaceLevels(levels, offlineLevelsActor); err != nil {
+		return err
+	}
+	events.publish(levelsEdited{Time: time.Now(), Actor: offlineLevelsActor, Levels: len(levels), Changes: changes})
+	fmt.Printf("Imported %d levels\n", len(levels))
+	return nil
+}
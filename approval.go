@@ -0,0 +1,360 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"github.com/go-playground/log"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// pendingChange is an escalation waiting for a second operator to confirm
+// it. Its ID is the history entry that recorded the request.
+type pendingChange struct {
+	ID        int64  `json:"id"`
+	Level     int    `json:"level"`
+	Previous  int    `json:"previous"`
+	Requester string `json:"requester"`
+	// RequesterID is the tokenID of the token that asked, notes aren't
+	// unique so they can't tell operators apart
+	RequesterID string    `json:"requesterId,omitempty"`
+	Reason      string    `json:"reason,omitempty"`
+	Requested   time.Time `json:"requested"`
+	Expires     time.Time `json:"expires"`
+	// Node is the cluster node it was requested on, which expires it
+	Node string `json:"node,omitempty"`
+}
+
+// public is p without who asked beyond their note, for viewers
+func (p *pendingChange) public() *pendingChange {
+	if p == nil {
+		return nil
+	}
+	out := *p
+	out.RequesterID = ""
+	out.Node = ""
+	return &out
+}
+
+// requestedBy reports whether the token with the given tokenID asked for p.
+// Changes restored from before requesters were recorded fall back to the
+// note.
+func (p *pendingChange) requestedBy(id, note string) bool {
+	if p.RequesterID == "" {
+		return note == p.Requester
+	}
+	return id == p.RequesterID
+}
+
+// pendingUpdate is broadcast as levelpending whenever a change is requested
+// or resolved, Status is pending, confirmed, rejected, or expired
+type pendingUpdate struct {
+	*pendingChange
+	Status string `json:"status"`
+	By     string `json:"by,omitempty"`
+}
+
+var (
+	errChangePending   = errors.New("another level change is already waiting for approval")
+	errNoPendingChange = errors.New("no such pending level change")
+	errOwnChange       = errors.New("a change has to be confirmed by a different operator")
+)
+
+var (
+	// pendingLevel and pendingTimer are guarded by levelMu
+	pendingLevel *pendingChange
+	pendingTimer *time.Timer
+)
+
+// approvalBetween returns the approval policy for raising the level from
+// from to to, that of the highest level passed through that has one, so a
+// jump can't skip over a level's policy. It's nil if none of them need one.
+func approvalBetween(from, to int) *levelApproval {
+	levels, err := store.Levels()
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+		return nil
+	}
+	for lvl := to; lvl > from; lvl-- {
+		if policy := levels[lvl].Approval; policy != nil {
+			return policy
+		}
+	}
+	return nil
+}
+
+func pendingMessage(p *pendingChange, status, by string) *socketMessage {
+	return &socketMessage{Type: "levelpending", Data: pendingUpdate{pendingChange: p.public(), Status: status, By: by}}
+}
+
+// requestChangeLocked records a request by actor, whose token has the
+// tokenID actorID, to move to newlvl and waits for policy.Within for someone
+// else to confirm it. levelMu must be held.
+func requestChangeLocked(actor, actorID, reason string, newlvl int, policy *levelApproval) (*pendingChange, error) {
+	if pendingLevel != nil {
+		return nil, errChangePending
+	}
+
+	now := time.Now()
+	entry := historyEntry{Kind: historyRequested, Time: now, Level: newlvl, Previous: level, Actor: actor, Reason: reason}
+	id, err := store.AppendHistory(entry)
+	if err != nil {
+		return nil, err
+	}
+
+	pendingLevel = &pendingChange{
+		ID:          id,
+		Level:       newlvl,
+		Previous:    level,
+		Requester:   actor,
+		RequesterID: actorID,
+		Reason:      reason,
+		Requested:   now,
+		Expires:     now.Add(time.Duration(policy.Within)),
+		Node:        nodeID,
+	}
+	if err := saveStateLocked(); err != nil {
+		log.Errorf("Could not save pending level change: %s", err.Error())
+	}
+
+	log.Infof("%s requested level %d, waiting for approval until %s", actor, newlvl, pendingLevel.Expires.Format(time.RFC3339))
+	schedulePendingExpiryLocked()
+	events.publish(levelPending{Change: pendingLevel, Status: "pending"})
+	return pendingLevel, nil
+}
+
+// schedulePendingExpiryLocked expires the pending change once it's out of
+// time. In a cluster the node it was requested on expires it and tells the
+// others, who only step in if that node has been gone as long as it takes
+// to count as down. levelMu must be held.
+func schedulePendingExpiryLocked() {
+	if pendingTimer != nil {
+		pendingTimer.Stop()
+	}
+
+	p := pendingLevel
+	wait := time.Until(p.Expires)
+	if p.Node != "" && p.Node != nodeID {
+		wait += 3 * cfg.ClusterHeartbeat
+	}
+	pendingTimer = time.AfterFunc(wait, func() {
+		levelMu.Lock()
+		defer levelMu.Unlock()
+
+		if pendingLevel != p {
+			return
+		}
+		p := pendingLevel
+		recordResolutionLocked(historyExpired, "")
+		log.Infof("Request for level %d by %s expired", p.Level, p.Requester)
+		events.publish(levelPending{Change: p, Status: historyExpired})
+	})
+}
+
+// recordResolutionLocked clears the pending change, recording why when it
+// didn't go through. levelMu must be held.
+func recordResolutionLocked(kind, actor string) {
+	p := pendingLevel
+	pendingLevel = nil
+	if pendingTimer != nil {
+		pendingTimer.Stop()
+		pendingTimer = nil
+	}
+
+	entry := historyEntry{Kind: kind, Time: time.Now(), Level: p.Level, Previous: level, Actor: actor, Reason: p.Reason}
+	if _, err := store.AppendHistory(entry); err != nil {
+		log.Errorf("Could not write history: %s", err.Error())
+	}
+	if err := saveStateLocked(); err != nil {
+		log.Errorf("Could not save state: %s", err.Error())
+	}
+}
+
+// resolvePending confirms or rejects the pending change with the given id,
+// as actor holding the token with tokenID actorID. Anyone can reject a
+// change, including whoever requested it, but only a different token can
+// confirm it.
+func resolvePending(id int64, actor, actorID string, confirm bool) error {
+	levelMu.Lock()
+	defer levelMu.Unlock()
+
+	p := pendingLevel
+	if p == nil || p.ID != id {
+		return errNoPendingChange
+	}
+
+	if !confirm {
+		recordResolutionLocked(historyRejected, actor)
+		log.Infof("%s rejected level %d requested by %s", actor, p.Level, p.Requester)
+		events.publish(levelPending{Change: p, Status: historyRejected, By: actor})
+		return nil
+	}
+
+	if p.requestedBy(actorID, actor) {
+		return errOwnChange
+	}
+
+	pendingLevel = nil
+	if err := setLevelLocked(p.Level, p.Requester, actor, p.Reason); err != nil {
+		pendingLevel = p
+		return err
+	}
+	if pendingTimer != nil {
+		pendingTimer.Stop()
+		pendingTimer = nil
+	}
+
+	log.Infof("%s confirmed level %d requested by %s", actor, p.Level, p.Requester)
+	events.publish(levelPending{Change: p, Status: "confirmed", By: actor})
+	return nil
+}
+
+// restorePending picks a pending change back up after a restart, expiring
+// it straight away if it ran out of time while we were down
+func restorePending(p *pendingChange) {
+	if p == nil {
+		return
+	}
+
+	levelMu.Lock()
+	defer levelMu.Unlock()
+
+	pendingLevel = p
+	schedulePendingExpiryLocked()
+}
+
+func currentPending() *pendingChange {
+	levelMu.RLock()
+	defer levelMu.RUnlock()
+	return pendingLevel
+}
+
+func pendingHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	j, _ := json.Marshal(currentPending().public())
+	w.Write(j)
+}
+
+func confirmPendingHandler(w http.ResponseWriter, r *http.Request) {
+	resolvePendingRequest(w, r, true)
+}
+
+func rejectPendingHandler(w http.ResponseWriter, r *http.Request) {
+	resolvePendingRequest(w, r, false)
+}
+
+func resolvePendingRequest(w http.ResponseWriter, r *http.Request, confirm bool) {
+	token, attr, ok := authRequest(w, r)
+	if !ok {
+		return
+	}
+
+	id, err := strconv.ParseInt(r.Header.Get("Pending-Id"), 10, 64)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("you must provide a numeric Pending-Id header"))
+		return
+	}
+
+	if !allowLevelChange(w, token) {
+		return
+	}
+
+	err = resolvePending(id, attr.Note, tokenID(token), confirm)
+	w.Header().Set("Content-Type", "text/plain")
+	switch err {
+	case nil:
+	case errNoPendingChange:
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte(err.Error()))
+		return
+	case errOwnChange:
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte(err.Error()))
+		return
+	default:
+		log.Errorf("Could not resolve pending level change: %s", err.Error())
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not save level"))
+		return
+	}
+
+	if confirm {
+		w.Write([]byte("Level change confirmed"))
+	} else {
+		w.Write([]byte("Level change rejected"))
+	}
+}
+
+func handleSocketConfirm(c *socketConnection, data json.RawMessage) {
+	resolvePendingSocket(c, data, "confirm")
+}
+
+func handleSocketReject(c *socketConnection, data json.RawMessage) {
+	resolvePendingSocket(c, data, "reject")
+}
+
+func resolvePendingSocket(c *socketConnection, data json.RawMessage, action string) {
+	req := struct {
+		ID int64 `json:"id"`
+	}{}
+	json.Unmarshal(data, &req)
+
+	reply := map[string]interface{}{"ok": true}
+	if err := resolvePendingAsSocket(c, req.ID, action == "confirm"); err != nil {
+		reply = map[string]interface{}{"ok": false, "error": err.Error()}
+	}
+	c.reply(&socketMessage{Type: action, Data: reply})
+}
+
+// resolvePendingAsSocket resolves a change for the socket's operator, with
+// the same checks and limits as the API. The token is looked up again since
+// it may have been revoked after the socket authenticated.
+func resolvePendingAsSocket(c *socketConnection, id int64, confirm bool) error {
+	token := c.operatorToken()
+	if token == "" {
+		return errors.New("only operators can do that")
+	}
+
+	attr, authed := isTokenAuthed(token)
+	if !authed {
+		c.forget()
+		schedulePresence()
+		return errors.New("token is not authed")
+	}
+	if ok, _ := tokenLimiter.allow(token); !ok {
+		return errors.New("too many requests for this token")
+	}
+	if ok, _ := levelChangeLimiter.allow(token); !ok {
+		return errors.New("too many level changes for this token")
+	}
+
+	err := resolvePending(id, attr.Note, tokenID(token), confirm)
+	if err != nil && err != errNoPendingChange && err != errOwnChange {
+		log.Errorf("Could not resolve pending level change: %s", err.Error())
+		return errors.New("could not save level")
+	}
+	return err
+}
@@ -0,0 +1,114 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// setupApproval has level 4 need a second operator, and the operator ask
+// for it
+func setupApproval(t *testing.T) *pendingChange {
+	t.Helper()
+	setupTestServer(t)
+
+	levels, _ := store.Levels()
+	top := levels[4]
+	top.Approval = &levelApproval{Within: jsonDuration(time.Minute)}
+	levels[4] = top
+	if err := store.SetLevels(levels); err != nil {
+		t.Fatal(err)
+	}
+
+	_, pending, err := updateLevel("operator", tokenID(testOperatorToken), "", func(int) int { return 4 })
+	if err != nil || pending == nil {
+		t.Fatalf("requesting level 4 = %#v, %v", pending, err)
+	}
+	return pending
+}
+
+func TestSocketConfirmRechecksToken(t *testing.T) {
+	pending := setupApproval(t)
+	cfg.EnablePresence = false
+
+	c := &socketConnection{remoteAddr: "192.0.2.1"}
+	if !c.authenticate(testAdminToken) {
+		t.Fatal("admin token didn't authenticate")
+	}
+	if _, err := store.DeleteToken(testAdminToken); err != nil {
+		t.Fatal(err)
+	}
+	if err := resolvePendingAsSocket(c, pending.ID, true); err == nil {
+		t.Error("a revoked token confirmed a change")
+	}
+	if c.operator() != "" || currentPending() == nil || getCurrentLevel() != 0 {
+		t.Errorf("after a revoked token tried to confirm, the socket is %q and the level %d", c.operator(), getCurrentLevel())
+	}
+
+	store.PutToken(testAdminToken, tokenAttr{Level: 1, Note: "admin", Role: roleAdmin})
+	c.authenticate(testAdminToken)
+	if err := resolvePendingAsSocket(c, pending.ID, true); err != nil || getCurrentLevel() != 4 {
+		t.Errorf("confirming = %v, level is %d", err, getCurrentLevel())
+	}
+}
+
+func TestSocketConfirmLimited(t *testing.T) {
+	pending := setupApproval(t)
+	cfg.LevelChangesPerMinute = 1
+	setupRateLimits()
+
+	c := &socketConnection{remoteAddr: "192.0.2.1"}
+	c.authenticate(testAdminToken)
+	if err := resolvePendingAsSocket(c, pending.ID+1, true); err != errNoPendingChange {
+		t.Fatalf("confirming the wrong change = %v", err)
+	}
+	if err := resolvePendingAsSocket(c, pending.ID, true); err == nil || currentPending() == nil {
+		t.Errorf("confirming past limits.level_changes_per_minute = %v", err)
+	}
+}
+
+func TestPendingExpiresOnItsNode(t *testing.T) {
+	setupTestServer(t)
+	cfg.ClusterHeartbeat = 50 * time.Millisecond
+	defer func(id string) { nodeID = id }(nodeID)
+	nodeID = "here"
+
+	expire := func(node string) *pendingChange {
+		levelMu.Lock()
+		pendingLevel = &pendingChange{ID: 1, Level: 4, Expires: time.Now(), Node: node}
+		schedulePendingExpiryLocked()
+		levelMu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		return currentPending()
+	}
+
+	if p := expire("here"); p != nil {
+		t.Error("a change requested here didn't expire on time")
+	}
+	if p := expire("there"); p == nil {
+		t.Error("a change requested on another node expired here before that node could")
+	}
+	time.Sleep(3 * cfg.ClusterHeartbeat)
+	if p := currentPending(); p != nil {
+		t.Error("a change requested on a node that's gone never expired")
+	}
+}
@@ -0,0 +1,506 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A backplane carries messages between the nodes of a cluster. Messages can
+// be lost, the heartbeat makes up for that.
+type backplane interface {
+	send(msg []byte)
+	// receive starts delivering messages from other nodes, and from this
+	// one on backplanes that echo them
+	receive(deliver func(msg []byte))
+	stop()
+}
+
+const (
+	// maxClusterMessage is the most a node will take from another, the
+	// levels are the biggest thing sent and they're limited like bundles
+	maxClusterMessage = maxBundleSize + 4<<10
+	clusterMaxBackoff = 30 * time.Second
+	clusterTimeout    = 5 * time.Second
+)
+
+// redisBackplane publishes to cluster.redis_channel, on its own connection
+// since a subscribed Redis connection can't do anything else. Anything that
+// can reach Redis can publish, so messages are signed with cluster.secret
+// like on the HTTP backplane.
+type redisBackplane struct {
+	mu      sync.Mutex
+	pub     *redisConn
+	sub     *redisConn
+	stopped bool
+}
+
+type redisConn struct {
+	conn net.Conn
+	r    *bufio.Reader
+}
+
+func newRedisBackplane() *redisBackplane {
+	return &redisBackplane{}
+}
+
+// send publishes msg, dropping it if Redis can't be reached
+func (b *redisBackplane) send(msg []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stopped {
+		return
+	}
+	if b.pub == nil {
+		c, err := dialRedis()
+		if err != nil {
+			log.Warnf("Could not connect to Redis at %s: %s", cfg.ClusterRedisAddr, err.Error())
+			return
+		}
+		b.pub = c
+	}
+	if _, err := b.pub.do("PUBLISH", []byte(cfg.ClusterRedisChannel), signClusterMessage(msg)); err != nil {
+		log.Warnf("Could not publish to Redis: %s", err.Error())
+		b.pub.conn.Close()
+		b.pub = nil
+	}
+}
+
+func (b *redisBackplane) receive(deliver func([]byte)) {
+	go b.run(deliver)
+}
+
+func (b *redisBackplane) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stopped = true
+	if b.pub != nil {
+		b.pub.conn.Close()
+	}
+	if b.sub != nil {
+		b.sub.conn.Close()
+	}
+}
+
+func (b *redisBackplane) isStopped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stopped
+}
+
+func (b *redisBackplane) run(deliver func([]byte)) {
+	backoff := time.Second
+	for !b.isStopped() {
+		start := time.Now()
+		err := b.subscribe(deliver)
+		if b.isStopped() {
+			return
+		}
+		if time.Since(start) > clusterMaxBackoff {
+			backoff = time.Second
+		}
+		log.Warnf("Redis subscription on %s lost, retrying in %s: %s", cfg.ClusterRedisAddr, backoff, err.Error())
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > clusterMaxBackoff {
+			backoff = clusterMaxBackoff
+		}
+	}
+}
+
+// subscribe delivers messages on the channel until the connection drops
+func (b *redisBackplane) subscribe(deliver func([]byte)) error {
+	c, err := dialRedis()
+	if err != nil {
+		return err
+	}
+	defer c.conn.Close()
+
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		return nil
+	}
+	b.sub = c
+	b.mu.Unlock()
+
+	if _, err := c.do("SUBSCRIBE", []byte(cfg.ClusterRedisChannel)); err != nil {
+		return err
+	}
+	log.Infof("Subscribed to %s on Redis at %s", cfg.ClusterRedisChannel, cfg.ClusterRedisAddr)
+
+	for {
+		// Subscribed connections can't PING, the heartbeat is what
+		// keeps messages coming
+		c.conn.SetReadDeadline(time.Now().Add(3 * cfg.ClusterHeartbeat))
+		reply, err := readRESP(c.r)
+		if err != nil {
+			return err
+		}
+		parts, ok := reply.([]interface{})
+		if !ok || len(parts) != 3 {
+			continue
+		}
+		if kind, _ := parts[0].([]byte); string(kind) != "message" {
+			continue
+		}
+		signed, ok := parts[2].([]byte)
+		if !ok {
+			continue
+		}
+		msg, err := openClusterMessage(signed)
+		if err != nil {
+			log.Warnf("Ignored a message on %s: %s", cfg.ClusterRedisChannel, err.Error())
+			continue
+		}
+		deliver(msg)
+	}
+}
+
+// dialRedis connects, authenticating with cluster.redis_password if it's set
+func dialRedis() (*redisConn, error) {
+	conn, err := net.DialTimeout("tcp", cfg.ClusterRedisAddr, clusterTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c := &redisConn{conn: conn, r: bufio.NewReader(conn)}
+	if cfg.ClusterRedisPassword != "" {
+		if _, err := c.do("AUTH", []byte(cfg.ClusterRedisPassword)); err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return c, nil
+}
+
+// do sends a command and reads its reply
+func (c *redisConn) do(cmd string, args ...[]byte) (interface{}, error) {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%d\r\n$%d\r\n%s\r\n", len(args)+1, len(cmd), cmd)
+	for _, arg := range args {
+		fmt.Fprintf(buf, "$%d\r\n", len(arg))
+		buf.Write(arg)
+		buf.WriteString("\r\n")
+	}
+
+	c.conn.SetDeadline(time.Now().Add(clusterTimeout))
+	defer c.conn.SetDeadline(time.Time{})
+	if _, err := c.conn.Write(buf.Bytes()); err != nil {
+		return nil, err
+	}
+	return readRESP(c.r)
+}
+
+// readRESP reads one Redis reply: bulk strings are []byte, arrays are
+// []interface{}, and an error reply is returned as an error
+func readRESP(r *bufio.Reader) (interface{}, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || !strings.HasSuffix(line, "\r\n") {
+		return nil, errors.New("malformed Redis reply")
+	}
+	kind, line := line[0], line[1:len(line)-2]
+
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, fmt.Errorf("Redis error: %s", line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n > maxClusterMessage {
+			return nil, errors.New("bad Redis bulk string length")
+		}
+		if n < 0 {
+			return nil, nil
+		}
+		b := make([]byte, n+2)
+		if _, err := io.ReadFull(r, b); err != nil {
+			return nil, err
+		}
+		return b[:n], nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n > 64 {
+			return nil, errors.New("bad Redis array length")
+		}
+		out := []interface{}{}
+		for i := 0; i < n; i++ {
+			v, err := readRESP(r)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, v)
+		}
+		return out, nil
+	}
+	return nil, fmt.Errorf("unknown Redis reply type %q", kind)
+}
+
+// httpBackplane POSTs every message to each of cluster.peers, signed with
+// cluster.secret, and takes theirs on /api/cluster
+type httpBackplane struct {
+	peers   []*httpPeer
+	mu      sync.Mutex
+	deliver func([]byte)
+	stopped bool
+}
+
+// httpPeer sends to one peer in order, dropping messages while it's too far
+// behind rather than holding up the rest of the server
+type httpPeer struct {
+	url   string
+	queue chan []byte
+	done  chan struct{}
+}
+
+// httpPeerQueue is how many messages can wait for a slow peer
+const httpPeerQueue = 256
+
+// clusterMaxSkew is how far a signed message's time can be from ours, so
+// one can't be replayed later. Within it, each node's messages are numbered.
+const clusterMaxSkew = time.Minute
+
+var clusterClient = &http.Client{Timeout: clusterTimeout}
+
+func newHTTPBackplane() *httpBackplane {
+	b := &httpBackplane{}
+	for _, peer := range cfg.ClusterPeers {
+		p := &httpPeer{
+			url:   strings.TrimSuffix(peer, "/") + "/api/cluster",
+			queue: make(chan []byte, httpPeerQueue),
+			done:  make(chan struct{}),
+		}
+		b.peers = append(b.peers, p)
+		go p.run()
+	}
+	return b
+}
+
+func (b *httpBackplane) send(msg []byte) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	if b.stopped {
+		return
+	}
+	for _, p := range b.peers {
+		select {
+		case p.queue <- msg:
+		default:
+			log.Warnf("Dropped a cluster message for %s, it's too far behind", p.url)
+		}
+	}
+}
+
+func (b *httpBackplane) receive(deliver func([]byte)) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.deliver = deliver
+}
+
+func (b *httpBackplane) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stopped = true
+	for _, p := range b.peers {
+		close(p.done)
+	}
+}
+
+func (p *httpPeer) run() {
+	failing := false
+	for {
+		select {
+		case <-p.done:
+			return
+		case msg := <-p.queue:
+			err := p.post(msg)
+			if err != nil && !failing {
+				log.Warnf("Could not reach cluster peer %s: %s", p.url, err.Error())
+			} else if err == nil && failing {
+				log.Infof("Cluster peer %s is reachable again", p.url)
+			}
+			failing = err != nil
+		}
+	}
+}
+
+func (p *httpPeer) post(msg []byte) error {
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	req, err := http.NewRequest("POST", p.url, bytes.NewReader(msg))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Cluster-Time", now)
+	req.Header.Set("Cluster-Signature", clusterSignature(now, msg))
+
+	resp, err := clusterClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	io.Copy(ioutil.Discard, resp.Body)
+	if resp.StatusCode != http.StatusNoContent {
+		return fmt.Errorf("peer answered %s", resp.Status)
+	}
+	return nil
+}
+
+// clusterSignature is the hex HMAC-SHA256 of a message and the time it was
+// sent, under cluster.secret
+func clusterSignature(sent string, msg []byte) string {
+	mac := hmac.New(sha256.New, []byte(cfg.ClusterSecret))
+	mac.Write([]byte(sent + "\n"))
+	mac.Write(msg)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// validClusterSignature checks a message was signed under cluster.secret,
+// at a time close enough to ours
+func validClusterSignature(sent, signature string, msg []byte) bool {
+	unix, err := strconv.ParseInt(sent, 10, 64)
+	if err != nil {
+		return false
+	}
+	skew := time.Since(time.Unix(unix, 0))
+	if skew > clusterMaxSkew || skew < -clusterMaxSkew {
+		return false
+	}
+	return hmac.Equal([]byte(signature), []byte(clusterSignature(sent, msg)))
+}
+
+// clusterSealer encrypts with a key derived from cluster.secret, for what
+// only other nodes should read, not everything else that can read the
+// backplane
+func clusterSealer() (cipher.AEAD, error) {
+	mac := hmac.New(sha256.New, []byte(cfg.ClusterSecret))
+	mac.Write([]byte("jmaas cluster seal"))
+	block, err := aes.NewCipher(mac.Sum(nil))
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func sealClusterData(plain []byte) ([]byte, error) {
+	aead, err := clusterSealer()
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, plain, nil), nil
+}
+
+func openClusterData(sealed []byte) ([]byte, error) {
+	aead, err := clusterSealer()
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < aead.NonceSize() {
+		return nil, errors.New("sealed data is too short")
+	}
+	return aead.Open(nil, sealed[:aead.NonceSize()], sealed[aead.NonceSize():], nil)
+}
+
+// signClusterMessage puts the time and signature on a line before msg, for
+// the Redis backplane that has no headers to carry them
+func signClusterMessage(msg []byte) []byte {
+	sent := strconv.FormatInt(time.Now().Unix(), 10)
+	return append([]byte(sent+" "+clusterSignature(sent, msg)+"\n"), msg...)
+}
+
+// openClusterMessage checks a message from signClusterMessage and returns
+// what was signed
+func openClusterMessage(signed []byte) ([]byte, error) {
+	end := bytes.IndexByte(signed, '\n')
+	if end < 0 {
+		return nil, errors.New("message is not signed")
+	}
+	fields := strings.Fields(string(signed[:end]))
+	msg := signed[end+1:]
+	if len(fields) != 2 || !validClusterSignature(fields[0], fields[1], msg) {
+		return nil, errors.New("bad cluster signature")
+	}
+	return msg, nil
+}
+
+// clusterHandler takes messages from the other nodes on the HTTP backplane
+func clusterHandler(w http.ResponseWriter, r *http.Request) {
+	b := cluster.backplane.(*httpBackplane)
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Cluster messages need a POST"))
+		return
+	}
+
+	msg, err := ioutil.ReadAll(io.LimitReader(r.Body, maxClusterMessage))
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Could not read message"))
+		return
+	}
+
+	if !validClusterSignature(r.Header.Get("Cluster-Time"), r.Header.Get("Cluster-Signature"), msg) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("Bad cluster signature"))
+		return
+	}
+
+	b.mu.Lock()
+	deliver := b.deliver
+	b.mu.Unlock()
+	if deliver != nil {
+		deliver(msg)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
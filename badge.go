@@ -0,0 +1,309 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/xml"
+	"fmt"
+	"github.com/go-playground/log"
+	"golang.org/x/image/font"
+	"golang.org/x/image/font/basicfont"
+	"golang.org/x/image/math/fixed"
+	"hash/fnv"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"net/http"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+const (
+	defaultBadgeLabel = "anger level"
+	badgeLabelColor   = "#555555"
+	// badgeFallbackColor is used when a level's background isn't a hex color
+	badgeFallbackColor = "#9E9E9E"
+	maxBadgeLabel      = 32
+	maxStatusScale     = 4
+	badgeHeight        = 20
+)
+
+// badge is the current level as a shields-style label and message
+type badge struct {
+	Label      string
+	Message    string
+	Background string
+}
+
+// badge is how the snapshot's level looks as a badge
+func (s levelSnapshot) badge() badge {
+	b := badge{
+		Label:      defaultBadgeLabel,
+		Message:    excerpt(s.Definition.Title),
+		Background: s.Color(),
+	}
+	if b.Message == "" {
+		b.Message = strconv.Itoa(s.Level)
+	}
+	return b
+}
+
+// currentBadge builds the badge for the current level, along with an ETag
+// that changes whenever the level, its definition, or the label does
+func currentBadge(r *http.Request, extra string) (badge, string, error) {
+	snap, err := currentSnapshot(r)
+	if err != nil {
+		return badge{}, "", err
+	}
+
+	b := snap.badge()
+	if label := r.URL.Query().Get("label"); label != "" {
+		b.Label = label
+	}
+	if utf8.RuneCountInString(b.Label) > maxBadgeLabel {
+		b.Label = string([]rune(b.Label)[:maxBadgeLabel])
+	}
+
+	h := fnv.New32a()
+	fmt.Fprintf(h, "%s\x00%s\x00%s\x00%s", b.Label, b.Message, b.Background, extra)
+	return b, fmt.Sprintf(`"%d.%d.%08x"`, snap.Event, snap.Level, h.Sum32()), nil
+}
+
+func parseHexColor(s string) (uint8, uint8, uint8, bool) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) == 3 {
+		s = string([]byte{s[0], s[0], s[1], s[1], s[2], s[2]})
+	}
+	if len(s) != 6 {
+		return 0, 0, 0, false
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return uint8(v >> 16), uint8(v >> 8), uint8(v), true
+}
+
+// textColor picks black or white text, whichever reads better on bg
+func textColor(bg string) string {
+	r, g, b, _ := parseHexColor(bg)
+	if (299*int(r)+587*int(g)+114*int(b))/1000 > 150 {
+		return "#000000"
+	}
+	return "#FFFFFF"
+}
+
+func xmlEscape(s string) string {
+	var buf bytes.Buffer
+	xml.EscapeText(&buf, []byte(s))
+	return buf.String()
+}
+
+// badgeTextWidth estimates how wide s is in 11px Verdana, the SVG sets
+// textLength so viewers squeeze the text to fit whatever we guess
+func badgeTextWidth(s string) int {
+	width := 0
+	for _, r := range s {
+		switch {
+		case strings.ContainsRune("iljtfI.,:;!|' ", r):
+			width += 4
+		case strings.ContainsRune("mwMW", r):
+			width += 10
+		case r >= 'A' && r <= 'Z':
+			width += 8
+		default:
+			width += 7
+		}
+	}
+	return width
+}
+
+// svgWidths returns the widths of the label and message halves of the SVG
+func (b badge) svgWidths() (int, int) {
+	return badgeTextWidth(b.Label) + 10, badgeTextWidth(b.Message) + 10
+}
+
+// pngWidths returns the widths of the label and message halves of the PNG
+// before it's scaled
+func (b badge) pngWidths() (int, int) {
+	face := basicfont.Face7x13
+	return font.MeasureString(face, b.Label).Ceil() + 12, font.MeasureString(face, b.Message).Ceil() + 12
+}
+
+func (b badge) svg() []byte {
+	labelWidth, messageWidth := b.svgWidths()
+	width := labelWidth + messageWidth
+	label, message := xmlEscape(b.Label), xmlEscape(b.Message)
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" width="%d" height="20" role="img" aria-label="%s: %s">`, width, label, message)
+	fmt.Fprintf(&buf, `<title>%s: %s</title>`, label, message)
+	buf.WriteString(`<linearGradient id="s" x2="0" y2="100%"><stop offset="0" stop-color="#bbb" stop-opacity=".1"/><stop offset="1" stop-opacity=".1"/></linearGradient>`)
+	fmt.Fprintf(&buf, `<clipPath id="r"><rect width="%d" height="20" rx="3" fill="#fff"/></clipPath>`, width)
+	fmt.Fprintf(&buf, `<g clip-path="url(#r)"><rect width="%d" height="20" fill="%s"/><rect x="%d" width="%d" height="20" fill="%s"/><rect width="%d" height="20" fill="url(#s)"/></g>`,
+		labelWidth, badgeLabelColor, labelWidth, messageWidth, b.Background, width)
+	buf.WriteString(`<g text-anchor="middle" font-family="Verdana,Geneva,DejaVu Sans,sans-serif" font-size="11">`)
+	fmt.Fprintf(&buf, `<text x="%d" y="14" fill="#fff" textLength="%d">%s</text>`, labelWidth/2, labelWidth-10, label)
+	fmt.Fprintf(&buf, `<text x="%d" y="14" fill="%s" textLength="%d">%s</text>`, labelWidth+messageWidth/2, textColor(b.Background), messageWidth-10, message)
+	buf.WriteString(`</g></svg>`)
+	return buf.Bytes()
+}
+
+func hexToRGBA(s string) color.RGBA {
+	r, g, b, _ := parseHexColor(s)
+	return color.RGBA{r, g, b, 0xff}
+}
+
+// png renders the badge with a fixed bitmap font, scaled up by scale.
+// Characters the font doesn't have are drawn as boxes.
+func (b badge) png(scale int) ([]byte, error) {
+	labelWidth, messageWidth := b.pngWidths()
+	height := badgeHeight
+
+	small := image.NewRGBA(image.Rect(0, 0, labelWidth+messageWidth, height))
+	draw.Draw(small, image.Rect(0, 0, labelWidth, height), image.NewUniform(hexToRGBA(badgeLabelColor)), image.Point{}, draw.Src)
+	draw.Draw(small, image.Rect(labelWidth, 0, labelWidth+messageWidth, height), image.NewUniform(hexToRGBA(b.Background)), image.Point{}, draw.Src)
+
+	d := font.Drawer{Dst: small, Face: basicfont.Face7x13}
+	d.Src = image.NewUniform(color.White)
+	d.Dot = fixed.P(6, 14)
+	d.DrawString(b.Label)
+	d.Src = image.NewUniform(hexToRGBA(textColor(b.Background)))
+	d.Dot = fixed.P(labelWidth+6, 14)
+	d.DrawString(b.Message)
+
+	out := small
+	if scale > 1 {
+		out = image.NewRGBA(image.Rect(0, 0, small.Bounds().Dx()*scale, height*scale))
+		for y := 0; y < out.Bounds().Dy(); y++ {
+			for x := 0; x < out.Bounds().Dx(); x++ {
+				out.SetRGBA(x, y, small.RGBAAt(x/scale, y/scale))
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, out); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// etagMatches reports whether r's If-None-Match lists etag, comparing them
+// weakly as the header requires, or is *
+func etagMatches(r *http.Request, etag string) bool {
+	want := strings.TrimPrefix(etag, "W/")
+	for _, header := range r.Header.Values("If-None-Match") {
+		for header = strings.TrimSpace(header); header != ""; {
+			if header[0] == '*' {
+				return true
+			}
+
+			tag := strings.TrimPrefix(header, "W/")
+			end := strings.IndexByte(tag, ',')
+			if strings.HasPrefix(tag, `"`) {
+				// Quoted tags can have commas in them
+				if close := strings.IndexByte(tag[1:], '"'); close >= 0 {
+					end = close + 2
+				} else {
+					end = -1
+				}
+			}
+			if end < 0 {
+				end = len(tag)
+			}
+			if tag[:end] == want {
+				return true
+			}
+
+			header = strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(tag[end:]), ","))
+		}
+	}
+	return false
+}
+
+// serveBadge sends a rendered badge. Clients have to revalidate every time,
+// which is cheap since the ETag only changes with the level.
+func serveBadge(w http.ResponseWriter, r *http.Request, contentType, etag string, render func() ([]byte, error)) {
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	w.Header().Add("Vary", "Accept-Language")
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	body, err := render()
+	if err != nil {
+		log.Errorf("Could not render badge: %s", err.Error())
+		w.Header().Del("ETag")
+		http.Error(w, "could not render badge", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Length", strconv.Itoa(len(body)))
+	if r.Method != http.MethodHead {
+		w.Write(body)
+	}
+}
+
+func badgeSVGHandler(w http.ResponseWriter, r *http.Request) {
+	b, etag, err := currentBadge(r, "svg")
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+		http.Error(w, "could not load levels", http.StatusInternalServerError)
+		return
+	}
+
+	serveBadge(w, r, "image/svg+xml", etag, func() ([]byte, error) {
+		return b.svg(), nil
+	})
+}
+
+func statusPNGHandler(w http.ResponseWriter, r *http.Request) {
+	scale := 2
+	if s := r.URL.Query().Get("scale"); s != "" {
+		n, err := strconv.Atoi(s)
+		if err != nil || n < 1 || n > maxStatusScale {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusBadRequest)
+			w.Write([]byte(fmt.Sprintf("scale must be between 1 and %d", maxStatusScale)))
+			return
+		}
+		scale = n
+	}
+
+	b, etag, err := currentBadge(r, "png"+strconv.Itoa(scale))
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+		http.Error(w, "could not load levels", http.StatusInternalServerError)
+		return
+	}
+
+	serveBadge(w, r, "image/png", etag, func() ([]byte, error) {
+		return b.png(scale)
+	})
+}
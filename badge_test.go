@@ -0,0 +1,66 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net/http/httptest"
+	"testing"
+)
+
+func TestETagMatches(t *testing.T) {
+	tests := []struct {
+		header string
+		etag   string
+		want   bool
+	}{
+		{``, `"1.2.abc"`, false},
+		{`"1.2.abc"`, `"1.2.abc"`, true},
+		{`W/"1.2.abc"`, `"1.2.abc"`, true},
+		{`"1.2.abc"`, `W/"1.2.abc"`, true},
+		{`"other", "1.2.abc"`, `"1.2.abc"`, true},
+		{`"other",W/"1.2.abc"`, `"1.2.abc"`, true},
+		{`"a,b", "c"`, `"c"`, true},
+		{`"a,b"`, `"b"`, false},
+		{`"1.2.ab"`, `"1.2.abc"`, false},
+		{`*`, `"1.2.abc"`, true},
+		{`d41d8cd98f00b204e9800998ecf8427e`, `d41d8cd98f00b204e9800998ecf8427e`, true},
+	}
+
+	for _, test := range tests {
+		r := httptest.NewRequest("GET", "/badge.svg", nil)
+		if test.header != "" {
+			r.Header.Set("If-None-Match", test.header)
+		}
+		if got := etagMatches(r, test.etag); got != test.want {
+			t.Errorf("If-None-Match: %s against %s = %t, want %t", test.header, test.etag, got, test.want)
+		}
+	}
+}
+
+func TestBadgeMessageIsText(t *testing.T) {
+	snap := levelSnapshot{Level: 3, Definition: levelDefinition{Title: `<b>Very</b> &amp; <i>angry</i>`}}
+	if got := snap.badge().Message; got != "Very & angry" {
+		t.Errorf("badge message = %q", got)
+	}
+	if got := (levelSnapshot{Level: 3}).badge().Message; got != "3" {
+		t.Errorf("untitled badge message = %q", got)
+	}
+}
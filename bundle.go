@@ -0,0 +1,329 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// bundleVersion is the version of the bundle format this server writes.
+// Importing accepts anything up to it.
+const bundleVersion = 1
+
+// maxBundleSize is the most a bundle upload can be
+const maxBundleSize = 1 << 20
+
+// levelBundle is a board's whole configuration as one file. The levels carry
+// their colors, translations, and approval policies with them.
+type levelBundle struct {
+	Version  int       `json:"version"`
+	Exported time.Time `json:"exported"`
+	Levels   levelSet  `json:"levels"`
+}
+
+// levelChange is one difference between two sets of levels
+type levelChange struct {
+	Level  int    `json:"level"`
+	Change string `json:"change"`
+	Title  string `json:"title"`
+	// Fields lists what changed on a level that's in both
+	Fields []string `json:"fields,omitempty"`
+}
+
+func (c levelChange) String() string {
+	switch c.Change {
+	case "added":
+		return fmt.Sprintf("+ %d %s", c.Level, c.Title)
+	case "removed":
+		return fmt.Sprintf("- %d %s", c.Level, c.Title)
+	}
+	return fmt.Sprintf("~ %d %s: %s", c.Level, c.Title, strings.Join(c.Fields, ", "))
+}
+
+func newBundle(levels levelSet) levelBundle {
+	return levelBundle{Version: bundleVersion, Exported: time.Now().UTC(), Levels: levels}
+}
+
+// encode writes the bundle like levels.json, indented and with the HTML in
+// descriptions left readable
+func (b levelBundle) encode() ([]byte, error) {
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(b); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// readBundle decodes and checks a bundle, returning its levels
+func readBundle(r io.Reader) (levelSet, error) {
+	bundle := levelBundle{}
+	if err := json.NewDecoder(r).Decode(&bundle); err != nil {
+		return nil, fmt.Errorf("could not read bundle: %s", err.Error())
+	}
+
+	if bundle.Version < 1 {
+		return nil, errors.New("not a bundle, it has no version")
+	}
+	if bundle.Version > bundleVersion {
+		return nil, fmt.Errorf("bundle version %d is newer than this server understands", bundle.Version)
+	}
+
+	if err := bundle.Levels.validate(); err != nil {
+		return nil, err
+	}
+	return bundle.Levels, nil
+}
+
+// validate checks that the levels can run a board, they have to be numbered
+// from 0 up without gaps since changes only ever move one level at a time
+func (l levelSet) validate() error {
+	if len(l) == 0 {
+		return errors.New("there are no levels")
+	}
+	for i, n := range l.sortedLevels() {
+		if n != i {
+			return fmt.Errorf("levels must be numbered 0 to %d, level %d is missing", len(l)-1, i)
+		}
+		if strings.TrimSpace(l[n].Title) == "" {
+			return fmt.Errorf("level %d has no title", n)
+		}
+		if _, _, _, ok := parseHexColor(l[n].Background); !ok {
+			return fmt.Errorf("level %d's background %q is not a hex color", n, l[n].Background)
+		}
+	}
+	return l.validateLocales()
+}
+
+// diffLevels lists what replacing from with to would change, lowest level
+// first
+func diffLevels(from, to levelSet) []levelChange {
+	numbers := map[int]bool{}
+	for n := range from {
+		numbers[n] = true
+	}
+	for n := range to {
+		numbers[n] = true
+	}
+	all := levelSet{}
+	for n := range numbers {
+		all[n] = levelDefinition{}
+	}
+
+	changes := []levelChange{}
+	for _, n := range all.sortedLevels() {
+		old, hadOld := from[n]
+		def, hasNew := to[n]
+		switch {
+		case !hadOld:
+			changes = append(changes, levelChange{Level: n, Change: "added", Title: def.Title})
+		case !hasNew:
+			changes = append(changes, levelChange{Level: n, Change: "removed", Title: old.Title})
+		default:
+			fields := []string{}
+			if old.Title != def.Title {
+				fields = append(fields, "title")
+			}
+			if old.Description != def.Description {
+				fields = append(fields, "description")
+			}
+			if old.Background != def.Background {
+				fields = append(fields, "background")
+			}
+			if len(old.Locales)+len(def.Locales) > 0 && !reflect.DeepEqual(old.Locales, def.Locales) {
+				fields = append(fields, "locales")
+			}
+			if !reflect.DeepEqual(old.Approval, def.Approval) {
+				fields = append(fields, "approval")
+			}
+			if len(fields) > 0 {
+				changes = append(changes, levelChange{Level: n, Change: "changed", Title: def.Title, Fields: fields})
+			}
+		}
+	}
+	return changes
+}
+
+// replaceLevels swaps in a new set of levels. If the board is above the new
+// top level it's brought down to it, and a pending change to a level that no
+// longer exists is rejected.
+func replaceLevels(levels levelSet, actor string) error {
+	levelMu.Lock()
+	defer levelMu.Unlock()
+
+	if err := store.SetLevels(levels); err != nil {
+		return err
+	}
+
+	top := len(levels) - 1
+	if p := pendingLevel; p != nil && p.Level > top {
+		recordResolutionLocked(historyRejected, actor)
+		log.Infof("Rejected request for level %d by %s, it was removed", p.Level, p.Requester)
+		events.publish(levelPending{Change: p, Status: historyRejected, By: actor})
+	}
+
+	newlvl := level
+	if newlvl > top {
+		newlvl = top
+	}
+	// Broadcasts the new definition even when the level doesn't move
+	return setLevelLocked(newlvl, actor, "", "levels were replaced")
+}
+
+// importLevelsRequest reads the levels to import from a built-in template
+// named by ?template=, or a bundle in the body
+func importLevelsRequest(r *http.Request) (levelSet, error) {
+	if name := r.URL.Query().Get("template"); name != "" {
+		levels, exists := levelTemplate(name)
+		if !exists {
+			return nil, fmt.Errorf("unknown template %q, expected one of %s", name, strings.Join(templateNames(), ", "))
+		}
+		return levels, nil
+	}
+	return readBundle(io.LimitReader(r.Body, maxBundleSize))
+}
+
+func exportLevelsHandler(w http.ResponseWriter, r *http.Request) {
+	_, attr, ok := authRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if attr.role() != roleAdmin {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("token is not an admin"))
+		return
+	}
+
+	levels, err := store.Levels()
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not load levels"))
+		return
+	}
+
+	j, err := newBundle(levels).encode()
+	if err != nil {
+		log.Errorf("Could not encode levels: %s", err.Error())
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not encode levels"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Disposition", `attachment; filename="jmaas-levels.json"`)
+	w.Write(j)
+}
+
+// importLevelsHandler replaces the levels with a bundle POSTed as the body
+// or a built-in template. With ?dry_run=true it only reports the changes.
+func importLevelsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("import needs a POST"))
+		return
+	}
+
+	_, attr, ok := authRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if attr.role() != roleAdmin {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("token is not an admin"))
+		return
+	}
+
+	levels, err := importLevelsRequest(r)
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	current, err := store.Levels()
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not load levels"))
+		return
+	}
+	changes := diffLevels(current, levels)
+
+	dryRun, _ := strconv.ParseBool(r.URL.Query().Get("dry_run"))
+	if !dryRun && len(changes) > 0 {
+		if err := replaceLevels(levels, attr.Note); err != nil {
+			log.Errorf("Could not save levels: %s", err.Error())
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusInternalServerError)
+			w.Write([]byte("could not save levels"))
+			return
+		}
+		log.Infof("%s imported %d levels with %d changes", attr.Note, len(levels), len(changes))
+		events.publish(levelsEdited{Time: time.Now(), Actor: attr.Note, Levels: len(levels), Changes: changes})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]interface{}{
+		"applied": !dryRun && len(changes) > 0,
+		"changes": changes,
+	})
+	w.Write(j)
+}
+
+// templatesHandler lists the built-in templates with their levels' titles
+func templatesHandler(w http.ResponseWriter, r *http.Request) {
+	templates := map[string][]string{}
+	for _, name := range templateNames() {
+		levels, _ := levelTemplate(name)
+		titles := []string{}
+		for _, n := range levels.sortedLevels() {
+			titles = append(titles, levels[n].Title)
+		}
+		templates[name] = titles
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	j, _ := json.Marshal(templates)
+	w.Write(j)
+}
@@ -0,0 +1,249 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"github.com/go-playground/log"
+	"net/http"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	// calendarDefaultDays is how much history the feed has without a from
+	calendarDefaultDays = 90
+	// calendarRefresh is how often calendar apps are asked to check again
+	calendarRefresh = "PT15M"
+	icsTime         = "20060102T150405Z"
+)
+
+// levelPeriod is a span of time the board spent at one level, End is zero
+// for the current level
+type levelPeriod struct {
+	Entry historyEntry
+	Start time.Time
+	End   time.Time
+}
+
+// levelPeriods calls fn with every period that overlaps from to to, oldest
+// first, starting with the one the level was in at from. A period only starts
+// with a change in the history, the level before the first change isn't
+// known. Only the period waiting for the next change is held, so a feed
+// doesn't read the whole history.
+func levelPeriods(from, to time.Time, fn func(levelPeriod) error) error {
+	var current *levelPeriod
+	if !from.IsZero() {
+		entry, found, err := store.LastLevelChange(from)
+		if err != nil {
+			return err
+		}
+		if found {
+			current = &levelPeriod{Entry: entry, Start: entry.Time}
+		}
+	}
+
+	err := store.History(from, to, func(entry historyEntry) error {
+		if entry.Kind != "" {
+			return nil
+		}
+		if current != nil {
+			current.End = entry.Time
+			if err := fn(*current); err != nil {
+				return err
+			}
+		}
+		current = &levelPeriod{Entry: entry, Start: entry.Time}
+		return nil
+	})
+	if err != nil || current == nil {
+		return err
+	}
+	return fn(*current)
+}
+
+// requestToken is the Token header, or the token query parameter for feeds
+// and downloads that can't send headers
+func requestToken(r *http.Request) string {
+	if token := r.Header.Get("Token"); token != "" {
+		return token
+	}
+	return r.URL.Query().Get("token")
+}
+
+// parseRangeParam reads a from or to query parameter, either RFC 3339 or a
+// plain date taken as midnight UTC
+func parseRangeParam(r *http.Request, name string) (time.Time, error) {
+	value := r.URL.Query().Get(name)
+	if value == "" {
+		return time.Time{}, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return t, nil
+	}
+	if t, err := time.Parse("2006-01-02", value); err == nil {
+		return t, nil
+	}
+	return time.Time{}, fmt.Errorf("%s must be a date like 2017-06-01 or an RFC 3339 time", name)
+}
+
+// historyCalendarHandler publishes the level history as an iCalendar feed,
+// one event per period at a level, for overlaying on a team calendar. It
+// takes from and to, and name for the calendar's name. Each event's UID
+// includes the host, so several boards' feeds can be overlaid. A board with
+// history.private on needs a token, in the URL since calendar apps can't
+// send headers.
+func historyCalendarHandler(w http.ResponseWriter, r *http.Request) {
+	if cfg.HistoryPrivate {
+		if _, _, ok := authToken(w, r, requestToken(r)); !ok {
+			return
+		}
+	}
+
+	now := time.Now()
+	from, err := parseRangeParam(r, "from")
+	if err == nil && from.IsZero() {
+		from = now.AddDate(0, 0, -calendarDefaultDays)
+	}
+	to, toErr := parseRangeParam(r, "to")
+	if err == nil {
+		err = toErr
+	}
+	if err == nil && !to.IsZero() && !to.After(from) {
+		err = fmt.Errorf("to must be after from")
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	levels, err := store.Levels()
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+	}
+	locale := negotiateLocale(r, levels)
+	levels = levels.localized(locale)
+	setLocaleHeaders(w, locale)
+
+	name := cleanLine(r.URL.Query().Get("name"))
+	if name == "" {
+		name = siteName
+	}
+
+	w.Header().Set("Content-Type", "text/calendar; charset=utf-8")
+	w.Header().Set("Content-Disposition", `inline; filename="history.ics"`)
+	w.Header().Set("Cache-Control", "no-cache")
+
+	cal := &icsWriter{bufio.NewWriter(w)}
+	cal.line("BEGIN", "VCALENDAR")
+	cal.line("VERSION", "2.0")
+	cal.line("PRODID", "-//jmaas//Level History//EN")
+	cal.line("CALSCALE", "GREGORIAN")
+	cal.line("METHOD", "PUBLISH")
+	cal.text("X-WR-CALNAME", name)
+	cal.line("REFRESH-INTERVAL;VALUE=DURATION", calendarRefresh)
+	cal.line("X-PUBLISHED-TTL", calendarRefresh)
+
+	host := r.Host
+	if i := strings.LastIndex(host, ":"); i > 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	err = levelPeriods(from, to, func(p levelPeriod) error {
+		end := p.End
+		if end.IsZero() {
+			end = now
+		}
+		title := excerpt(levels[p.Entry.Level].Title)
+		if title == "" {
+			title = fmt.Sprintf("Level %d", p.Entry.Level)
+		}
+
+		description := []string{}
+		if p.Entry.Reason != "" {
+			description = append(description, p.Entry.Reason)
+		}
+		if p.Entry.Actor != "" {
+			by := "Set by " + p.Entry.Actor
+			if p.Entry.ApprovedBy != "" {
+				by += ", approved by " + p.Entry.ApprovedBy
+			}
+			description = append(description, by)
+		}
+		if p.End.IsZero() {
+			description = append(description, "Still the current level")
+		}
+
+		cal.line("BEGIN", "VEVENT")
+		cal.line("UID", fmt.Sprintf("level-%d@%s", p.Entry.ID, host))
+		cal.line("DTSTAMP", now.UTC().Format(icsTime))
+		cal.line("DTSTART", p.Start.UTC().Format(icsTime))
+		cal.line("DTEND", end.UTC().Format(icsTime))
+		cal.text("SUMMARY", title)
+		if len(description) > 0 {
+			cal.text("DESCRIPTION", strings.Join(description, "\n"))
+		}
+		cal.text("CATEGORIES", fmt.Sprintf("Level %d", p.Entry.Level))
+		cal.line("URL", baseURL(r)+"/")
+		cal.line("TRANSP", "TRANSPARENT")
+		cal.line("END", "VEVENT")
+		return nil
+	})
+	if err != nil {
+		// Like an export, the status is gone by now and the feed is left
+		// unfinished for the calendar app to throw away
+		log.Errorf("Could not read history: %s", err.Error())
+		return
+	}
+	cal.line("END", "VCALENDAR")
+	cal.Flush()
+}
+
+// icsWriter writes iCalendar content lines, folded at 75 bytes (RFC 5545
+// section 3.1) without splitting a UTF-8 character
+type icsWriter struct {
+	*bufio.Writer
+}
+
+func (c *icsWriter) line(name, value string) {
+	line := name + ":" + value
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		for !utf8.RuneStart(line[cut]) {
+			cut--
+		}
+		c.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		// The space starting a continuation counts toward its length
+		limit = 74
+	}
+	c.WriteString(line + "\r\n")
+}
+
+// text writes a TEXT value, escaped
+func (c *icsWriter) text(name, value string) {
+	value = strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r\n", `\n`, "\n", `\n`).Replace(value)
+	c.line(name, value)
+}
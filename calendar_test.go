@@ -0,0 +1,122 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// calendarTestHistory records changes to levels 1, 2, 3 and 4 a day apart,
+// with a request in between that doesn't start a period
+func calendarTestHistory(t *testing.T) time.Time {
+	start := time.Date(2026, 5, 1, 12, 0, 0, 0, time.UTC)
+	for i, entry := range []historyEntry{
+		{Level: 1, Actor: "operator"},
+		{Level: 2, Actor: "operator", Reason: "deploy"},
+		{Level: 3, Kind: historyRequested, Actor: "operator"},
+		{Level: 3, Actor: "operator", ApprovedBy: "admin"},
+		{Level: 4, Actor: "operator"},
+	} {
+		entry.Time = start.AddDate(0, 0, i)
+		if _, err := store.AppendHistory(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+	return start
+}
+
+func TestLevelPeriods(t *testing.T) {
+	setupTestServer(t)
+	start := calendarTestHistory(t)
+
+	periods := func(from, to time.Time) []levelPeriod {
+		out := []levelPeriod{}
+		if err := levelPeriods(from, to, func(p levelPeriod) error {
+			out = append(out, p)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return out
+	}
+
+	all := periods(time.Time{}, time.Time{})
+	if len(all) != 4 {
+		t.Fatalf("got %d periods, want 4", len(all))
+	}
+	for i, p := range all {
+		if p.Entry.Level != i+1 {
+			t.Errorf("period %d is at level %d, want %d", i, p.Entry.Level, i+1)
+		}
+		if i < 3 && !p.End.Equal(all[i+1].Start) {
+			t.Errorf("period %d ends at %s, want the next one's start %s", i, p.End, all[i+1].Start)
+		}
+	}
+	if !all[2].Start.Equal(start.AddDate(0, 0, 3)) || !all[3].End.IsZero() {
+		t.Errorf("level 3 started at %s, and the current period ends at %s", all[2].Start, all[3].End)
+	}
+
+	// A range starting inside a period starts with that period, the
+	// request in between doesn't end it
+	ranged := periods(start.AddDate(0, 0, 2), start.AddDate(0, 0, 4))
+	if len(ranged) != 2 || ranged[0].Entry.Level != 2 || !ranged[0].Start.Equal(start.AddDate(0, 0, 1)) || ranged[1].Entry.Level != 3 {
+		t.Errorf("periods from day 2 to 4 are %+v", ranged)
+	}
+
+	if before := periods(start.AddDate(0, 0, -2), start.AddDate(0, 0, -1)); len(before) != 0 {
+		t.Errorf("periods before the first change are %+v", before)
+	}
+}
+
+func TestHistoryCalendar(t *testing.T) {
+	setupTestServer(t)
+	start := calendarTestHistory(t)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("GET", "/api/history.ics?from="+start.AddDate(0, 0, 2).Format(time.RFC3339)+"&name=Team", nil)
+	historyCalendarHandler(w, r)
+	if w.Code != http.StatusOK || w.Header().Get("Content-Type") != "text/calendar; charset=utf-8" {
+		t.Fatalf("feed answered %d with %s", w.Code, w.Header().Get("Content-Type"))
+	}
+
+	feed := w.Body.String()
+	if !strings.HasPrefix(feed, "BEGIN:VCALENDAR\r\n") || !strings.HasSuffix(feed, "END:VCALENDAR\r\n") {
+		t.Errorf("feed is not a whole calendar:\n%s", feed)
+	}
+	if n := strings.Count(feed, "BEGIN:VEVENT"); n != 3 {
+		t.Errorf("feed has %d events, want levels 2, 3 and 4:\n%s", n, feed)
+	}
+	for _, want := range []string{
+		"X-WR-CALNAME:Team",
+		"DTSTART:" + start.AddDate(0, 0, 1).Format(icsTime),
+		"SUMMARY:Annoyed",
+		"DESCRIPTION:Set by operator\\, approved by admin",
+		"DESCRIPTION:Set by operator\\nStill the current level",
+	} {
+		if !strings.Contains(feed, want+"\r\n") {
+			t.Errorf("feed is missing %s:\n%s", want, feed)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+// The service worker only shows push notifications, the board itself always
+// comes from the network
+
+self.addEventListener("push", e => {
+  let n = e.data ? e.data.json() : {};
+  e.waitUntil(self.registration.showNotification(n.title || "The Josh Mills Anger Advisory System", {
+    body: n.body,
+    icon: "/static/icon-256.png",
+    // A newer level replaces an older one still on screen
+    tag: "jmaas-level",
+    renotify: true,
+    data: { url: n.url || "/" },
+  }));
+});
+
+self.addEventListener("notificationclick", e => {
+  e.notification.close();
+  e.waitUntil(clients.matchAll({ type: "window" }).then(windows => {
+    for (let w of windows) {
+      if (new URL(w.url).origin == self.location.origin && "focus" in w) {
+        return w.focus();
+      }
+    }
+    return clients.openWindow(e.notification.data.url);
+  }));
+});
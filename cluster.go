@@ -0,0 +1,558 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-playground/log"
+	"os"
+	"sort"
+	"sync"
+	"time"
+)
+
+// A cluster is several servers behind one load balancer, each with its own
+// store. They share the live state over a backplane: the level, its reason,
+// any pending change, reactions, presence, and edits to the levels. The
+// newest version of the state wins, and every node sends its state on each
+// heartbeat so one that missed a message, or just started, catches up.
+// History stays in each node's own store.
+//
+// Tokens and notification subscriptions are copied to the other nodes as
+// they're put or deleted, encrypted since they're secrets. There's no
+// heartbeat for them, so a node that was down while they changed has to be
+// started from a copy of another's data directory. Changes made offline with
+// jmaas tokens stay on that node. Each subscription is notified by the node
+// it was made on, so it isn't notified once per node.
+//
+// A version is the time of the change in nanoseconds, but never less than
+// one past the version the node already has, so a change made after seeing
+// another always wins over it whatever the clocks say. Only changes made on
+// two nodes before either heard of the other are settled by the clock, the
+// later one by the node's own time winning, and the one whose event key sorts
+// last if the times are the same. A node whose clock runs ahead wins those
+// races, so keep the clocks in sync.
+
+// nodeID names this server in a cluster, and in the keys of its events
+var nodeID string
+
+var cluster struct {
+	backplane backplane
+
+	// sendMu keeps messages going out in the order of their Seq
+	sendMu  sync.Mutex
+	lastSeq int64
+
+	mu sync.Mutex
+	// seq is the last Seq taken from every other node
+	seq map[string]int64
+	// presence is what every other node last said about its sockets
+	presence map[string]nodePresence
+	// sentPresence is what we last said about ours
+	sentPresence *presence
+}
+
+type nodePresence struct {
+	presence
+	seen time.Time
+}
+
+// clusterMessage is what nodes send each other, Type says which of the
+// other fields is set. Seq goes up with every message a node sends, so one
+// can't be taken twice.
+type clusterMessage struct {
+	Node     string           `json:"node"`
+	Seq      int64            `json:"seq"`
+	Type     string           `json:"type"`
+	State    *serverState     `json:"state,omitempty"`
+	Change   *historyEntry    `json:"change,omitempty"`
+	Reaction *clusterReaction `json:"reaction,omitempty"`
+	Presence *presence        `json:"presence,omitempty"`
+	Levels   levelSet         `json:"levels,omitempty"`
+	// Record is a sealed clusterRecord
+	Record []byte `json:"record,omitempty"`
+}
+
+// clusterRecord is a token or subscription put or deleted on another node,
+// a nil TokenAttr or Subscription deletes
+type clusterRecord struct {
+	Token          string        `json:"token,omitempty"`
+	TokenAttr      *tokenAttr    `json:"tokenAttr,omitempty"`
+	SubscriptionID string        `json:"subscriptionId,omitempty"`
+	Subscription   *subscription `json:"subscription,omitempty"`
+}
+
+type clusterReaction struct {
+	EventKey string `json:"eventKey"`
+	Reaction string `json:"reaction"`
+}
+
+// Cluster message types
+const (
+	clusterState    = "state"
+	clusterReact    = "reaction"
+	clusterPresence = "presence"
+	clusterLevels   = "levels"
+	clusterRecords  = "record"
+)
+
+// setupNodeID picks the node's name, cluster.node_id if it's set or the
+// hostname and pid otherwise
+func setupNodeID() {
+	if cfg.ClusterNodeID != "" {
+		nodeID = cfg.ClusterNodeID
+		return
+	}
+	host, err := os.Hostname()
+	if err != nil {
+		host = "jmaas"
+	}
+	nodeID = fmt.Sprintf("%s-%d", host, os.Getpid())
+}
+
+// eventKey names a level change made on this node
+func eventKey(historyID int64) string {
+	return fmt.Sprintf("%s/%d", nodeID, historyID)
+}
+
+// startCluster joins the cluster on cluster.backplane, if there is one
+func startCluster() {
+	switch cfg.ClusterBackplane {
+	case "":
+		return
+	case "redis":
+		cluster.backplane = newRedisBackplane()
+	case "http":
+		cluster.backplane = newHTTPBackplane()
+	}
+	cluster.presence = map[string]nodePresence{}
+	cluster.seq = map[string]int64{}
+	store = clusterStore{Store: store}
+
+	if cfg.MQTTCommandTopic != "" {
+		log.Warn("Every node in the cluster acts on MQTT commands, set mqtt.command_topic on only one of them")
+	}
+
+	events.subscribe("cluster", clusterEvents)
+	cluster.backplane.receive(receiveClusterMessage)
+	go clusterHeartbeat()
+	log.Infof("Joined the cluster as %s over %s", nodeID, cfg.ClusterBackplane)
+}
+
+func stopCluster() {
+	if cluster.backplane != nil {
+		cluster.backplane.stop()
+	}
+}
+
+// sendClusterMessage numbers msg and sends it. Seq starts from the time, so
+// it keeps going up across restarts.
+func sendClusterMessage(msg clusterMessage) {
+	cluster.sendMu.Lock()
+	defer cluster.sendMu.Unlock()
+
+	msg.Node = nodeID
+	msg.Seq = time.Now().UnixNano()
+	if msg.Seq <= cluster.lastSeq {
+		msg.Seq = cluster.lastSeq + 1
+	}
+	j, err := json.Marshal(msg)
+	if err != nil {
+		log.Errorf("Could not encode cluster message: %s", err.Error())
+		return
+	}
+	cluster.lastSeq = msg.Seq
+	cluster.backplane.send(j)
+}
+
+// takeClusterSeq reports whether seq is newer than anything node sent
+// before. Signatures stop anyone else making messages, this stops a signed
+// one being sent again while its time is still good.
+func takeClusterSeq(node string, seq int64) bool {
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	if seq <= cluster.seq[node] {
+		return false
+	}
+	cluster.seq[node] = seq
+	return true
+}
+
+// clusterStore is the store in a cluster, it sends token and subscription
+// changes on to the other nodes. Deletes are sent even when there was
+// nothing here to delete, another node may have it.
+type clusterStore struct {
+	Store
+}
+
+func (s clusterStore) PutToken(token string, attr tokenAttr) error {
+	if err := s.Store.PutToken(token, attr); err != nil {
+		return err
+	}
+	sendClusterRecord(clusterRecord{Token: token, TokenAttr: &attr})
+	return nil
+}
+
+func (s clusterStore) DeleteToken(token string) (bool, error) {
+	deleted, err := s.Store.DeleteToken(token)
+	if err == nil {
+		sendClusterRecord(clusterRecord{Token: token})
+	}
+	return deleted, err
+}
+
+func (s clusterStore) PutSubscription(sub subscription) error {
+	if err := s.Store.PutSubscription(sub); err != nil {
+		return err
+	}
+	sendClusterRecord(clusterRecord{SubscriptionID: sub.ID, Subscription: &sub})
+	return nil
+}
+
+func (s clusterStore) DeleteSubscription(id string) (bool, error) {
+	deleted, err := s.Store.DeleteSubscription(id)
+	if err == nil {
+		sendClusterRecord(clusterRecord{SubscriptionID: id})
+	}
+	return deleted, err
+}
+
+func sendClusterRecord(r clusterRecord) {
+	j, err := json.Marshal(r)
+	if err != nil {
+		log.Errorf("Could not encode cluster record: %s", err.Error())
+		return
+	}
+	sealed, err := sealClusterData(j)
+	if err != nil {
+		log.Errorf("Could not seal cluster record: %s", err.Error())
+		return
+	}
+	sendClusterMessage(clusterMessage{Type: clusterRecords, Record: sealed})
+}
+
+// sendState tells the other nodes our state, along with the history entry
+// for the current level when it's ours so they can record it too
+func sendState() {
+	levelMu.RLock()
+	state := currentStateLocked()
+	levelMu.RUnlock()
+	sendClusterMessage(clusterMessage{Type: clusterState, State: &state})
+}
+
+// clusterEvents is the cluster's subscriber, sending changes made here to
+// the other nodes
+func clusterEvents(e event) {
+	switch e := e.(type) {
+	case levelChanged:
+		if !e.Remote {
+			change := historyEntry{Time: e.Time, Level: e.Level, Previous: e.Previous, Actor: e.Actor, ApprovedBy: e.ApprovedBy, Reason: e.Reason}
+			levelMu.RLock()
+			state := currentStateLocked()
+			levelMu.RUnlock()
+			sendClusterMessage(clusterMessage{Type: clusterState, State: &state, Change: &change})
+		}
+	case levelPending:
+		if !e.Remote {
+			sendState()
+		}
+	case reactionsChanged:
+		if !e.Remote && e.Reaction != "" {
+			sendClusterMessage(clusterMessage{Type: clusterReact, Reaction: &clusterReaction{EventKey: e.Key, Reaction: e.Reaction}})
+		}
+	case levelsEdited:
+		levels, err := store.Levels()
+		if err != nil {
+			log.Errorf("Could not load levels: %s", err.Error())
+			return
+		}
+		sendClusterMessage(clusterMessage{Type: clusterLevels, Levels: levels})
+	case presenceChanged:
+		sendPresence(false)
+	}
+}
+
+// sendPresence sends our own sockets' presence when it's changed since we
+// last did, or always on a heartbeat
+func sendPresence(always bool) {
+	local := webSocketPool.presence()
+
+	cluster.mu.Lock()
+	unchanged := cluster.sentPresence != nil && samePresence(*cluster.sentPresence, local)
+	cluster.sentPresence = &local
+	cluster.mu.Unlock()
+
+	if always || !unchanged {
+		sendClusterMessage(clusterMessage{Type: clusterPresence, Presence: &local})
+	}
+}
+
+func samePresence(a, b presence) bool {
+	if a.Viewers != b.Viewers || a.Kiosks != b.Kiosks || len(a.Operators) != len(b.Operators) {
+		return false
+	}
+	for i := range a.Operators {
+		if a.Operators[i] != b.Operators[i] {
+			return false
+		}
+	}
+	return true
+}
+
+func clusterHeartbeat() {
+	ticker := time.NewTicker(cfg.ClusterHeartbeat)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		sendState()
+		if cfg.EnablePresence {
+			sendPresence(true)
+			expireClusterPresence()
+		}
+	}
+}
+
+// expireClusterPresence forgets nodes that have gone quiet
+func expireClusterPresence() {
+	cluster.mu.Lock()
+	expired := false
+	for node, p := range cluster.presence {
+		if time.Since(p.seen) > 3*cfg.ClusterHeartbeat {
+			delete(cluster.presence, node)
+			expired = true
+		}
+	}
+	cluster.mu.Unlock()
+
+	if expired {
+		schedulePresence()
+	}
+}
+
+// clusterPresenceTotal adds every other node's presence to ours
+func clusterPresenceTotal(local presence) presence {
+	if cluster.backplane == nil {
+		return local
+	}
+
+	cluster.mu.Lock()
+	defer cluster.mu.Unlock()
+
+	seen := map[string]bool{}
+	for _, note := range local.Operators {
+		seen[note] = true
+	}
+	for _, p := range cluster.presence {
+		local.Viewers += p.Viewers
+		local.Kiosks += p.Kiosks
+		for _, note := range p.Operators {
+			if !seen[note] {
+				seen[note] = true
+				local.Operators = append(local.Operators, note)
+			}
+		}
+	}
+	sort.Strings(local.Operators)
+	return local
+}
+
+func receiveClusterMessage(data []byte) {
+	msg := clusterMessage{}
+	if err := json.Unmarshal(data, &msg); err != nil {
+		log.Warnf("Ignored a bad cluster message: %s", err.Error())
+		return
+	}
+	if msg.Node == nodeID || msg.Node == "" {
+		return
+	}
+	if !takeClusterSeq(msg.Node, msg.Seq) {
+		log.Warnf("Ignored a %s message from %s that was already taken", msg.Type, msg.Node)
+		return
+	}
+
+	switch msg.Type {
+	case clusterState:
+		if msg.State != nil {
+			applyClusterState(*msg.State, msg.Change)
+		}
+	case clusterReact:
+		if msg.Reaction != nil {
+			applyClusterReaction(*msg.Reaction)
+		}
+	case clusterPresence:
+		if msg.Presence != nil {
+			cluster.mu.Lock()
+			last, known := cluster.presence[msg.Node]
+			cluster.presence[msg.Node] = nodePresence{presence: *msg.Presence, seen: time.Now()}
+			cluster.mu.Unlock()
+			if !known || !samePresence(last.presence, *msg.Presence) {
+				schedulePresence()
+			}
+		}
+	case clusterLevels:
+		applyClusterLevels(msg.Levels)
+	case clusterRecords:
+		applyClusterRecord(msg.Record)
+	}
+}
+
+// applyClusterState takes another node's state if it's newer than ours. A
+// new level is recorded in our history too, from change when it came with
+// one.
+func applyClusterState(state serverState, change *historyEntry) {
+	levelMu.Lock()
+	defer levelMu.Unlock()
+
+	if state.Version < levelVersion || (state.Version == levelVersion && state.EventKey <= levelEventKey) {
+		return
+	}
+
+	levelChangedTo := state.EventKey != levelEventKey
+	previous := level
+	if levelChangedTo {
+		entry := historyEntry{Time: time.Now(), Level: state.Level, Previous: level, Reason: state.Reason}
+		if change != nil {
+			entry = *change
+			entry.ID = 0
+		}
+		id, err := store.AppendHistory(entry)
+		if err != nil {
+			log.Errorf("Could not write history: %s", err.Error())
+		}
+		level = state.Level
+		levelReason = state.Reason
+		levelEventKey = state.EventKey
+		resetReactions(id, state.EventKey, nil)
+		log.Infof("Level changed from %d to %d on another node", previous, level)
+	}
+
+	oldPending := pendingLevel
+	pendingLevel = state.Pending
+	if pendingTimer != nil {
+		pendingTimer.Stop()
+		pendingTimer = nil
+	}
+	if pendingLevel != nil {
+		schedulePendingExpiryLocked()
+	}
+
+	levelVersion = state.Version
+	if err := store.SetState(currentStateLocked()); err != nil {
+		log.Errorf("Could not save state: %s", err.Error())
+	}
+
+	if levelChangedTo {
+		e := levelChanged{Time: time.Now(), Level: level, Previous: previous, Event: currentEvent(), Reason: levelReason, Remote: true}
+		if change != nil {
+			e.Time, e.Actor, e.ApprovedBy = change.Time, change.Actor, change.ApprovedBy
+		}
+		events.publish(e)
+	}
+	switch {
+	case pendingLevel != nil && (oldPending == nil || oldPending.ID != pendingLevel.ID):
+		events.publish(levelPending{Change: pendingLevel, Status: "pending", Remote: true})
+	case pendingLevel == nil && oldPending != nil:
+		events.publish(levelPending{Change: oldPending, Status: "resolved", Remote: true})
+	}
+}
+
+// applyClusterReaction counts a reaction made on another node, if it's to
+// the same event we have
+func applyClusterReaction(r clusterReaction) {
+	if !isAllowedReaction(r.Reaction) {
+		return
+	}
+
+	reactions.mu.Lock()
+	defer reactions.mu.Unlock()
+
+	if reactions.key == "" || reactions.key != r.EventKey {
+		return
+	}
+	reactions.counts[r.Reaction]++
+	if err := store.SetHistoryReactions(reactions.event, reactions.counts); err != nil {
+		log.Errorf("Could not save reactions: %s", err.Error())
+	}
+
+	changed := reactionsChangedLocked()
+	changed.Remote = true
+	events.publish(changed)
+}
+
+// applyClusterLevels saves levels another node imported. The node also sends
+// its state, which moves the level if it was above the new top.
+func applyClusterLevels(levels levelSet) {
+	if err := levels.validate(); err != nil {
+		log.Warnf("Ignored levels from another node: %s", err.Error())
+		return
+	}
+
+	levelMu.Lock()
+	defer levelMu.Unlock()
+
+	if err := store.SetLevels(levels); err != nil {
+		log.Errorf("Could not save levels: %s", err.Error())
+		return
+	}
+	log.Infof("Levels were replaced on another node")
+	events.publish(levelChanged{Time: time.Now(), Level: level, Previous: level, Event: currentEvent(), Reason: levelReason, Remote: true})
+}
+
+// applyClusterRecord saves a token or subscription change from another node
+// straight to our own store, so it isn't sent back
+func applyClusterRecord(sealed []byte) {
+	j, err := openClusterData(sealed)
+	if err != nil {
+		log.Warnf("Ignored a record from another node: %s", err.Error())
+		return
+	}
+	r := clusterRecord{}
+	if err := json.Unmarshal(j, &r); err != nil {
+		log.Warnf("Ignored a record from another node: %s", err.Error())
+		return
+	}
+
+	local := store
+	if s, ok := store.(clusterStore); ok {
+		local = s.Store
+	}
+	switch {
+	case r.Token != "" && r.TokenAttr != nil:
+		err = local.PutToken(r.Token, *r.TokenAttr)
+	case r.Token != "":
+		_, err = local.DeleteToken(r.Token)
+	case r.SubscriptionID != "":
+		// Held like any other change to subscriptions, so it can't land
+		// in the middle of one
+		notifier.mu.Lock()
+		if r.Subscription != nil {
+			err = local.PutSubscription(*r.Subscription)
+		} else {
+			_, err = local.DeleteSubscription(r.SubscriptionID)
+		}
+		notifier.mu.Unlock()
+	}
+	if err != nil {
+		log.Errorf("Could not save a record from another node: %s", err.Error())
+	}
+}
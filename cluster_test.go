@@ -0,0 +1,503 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"testing"
+	"time"
+)
+
+const testClusterSecret = "cluster-test-secret"
+
+// testNode is a whole server run from the test binary, see TestMain
+type testNode struct {
+	t    *testing.T
+	name string
+	addr string
+	dir  string
+	env  []string
+
+	cmd *exec.Cmd
+	out *bytes.Buffer
+}
+
+// newTestNodes makes n nodes, each with its own address and a data directory
+// holding five levels, testOperatorToken and testAdminToken
+func newTestNodes(t *testing.T, n int) []*testNode {
+	nodes := []*testNode{}
+	for i := 0; i < n; i++ {
+		node := &testNode{t: t, name: fmt.Sprintf("node%d", i), addr: freeTestAddr(t), dir: t.TempDir()}
+
+		s, err := openFileStore(node.dir)
+		if err != nil {
+			t.Fatal(err)
+		}
+		levels := levelSet{}
+		for l := 0; l < 5; l++ {
+			levels[l] = levelDefinition{Title: fmt.Sprintf("Level %d", l), Background: "#000000"}
+		}
+		if err := s.SetLevels(levels); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutToken(testOperatorToken, tokenAttr{Level: 1, Note: "operator", Role: roleOperator}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.PutToken(testAdminToken, tokenAttr{Level: 1, Note: "admin", Role: roleAdmin}); err != nil {
+			t.Fatal(err)
+		}
+		s.Close()
+
+		nodes = append(nodes, node)
+	}
+	return nodes
+}
+
+func freeTestAddr(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	return l.Addr().String()
+}
+
+func (n *testNode) url(path string) string {
+	return "http://" + n.addr + path
+}
+
+// start runs the node and waits for it to answer
+func (n *testNode) start() {
+	n.t.Helper()
+
+	n.out = &bytes.Buffer{}
+	n.cmd = exec.Command(os.Args[0])
+	n.cmd.Env = append(os.Environ(),
+		"JMAAS_CONFIG=",
+		"JMAAS_TEST_NODE=1",
+		"JMAAS_DATA_DIR="+n.dir,
+		"JMAAS_TLS_MODE=none",
+		"JMAAS_LISTEN_ADDRESS="+n.addr,
+		"JMAAS_CLUSTER_NODE_ID="+n.name,
+		"JMAAS_CLUSTER_HEARTBEAT=1s",
+		"JMAAS_CLUSTER_SECRET="+testClusterSecret,
+	)
+	n.cmd.Env = append(n.cmd.Env, n.env...)
+	n.cmd.Stdout = n.out
+	n.cmd.Stderr = n.out
+	if err := n.cmd.Start(); err != nil {
+		n.t.Fatal(err)
+	}
+	n.t.Cleanup(n.stop)
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		if _, err := n.level(); err == nil {
+			return
+		}
+		if time.Now().After(deadline) {
+			n.t.Fatalf("%s did not start", n.name)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// stop shuts the node down, showing what it logged if the test failed
+func (n *testNode) stop() {
+	if n.cmd == nil {
+		return
+	}
+	if err := n.cmd.Process.Signal(syscall.SIGTERM); err != nil {
+		n.cmd.Process.Kill()
+	}
+	n.cmd.Wait()
+	n.cmd = nil
+	if n.t.Failed() {
+		n.t.Logf("%s logged:\n%s", n.name, n.out)
+	}
+}
+
+func (n *testNode) level() (int, error) {
+	resp, err := http.Get(n.url("/api/currentlevel"))
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(string(body))
+}
+
+func (n *testNode) setLevel(lvl int) {
+	n.t.Helper()
+
+	req, _ := http.NewRequest("POST", n.url("/api/setlevel"), nil)
+	req.Header.Set("Token", testOperatorToken)
+	req.Header.Set("New-Level", strconv.Itoa(lvl))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		n.t.Fatalf("setting level %d on %s answered %s", lvl, n.name, resp.Status)
+	}
+}
+
+// waitForLevel waits until every node has the same level, one of want, and
+// returns it
+func waitForLevel(t *testing.T, nodes []*testNode, want ...int) int {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		levels := []int{}
+		for _, n := range nodes {
+			lvl, err := n.level()
+			if err != nil {
+				lvl = -1
+			}
+			levels = append(levels, lvl)
+		}
+
+		same := true
+		for _, lvl := range levels {
+			same = same && lvl == levels[0]
+		}
+		if same {
+			for _, w := range want {
+				if levels[0] == w {
+					return w
+				}
+			}
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("nodes are at levels %v, want all of them at one of %v", levels, want)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+// testClusterConverges changes the level on different nodes, at the same time
+// on two of them, and with one of them down, and checks every node ends up
+// with the same level
+func testClusterConverges(t *testing.T, nodes []*testNode) {
+	for _, n := range nodes {
+		n.start()
+	}
+
+	nodes[0].setLevel(2)
+	waitForLevel(t, nodes, 2)
+
+	wg := sync.WaitGroup{}
+	for i, lvl := range map[int]int{1: 3, 2: 1} {
+		wg.Add(1)
+		go func(n *testNode, lvl int) {
+			defer wg.Done()
+			n.setLevel(lvl)
+		}(nodes[i], lvl)
+	}
+	wg.Wait()
+	waitForLevel(t, nodes, 1, 3)
+
+	// A node that was down catches up on the heartbeat
+	last := nodes[len(nodes)-1]
+	last.stop()
+	nodes[0].setLevel(4)
+	waitForLevel(t, nodes[:len(nodes)-1], 4)
+	last.start()
+	waitForLevel(t, nodes, 4)
+}
+
+func TestClusterHTTPConverges(t *testing.T) {
+	nodes := newTestNodes(t, 3)
+	for _, n := range nodes {
+		peers := []string{}
+		for _, peer := range nodes {
+			if peer != n {
+				peers = append(peers, peer.url(""))
+			}
+		}
+		n.env = []string{"JMAAS_CLUSTER_BACKPLANE=http", "JMAAS_CLUSTER_PEERS=" + strings.Join(peers, ",")}
+	}
+
+	testClusterConverges(t, nodes)
+}
+
+func TestClusterRedisConverges(t *testing.T) {
+	redis := newTestRedis(t)
+	nodes := newTestNodes(t, 3)
+	for _, n := range nodes {
+		n.env = []string{"JMAAS_CLUSTER_BACKPLANE=redis", "JMAAS_CLUSTER_REDIS_ADDR=" + redis.addr(), "JMAAS_CLUSTER_REDIS_PASSWORD=hunter2"}
+	}
+
+	testClusterConverges(t, nodes)
+}
+
+func TestClusterRedisNeedsSignature(t *testing.T) {
+	redis := newTestRedis(t)
+	nodes := newTestNodes(t, 2)
+	for _, n := range nodes {
+		n.env = []string{"JMAAS_CLUSTER_BACKPLANE=redis", "JMAAS_CLUSTER_REDIS_ADDR=" + redis.addr(), "JMAAS_CLUSTER_REDIS_PASSWORD=hunter2"}
+		n.start()
+	}
+	nodes[0].setLevel(1)
+	waitForLevel(t, nodes, 1)
+
+	forged := fmt.Sprintf(`{"node":"intruder","type":"state","state":{"level":4,"version":%d,"eventKey":"intruder/1"}}`, time.Now().Add(time.Hour).UnixNano())
+	now := strconv.FormatInt(time.Now().Unix(), 10)
+	redis.publish("jmaas", []byte(forged))
+	redis.publish("jmaas", []byte(now+" "+strings.Repeat("0", 64)+"\n"+forged))
+
+	time.Sleep(500 * time.Millisecond)
+	waitForLevel(t, nodes, 1)
+}
+
+// testRedis is enough of a Redis server for the backplane: AUTH, PUBLISH and
+// SUBSCRIBE
+type testRedis struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu          sync.Mutex
+	subscribers map[string][]net.Conn
+}
+
+func newTestRedis(t *testing.T) *testRedis {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	r := &testRedis{t: t, ln: ln, subscribers: map[string][]net.Conn{}}
+	t.Cleanup(func() { ln.Close() })
+	go r.serve()
+	return r
+}
+
+func (r *testRedis) addr() string {
+	return r.ln.Addr().String()
+}
+
+func (r *testRedis) serve() {
+	for {
+		conn, err := r.ln.Accept()
+		if err != nil {
+			return
+		}
+		go r.handle(conn)
+	}
+}
+
+func (r *testRedis) handle(conn net.Conn) {
+	defer conn.Close()
+	reader := bufio.NewReader(conn)
+	authed := false
+	for {
+		req, err := readRESP(reader)
+		if err != nil {
+			return
+		}
+		args, _ := req.([]interface{})
+		if len(args) == 0 {
+			return
+		}
+		cmd, _ := args[0].([]byte)
+
+		switch {
+		case string(cmd) == "AUTH" && len(args) == 2:
+			password, _ := args[1].([]byte)
+			authed = string(password) == "hunter2"
+			if !authed {
+				conn.Write([]byte("-WRONGPASS invalid password\r\n"))
+				continue
+			}
+			conn.Write([]byte("+OK\r\n"))
+		case !authed:
+			conn.Write([]byte("-NOAUTH Authentication required.\r\n"))
+		case string(cmd) == "SUBSCRIBE" && len(args) == 2:
+			channel, _ := args[1].([]byte)
+			r.mu.Lock()
+			r.subscribers[string(channel)] = append(r.subscribers[string(channel)], conn)
+			r.mu.Unlock()
+			conn.Write(respArray([]byte("subscribe"), channel, 1))
+		case string(cmd) == "PUBLISH" && len(args) == 3:
+			channel, _ := args[1].([]byte)
+			msg, _ := args[2].([]byte)
+			n := r.publish(string(channel), msg)
+			conn.Write([]byte(fmt.Sprintf(":%d\r\n", n)))
+		default:
+			conn.Write([]byte("-ERR unknown command\r\n"))
+		}
+	}
+}
+
+// publish sends msg to every subscriber of channel, returning how many there
+// were
+func (r *testRedis) publish(channel string, msg []byte) int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	subscribed := []net.Conn{}
+	for _, conn := range r.subscribers[channel] {
+		if _, err := conn.Write(respArray([]byte("message"), []byte(channel), msg)); err == nil {
+			subscribed = append(subscribed, conn)
+		}
+	}
+	r.subscribers[channel] = subscribed
+	return len(subscribed)
+}
+
+func respArray(items ...interface{}) []byte {
+	buf := &bytes.Buffer{}
+	fmt.Fprintf(buf, "*%d\r\n", len(items))
+	for _, item := range items {
+		switch item := item.(type) {
+		case []byte:
+			fmt.Fprintf(buf, "$%d\r\n%s\r\n", len(item), item)
+		case int:
+			fmt.Fprintf(buf, ":%d\r\n", item)
+		}
+	}
+	return buf.Bytes()
+}
+
+func TestClusterMessageReplay(t *testing.T) {
+	setupTestServer(t)
+	cfg.EnableReactions = true
+	cluster.seq = map[string]int64{}
+	defer func() { cluster.seq = nil }()
+	resetReactions(1, "other/1", nil)
+
+	react := func(seq int64) int {
+		receiveClusterMessage([]byte(fmt.Sprintf(`{"node":"other","seq":%d,"type":"reaction","reaction":{"eventKey":"other/1","reaction":"👍"}}`, seq)))
+		reactions.mu.Lock()
+		defer reactions.mu.Unlock()
+		return reactions.counts["👍"]
+	}
+
+	if count := react(5); count != 1 {
+		t.Fatalf("a reaction from another node counted %d times", count)
+	}
+	for _, seq := range []int64{5, 4, 0} {
+		if count := react(seq); count != 1 {
+			t.Errorf("message %d was taken again after 5, reactions are at %d", seq, count)
+		}
+	}
+	if count := react(6); count != 2 {
+		t.Errorf("the next message wasn't taken, reactions are at %d", count)
+	}
+}
+
+// adminRequest sends a POST to path on n as testAdminToken
+func (n *testNode) adminRequest(path string, header ...string) (int, []byte) {
+	n.t.Helper()
+
+	req, _ := http.NewRequest("POST", n.url(path), nil)
+	req.Header.Set("Token", testAdminToken)
+	for i := 0; i+1 < len(header); i += 2 {
+		req.Header.Set(header[i], header[i+1])
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		n.t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, body
+}
+
+// waitForToken waits until token is, or isn't, accepted by n
+func waitForToken(t *testing.T, n *testNode, token string, accepted bool) {
+	t.Helper()
+
+	deadline := time.Now().Add(10 * time.Second)
+	for {
+		req, _ := http.NewRequest("GET", n.url("/api/sockets"), nil)
+		req.Header.Set("Token", token)
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		// Operators are authenticated and then forbidden from listing
+		// sockets
+		if accepted && resp.StatusCode == http.StatusForbidden || !accepted && resp.StatusCode == http.StatusUnauthorized {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("%s answered %s for the token, want it accepted: %t", n.name, resp.Status, accepted)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
+
+func TestClusterTokens(t *testing.T) {
+	nodes := newTestNodes(t, 2)
+	for i, n := range nodes {
+		n.env = []string{"JMAAS_CLUSTER_BACKPLANE=http", "JMAAS_CLUSTER_PEERS=http://" + nodes[1-i].addr}
+		n.start()
+	}
+
+	code, body := nodes[0].adminRequest("/api/tokens/create", "Note", "new operator")
+	created := tokenList{}
+	if err := json.Unmarshal(body, &created); code != http.StatusOK || err != nil || len(created) != 1 {
+		t.Fatalf("creating a token answered %d: %s", code, body)
+	}
+	token := created.sortedTokens()[0]
+	waitForToken(t, nodes[1], token, true)
+
+	if code, body := nodes[1].adminRequest("/api/tokens/revoke", "Revoke-Token", token); code != http.StatusOK {
+		t.Fatalf("revoking the token answered %d: %s", code, body)
+	}
+	waitForToken(t, nodes[0], token, false)
+}
+
+func TestClusterDataSealed(t *testing.T) {
+	defer func(secret string) { cfg.ClusterSecret = secret }(cfg.ClusterSecret)
+	cfg.ClusterSecret = testClusterSecret
+
+	sealed, err := sealClusterData([]byte(testAdminToken))
+	if err != nil || bytes.Contains(sealed, []byte(testAdminToken)) {
+		t.Fatalf("sealing = %q, %v", sealed, err)
+	}
+	if plain, err := openClusterData(sealed); err != nil || string(plain) != testAdminToken {
+		t.Errorf("opening = %q, %v", plain, err)
+	}
+
+	cfg.ClusterSecret = "another secret"
+	if _, err := openClusterData(sealed); err == nil {
+		t.Error("opened data sealed under another secret")
+	}
+}
@@ -0,0 +1,104 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+)
+
+func historyCommand(args []string) error {
+	if len(args) == 0 || args[0] != "export" {
+		usageError("expected history export")
+	}
+	return exportHistory(args[1:])
+}
+
+// exportHistory streams an export straight to a file or stdout, exports can
+// be far too large to hold in memory or finish inside the usual timeout
+func exportHistory(args []string) error {
+	query := url.Values{}
+	file := ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--audit":
+			query.Set("log", "audit")
+		case strings.HasPrefix(args[i], "--") && i+1 < len(args) &&
+			(args[i] == "--format" || args[i] == "--from" || args[i] == "--to" || args[i] == "--columns" || args[i] == "--tz"):
+			query.Set(strings.TrimPrefix(args[i], "--"), args[i+1])
+			i++
+		case file == "" && (args[i] == "-" || !strings.HasPrefix(args[i], "-")):
+			file = args[i]
+		default:
+			usageError(fmt.Sprintf("unexpected history export argument %q", args[i]))
+		}
+	}
+	if query.Get("log") == "audit" {
+		if err := requireToken(); err != nil {
+			return err
+		}
+	}
+
+	req, err := http.NewRequest("GET", *serverURL+"/api/history/export?"+query.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	if *token != "" {
+		req.Header.Set("Token", *token)
+	}
+
+	// No timeout, unlike client, a long export keeps the body coming
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		body, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 4096))
+		msg := strings.TrimSpace(string(body))
+		if unquoted, err := strconv.Unquote(msg); err == nil {
+			msg = unquoted
+		}
+		return fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+
+	if file == "" || file == "-" {
+		_, err = io.Copy(os.Stdout, resp.Body)
+		return err
+	}
+
+	f, err := os.Create(file)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(f, resp.Body); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
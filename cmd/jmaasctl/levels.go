@@ -0,0 +1,181 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+)
+
+type levelChange struct {
+	Level  int      `json:"level"`
+	Change string   `json:"change"`
+	Title  string   `json:"title"`
+	Fields []string `json:"fields"`
+}
+
+func levelsCommand(args []string) error {
+	if len(args) == 0 {
+		usageError("expected levels show, templates, export, or import")
+	}
+
+	switch args[0] {
+	case "show":
+		return showLevels()
+	case "templates":
+		return listTemplates()
+	case "export":
+		if len(args) > 2 {
+			usageError("levels export takes at most a file")
+		}
+		return exportLevels(args[1:])
+	case "import":
+		return importLevels(args[1:])
+	}
+
+	usageError(fmt.Sprintf("unknown levels command %q", args[0]))
+	return nil
+}
+
+func listTemplates() error {
+	body, err := request("/api/levels/templates", nil)
+	if err != nil {
+		return err
+	}
+
+	templates := map[string][]string{}
+	if err := json.Unmarshal(body, &templates); err != nil {
+		return err
+	}
+
+	names := []string{}
+	for name := range templates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		fmt.Printf("%-14s %s\n", name, strings.Join(templates[name], ", "))
+	}
+	return nil
+}
+
+func exportLevels(args []string) error {
+	if err := requireToken(); err != nil {
+		return err
+	}
+
+	body, err := request("/api/levels/export", nil)
+	if err != nil {
+		return err
+	}
+
+	if len(args) == 0 {
+		_, err = os.Stdout.Write(body)
+		return err
+	}
+	return ioutil.WriteFile(args[0], body, 0644)
+}
+
+func importLevels(args []string) error {
+	dryRun := false
+	template := ""
+	file := ""
+	for i := 0; i < len(args); i++ {
+		switch {
+		case args[i] == "--dry-run":
+			dryRun = true
+		case args[i] == "--template" && i+1 < len(args):
+			template = args[i+1]
+			i++
+		case file == "" && (args[i] == "-" || !strings.HasPrefix(args[i], "-")):
+			file = args[i]
+		default:
+			usageError(fmt.Sprintf("unexpected levels import argument %q", args[i]))
+		}
+	}
+	if (file == "") == (template == "") {
+		usageError("levels import needs a file, - for stdin, or --template NAME")
+	}
+
+	if err := requireToken(); err != nil {
+		return err
+	}
+
+	query := url.Values{}
+	if dryRun {
+		query.Set("dry_run", "true")
+	}
+
+	var in io.Reader
+	if template != "" {
+		query.Set("template", template)
+	} else if file == "-" {
+		in = os.Stdin
+	} else {
+		f, err := os.Open(file)
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		in = f
+	}
+
+	body, err := send("POST", "/api/levels/import?"+query.Encode(), map[string]string{"Content-Type": "application/json"}, in)
+	if err != nil {
+		return err
+	}
+
+	result := struct {
+		Applied bool          `json:"applied"`
+		Changes []levelChange `json:"changes"`
+	}{}
+	if err := json.Unmarshal(body, &result); err != nil {
+		return err
+	}
+
+	for _, c := range result.Changes {
+		switch c.Change {
+		case "added":
+			fmt.Printf("+ %d %s\n", c.Level, c.Title)
+		case "removed":
+			fmt.Printf("- %d %s\n", c.Level, c.Title)
+		default:
+			fmt.Printf("~ %d %s: %s\n", c.Level, c.Title, strings.Join(c.Fields, ", "))
+		}
+	}
+
+	switch {
+	case len(result.Changes) == 0:
+		fmt.Println("No changes")
+	case result.Applied:
+		fmt.Printf("Imported %d changes\n", len(result.Changes))
+	default:
+		fmt.Println("Dry run, nothing was changed")
+	}
+	return nil
+}
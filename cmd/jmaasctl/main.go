@@ -0,0 +1,560 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// jmaasctl is a command-line client for a running jmaas server.
+//
+// The server URL and token come from -url/-token, then JMAAS_URL/JMAAS_TOKEN,
+// then the config file ($XDG_CONFIG_HOME/jmaas/jmaasctl.conf by default),
+// which holds lines like:
+//
+//	url = "https://jmaas.example.com"
+//	token = "..."
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+var (
+	serverURL  = flag.String("url", "", "The jmaas server to talk to, defaults to $JMAAS_URL")
+	token      = flag.String("token", "", "The token to authenticate with, defaults to $JMAAS_TOKEN")
+	configPath = flag.String("config", "", "Path to the jmaasctl config file")
+	client     = &http.Client{Timeout: 10 * time.Second}
+)
+
+type levelDef struct {
+	Background  string `json:"background"`
+	Description string `json:"description"`
+	Title       string `json:"title"`
+}
+
+type pendingChange struct {
+	ID        int64     `json:"id"`
+	Level     int       `json:"level"`
+	Requester string    `json:"requester"`
+	Reason    string    `json:"reason"`
+	Expires   time.Time `json:"expires"`
+}
+
+type tokenAttr struct {
+	Level int
+	Note  string
+	Role  string
+}
+
+func usage() {
+	fmt.Fprintf(os.Stderr, `Usage: jmaasctl [flags] <command>
+
+Commands:
+  status                 Show the current level
+  up [REASON]            Raise the level by one
+  down [REASON]          Lower the level by one
+  set N [REASON]         Set the level to N
+  pending                Show the level change waiting for approval, if any
+  confirm ID             Confirm another operator's pending level change
+  reject ID              Reject a pending level change
+  watch                  Stream level changes until interrupted
+  tokens list            List every token
+  tokens create NOTE [ROLE]
+                         Create a new operator (or admin) token
+  tokens revoke TOKEN    Revoke a token
+  levels show            Show every level definition
+  levels templates       List the built-in level templates
+  levels export [FILE]   Save the levels as a bundle to FILE or stdout
+  levels import [--dry-run] FILE|--template NAME
+                         Replace the levels with a bundle (- for stdin) or
+                         a template, printing what changes
+  history export [--audit] [--format csv|json|ndjson] [--from T] [--to T]
+                 [--columns A,B] [--tz ZONE] [FILE]
+                         Save the level history (or, for admins, the audit
+                         log) to FILE or stdout
+  kiosks                 List the kiosk displays that are online
+
+Flags:
+`)
+	flag.PrintDefaults()
+}
+
+func main() {
+	flag.Usage = usage
+	flag.Parse()
+
+	if err := loadConfig(); err != nil {
+		fatal(err)
+	}
+
+	args := flag.Args()
+	if len(args) == 0 {
+		usage()
+		os.Exit(2)
+	}
+
+	var err error
+	switch args[0] {
+	case "status":
+		err = printStatus()
+	case "up":
+		err = changeLevel("/api/inclevel", withReason(nil, args[1:]))
+	case "down":
+		err = changeLevel("/api/declevel", withReason(nil, args[1:]))
+	case "set":
+		if len(args) < 2 {
+			usageError("set needs a level")
+		}
+		if _, convErr := strconv.Atoi(args[1]); convErr != nil {
+			usageError("level must be a number")
+		}
+		err = changeLevel("/api/setlevel", withReason(map[string]string{"New-Level": args[1]}, args[2:]))
+	case "pending":
+		err = showPending()
+	case "confirm", "reject":
+		if len(args) != 2 {
+			usageError(args[0] + " needs the pending change's id")
+		}
+		err = resolvePending(args[0], args[1])
+	case "watch":
+		err = watch()
+	case "tokens":
+		err = tokensCommand(args[1:])
+	case "kiosks":
+		err = listKiosks()
+	case "levels":
+		err = levelsCommand(args[1:])
+	case "history":
+		err = historyCommand(args[1:])
+	default:
+		usageError(fmt.Sprintf("unknown command %q", args[0]))
+	}
+
+	if err != nil {
+		fatal(err)
+	}
+}
+
+func fatal(err error) {
+	fmt.Fprintf(os.Stderr, "jmaasctl: %s\n", err.Error())
+	os.Exit(1)
+}
+
+func usageError(msg string) {
+	fmt.Fprintf(os.Stderr, "jmaasctl: %s\n\n", msg)
+	usage()
+	os.Exit(2)
+}
+
+func defaultConfigPath() string {
+	dir := os.Getenv("XDG_CONFIG_HOME")
+	if dir == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return ""
+		}
+		dir = filepath.Join(home, ".config")
+	}
+	return filepath.Join(dir, "jmaas", "jmaasctl.conf")
+}
+
+// loadConfig fills in -url and -token from the environment or config file
+// when they weren't given as flags
+func loadConfig() error {
+	if *serverURL == "" {
+		*serverURL = os.Getenv("JMAAS_URL")
+	}
+	if *token == "" {
+		*token = os.Getenv("JMAAS_TOKEN")
+	}
+
+	path := *configPath
+	if path == "" {
+		path = defaultConfigPath()
+	}
+
+	f, err := os.Open(path)
+	if os.IsNotExist(err) && *configPath == "" {
+		return checkConfig()
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return fmt.Errorf("%s:%d: expected key = value", path, lineNum)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		val := strings.TrimSpace(line[eq+1:])
+		if unquoted, err := strconv.Unquote(val); err == nil {
+			val = unquoted
+		}
+
+		switch key {
+		case "url":
+			if *serverURL == "" {
+				*serverURL = val
+			}
+		case "token":
+			if *token == "" {
+				*token = val
+			}
+		default:
+			return fmt.Errorf("%s:%d: unknown key %q", path, lineNum, key)
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+
+	return checkConfig()
+}
+
+func checkConfig() error {
+	if *serverURL == "" {
+		return fmt.Errorf("no server url, set -url, $JMAAS_URL, or url in %s", defaultConfigPath())
+	}
+	*serverURL = strings.TrimRight(*serverURL, "/")
+	return nil
+}
+
+// request makes an authenticated GET to the server, any non-2xx response is
+// returned as an error holding the server's message
+func request(path string, headers map[string]string) ([]byte, error) {
+	return send("GET", path, headers, nil)
+}
+
+// send is request for any method, with an optional body
+func send(method, path string, headers map[string]string, body io.Reader) ([]byte, error) {
+	req, err := http.NewRequest(method, *serverURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+
+	if *token != "" {
+		req.Header.Set("Token", *token)
+	}
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	respBody, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		msg := strings.TrimSpace(string(respBody))
+		if unquoted, err := strconv.Unquote(msg); err == nil {
+			msg = unquoted
+		}
+		return nil, fmt.Errorf("%s: %s", resp.Status, msg)
+	}
+
+	return respBody, nil
+}
+
+func requireToken() error {
+	if *token == "" {
+		return fmt.Errorf("this command needs a token, set -token, $JMAAS_TOKEN, or token in %s", defaultConfigPath())
+	}
+	return nil
+}
+
+func getLevels() (map[int]levelDef, error) {
+	body, err := request("/api/levels", nil)
+	if err != nil {
+		return nil, err
+	}
+
+	raw := map[string]levelDef{}
+	if err := json.Unmarshal(body, &raw); err != nil {
+		return nil, err
+	}
+
+	levels := map[int]levelDef{}
+	for k, v := range raw {
+		n, err := strconv.Atoi(k)
+		if err != nil {
+			return nil, fmt.Errorf("server sent a non-numeric level %q", k)
+		}
+		levels[n] = v
+	}
+	return levels, nil
+}
+
+func sortedLevels(levels map[int]levelDef) []int {
+	keys := []int{}
+	for k := range levels {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+func getCurrentLevel() (int, error) {
+	body, err := request("/api/currentlevel", nil)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(strings.TrimSpace(string(body)))
+}
+
+func printStatus() error {
+	levels, err := getLevels()
+	if err != nil {
+		return err
+	}
+
+	current, err := getCurrentLevel()
+	if err != nil {
+		return err
+	}
+
+	fmt.Println(formatLevel(current, levels[current]))
+	return nil
+}
+
+// withReason adds the words of a reason to a level change's headers
+func withReason(headers map[string]string, words []string) map[string]string {
+	if len(words) == 0 {
+		return headers
+	}
+	if headers == nil {
+		headers = map[string]string{}
+	}
+	headers["Reason"] = strings.Join(words, " ")
+	return headers
+}
+
+func changeLevel(path string, headers map[string]string) error {
+	if err := requireToken(); err != nil {
+		return err
+	}
+
+	body, err := request(path, headers)
+	if err != nil {
+		return err
+	}
+
+	// Changes that need approval come back as the pending change
+	pending := pendingChange{}
+	if json.Unmarshal(body, &pending) == nil && pending.ID != 0 {
+		fmt.Printf("Waiting for a second operator to confirm, run jmaasctl confirm %d before %s\n", pending.ID, pending.Expires.Local().Format("15:04:05"))
+		return nil
+	}
+	return printStatus()
+}
+
+func showPending() error {
+	body, err := request("/api/pending", nil)
+	if err != nil {
+		return err
+	}
+
+	var pending *pendingChange
+	if err := json.Unmarshal(body, &pending); err != nil {
+		return err
+	}
+	if pending == nil {
+		fmt.Println("No level change is pending")
+		return nil
+	}
+
+	levels, err := getLevels()
+	if err != nil {
+		return err
+	}
+	fmt.Printf("%d: %s requested %s", pending.ID, pending.Requester, formatLevel(pending.Level, levels[pending.Level]))
+	if pending.Reason != "" {
+		fmt.Printf(" %q", pending.Reason)
+	}
+	fmt.Printf(", expires at %s\n", pending.Expires.Local().Format("15:04:05"))
+	return nil
+}
+
+func resolvePending(action, id string) error {
+	if err := requireToken(); err != nil {
+		return err
+	}
+
+	body, err := request("/api/pending/"+action, map[string]string{"Pending-Id": id})
+	if err != nil {
+		return err
+	}
+	fmt.Println(string(body))
+	return printStatus()
+}
+
+func showLevels() error {
+	levels, err := getLevels()
+	if err != nil {
+		return err
+	}
+
+	for _, n := range sortedLevels(levels) {
+		fmt.Println(formatLevel(n, levels[n]))
+		for _, line := range strings.Split(stripHTML(levels[n].Description), "\n") {
+			if line = strings.TrimSpace(line); line != "" {
+				fmt.Printf("    %s\n", line)
+			}
+		}
+	}
+	return nil
+}
+
+type socketInfo struct {
+	ID          string    `json:"id"`
+	Name        string    `json:"name"`
+	RemoteAddr  string    `json:"remoteAddr"`
+	ConnectedAt time.Time `json:"connectedAt"`
+}
+
+func listKiosks() error {
+	if err := requireToken(); err != nil {
+		return err
+	}
+
+	body, err := request("/api/sockets?kind=kiosk", nil)
+	if err != nil {
+		return err
+	}
+
+	kiosks := []socketInfo{}
+	if err := json.Unmarshal(body, &kiosks); err != nil {
+		return err
+	}
+	if len(kiosks) == 0 {
+		fmt.Println("No kiosks are online")
+		return nil
+	}
+
+	for _, k := range kiosks {
+		name := k.Name
+		if name == "" {
+			name = "(unnamed)"
+		}
+		fmt.Printf("%-4s  %-20s  %-15s  since %s\n", k.ID, name, k.RemoteAddr, k.ConnectedAt.Local().Format("2006-01-02 15:04"))
+	}
+	return nil
+}
+
+func tokensCommand(args []string) error {
+	if len(args) == 0 {
+		usageError("expected tokens list, create, or revoke")
+	}
+
+	if err := requireToken(); err != nil {
+		return err
+	}
+
+	switch args[0] {
+	case "list":
+		body, err := request("/api/tokens/list", nil)
+		if err != nil {
+			return err
+		}
+		return printTokens(body)
+	case "create":
+		if len(args) != 2 && len(args) != 3 {
+			usageError("tokens create needs a note")
+		}
+		headers := map[string]string{"Note": args[1]}
+		if len(args) == 3 {
+			headers["Role"] = args[2]
+		}
+		body, err := request("/api/tokens/create", headers)
+		if err != nil {
+			return err
+		}
+		return printTokens(body)
+	case "revoke":
+		if len(args) != 2 {
+			usageError("tokens revoke needs a token")
+		}
+		if _, err := request("/api/tokens/revoke", map[string]string{"Revoke-Token": args[1]}); err != nil {
+			return err
+		}
+		fmt.Println("Token revoked")
+		return nil
+	}
+
+	usageError(fmt.Sprintf("unknown tokens command %q", args[0]))
+	return nil
+}
+
+func printTokens(body []byte) error {
+	tokens := map[string]tokenAttr{}
+	if err := json.Unmarshal(body, &tokens); err != nil {
+		return err
+	}
+
+	keys := []string{}
+	for k := range tokens {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	for _, k := range keys {
+		role := tokens[k].Role
+		if role == "" {
+			role = "admin"
+		}
+		fmt.Printf("%s  %-8s  %d  %s\n", k, role, tokens[k].Level, tokens[k].Note)
+	}
+	return nil
+}
+
+var (
+	tagRe   = regexp.MustCompile(`<[^>]*>`)
+	blockRe = regexp.MustCompile(`(?i)</p>|<br\s*/?>`)
+)
+
+func stripHTML(s string) string {
+	s = blockRe.ReplaceAllString(s, "\n")
+	s = tagRe.ReplaceAllString(s, "")
+	r := strings.NewReplacer("&amp;", "&", "&lt;", "<", "&gt;", ">", "&quot;", "\"", "&#39;", "'")
+	return r.Replace(s)
+}
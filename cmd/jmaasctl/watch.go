@@ -0,0 +1,182 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/gorilla/websocket"
+	"net/http"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type socketMessage struct {
+	Type string
+	Data map[string]interface{}
+}
+
+// watch streams level updates from /socket until interrupted, reconnecting
+// with exponential backoff whenever the connection drops
+func watch() error {
+	levels, err := getLevels()
+	if err != nil {
+		return err
+	}
+
+	socketURL := "ws" + strings.TrimPrefix(*serverURL, "http") + "/socket"
+
+	backoff := time.Second
+	for {
+		connected, err := watchOnce(socketURL, levels)
+		if connected {
+			backoff = time.Second
+		}
+
+		fmt.Fprintf(os.Stderr, "%s disconnected: %s, retrying in %s\n", time.Now().Format("15:04:05"), err.Error(), backoff)
+		time.Sleep(backoff)
+
+		backoff *= 2
+		if backoff > 30*time.Second {
+			backoff = 30 * time.Second
+		}
+
+		// Levels may have been edited while we were gone
+		if fresh, err := getLevels(); err == nil {
+			levels = fresh
+		}
+	}
+}
+
+func watchOnce(socketURL string, levels map[int]levelDef) (bool, error) {
+	header := http.Header{}
+	if *token != "" {
+		header.Set("Token", *token)
+	}
+
+	conn, _, err := websocket.DefaultDialer.Dial(socketURL, header)
+	if err != nil {
+		return false, err
+	}
+	defer conn.Close()
+
+	for {
+		msg := socketMessage{}
+		if err := conn.ReadJSON(&msg); err != nil {
+			return true, err
+		}
+
+		switch msg.Type {
+		case "levelupdate":
+			n, ok := msg.Data["level"].(float64)
+			if !ok {
+				continue
+			}
+			line := formatLevel(int(n), levels[int(n)])
+			if reason, _ := msg.Data["reason"].(string); reason != "" {
+				line += " " + strconv.Quote(reason)
+			}
+			fmt.Printf("%s %s\n", time.Now().Format("15:04:05"), line)
+		case "presence":
+			viewers, _ := msg.Data["viewers"].(float64)
+			operators := []string{}
+			if list, ok := msg.Data["operators"].([]interface{}); ok {
+				for _, op := range list {
+					operators = append(operators, fmt.Sprint(op))
+				}
+			}
+			line := fmt.Sprintf("%d watching", int(viewers))
+			if kiosks, _ := msg.Data["kiosks"].(float64); kiosks > 0 {
+				line += fmt.Sprintf(", %d displays", int(kiosks))
+			}
+			if len(operators) > 0 {
+				line += ", operators online: " + strings.Join(operators, ", ")
+			}
+			fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format("15:04:05"), line)
+		case "levelpending":
+			status, _ := msg.Data["status"].(string)
+			requester, _ := msg.Data["requester"].(string)
+			n, _ := msg.Data["level"].(float64)
+			id, _ := msg.Data["id"].(float64)
+			line := fmt.Sprintf("request %d by %s for %s: %s", int64(id), requester, formatLevel(int(n), levels[int(n)]), status)
+			if by, _ := msg.Data["by"].(string); by != "" {
+				line += " by " + by
+			}
+			fmt.Fprintf(os.Stderr, "%s %s\n", time.Now().Format("15:04:05"), line)
+		case "reactions":
+			counts, _ := msg.Data["reactions"].(map[string]interface{})
+			if len(counts) == 0 {
+				continue
+			}
+			keys := []string{}
+			for k := range counts {
+				keys = append(keys, k)
+			}
+			sort.Strings(keys)
+			parts := []string{}
+			for _, k := range keys {
+				parts = append(parts, fmt.Sprintf("%s %v", k, counts[k]))
+			}
+			fmt.Fprintf(os.Stderr, "%s reactions: %s\n", time.Now().Format("15:04:05"), strings.Join(parts, ", "))
+		}
+	}
+}
+
+// formatLevel renders a level as "N Title", colored with the level's
+// background when stdout is a terminal
+func formatLevel(n int, def levelDef) string {
+	text := fmt.Sprintf(" %d %s ", n, def.Title)
+	if os.Getenv("NO_COLOR") != "" || !isTerminal() {
+		return strings.TrimSpace(text)
+	}
+
+	r, g, b, ok := parseHexColor(def.Background)
+	if !ok {
+		return strings.TrimSpace(text)
+	}
+
+	fg := "97"
+	if (299*r+587*g+114*b)/1000 > 150 {
+		fg = "30"
+	}
+
+	return fmt.Sprintf("\x1b[48;2;%d;%d;%dm\x1b[%sm%s\x1b[0m", r, g, b, fg, text)
+}
+
+func parseHexColor(s string) (int, int, int, bool) {
+	s = strings.TrimPrefix(s, "#")
+	if len(s) != 6 {
+		return 0, 0, 0, false
+	}
+
+	v, err := strconv.ParseUint(s, 16, 32)
+	if err != nil {
+		return 0, 0, 0, false
+	}
+	return int(v >> 16 & 0xff), int(v >> 8 & 0xff), int(v & 0xff), true
+}
+
+func isTerminal() bool {
+	stat, err := os.Stdout.Stat()
+	return err == nil && stat.Mode()&os.ModeCharDevice != 0
+}
@@ -0,0 +1,749 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"github.com/go-playground/log"
+	"golang.org/x/text/language"
+	"io"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// config is the effective server configuration, built from the defaults, the
+// config file, JMAAS_* environment variables, and finally any flags that were
+// explicitly set on the command line
+type config struct {
+	DataDir  string
+	LogLevel string
+
+	StorageBackend string
+	SQLitePath     string
+
+	Listen         string
+	RedirectListen string
+	DevListen      string
+
+	TLSMode        string
+	Domains        []string
+	CertCache      string
+	CertFile       string
+	KeyFile        string
+	ReloadInterval time.Duration
+
+	TrustedProxies []string
+	ForceHTTPS     bool
+
+	ReadTimeout     time.Duration
+	WriteTimeout    time.Duration
+	IdleTimeout     time.Duration
+	ShutdownTimeout time.Duration
+	ExportTimeout   time.Duration
+
+	IPPerMinute           int
+	IPBurst               int
+	TokenPerMinute        int
+	TokenBurst            int
+	LevelChangesPerMinute int
+	LockoutThreshold      int
+	LockoutBase           time.Duration
+	LockoutMax            time.Duration
+
+	SocketAllowedOrigins []string
+	SocketMaxPerIP       int
+	SocketMaxTotal       int
+	SocketMaxMessageSize int
+	SocketReadTimeout    time.Duration
+	PresenceDebounce     time.Duration
+
+	DefaultLocale string
+	LevelTemplate string
+
+	MQTTBroker       string
+	MQTTClientID     string
+	MQTTUsername     string
+	MQTTPassword     string
+	MQTTTopic        string
+	MQTTCommandTopic string
+
+	ClusterBackplane     string
+	ClusterNodeID        string
+	ClusterHeartbeat     time.Duration
+	ClusterRedisAddr     string
+	ClusterRedisPassword string
+	ClusterRedisChannel  string
+	ClusterPeers         []string
+	ClusterSecret        string
+
+	// HistoryPrivate needs a token for the history feed
+	HistoryPrivate bool
+
+	NotifyBaseURL     string
+	NotifyRepeatAfter time.Duration
+	SMTPAddr          string
+	SMTPUsername      string
+	SMTPPassword      string
+	SMTPFrom          string
+	// VAPIDKey is created on first start, every node of a cluster needs a
+	// copy of the same one
+	VAPIDKey     string
+	VAPIDSubject string
+	PushHosts    []string
+
+	ReactionsAllowed   []string
+	ReactionsPerMinute int
+	ReactionsBurst     int
+
+	EnableHTTP2      bool
+	EnableServerPush bool
+	EnableTokenList  bool
+	EnablePresence   bool
+	EnableReactions  bool
+	EnableBadges     bool
+	EnableKiosk      bool
+	EnableNotify     bool
+}
+
+var cfg = defaultConfig()
+
+func defaultConfig() *config {
+	return &config{
+		DataDir:  ".",
+		LogLevel: "info",
+
+		StorageBackend: "file",
+		SQLitePath:     "jmaas.db",
+
+		Listen:         ":https",
+		RedirectListen: ":http",
+		DevListen:      ":34265",
+
+		TLSMode:        "autocert",
+		Domains:        []string{},
+		CertCache:      "certs",
+		ReloadInterval: time.Minute,
+
+		TrustedProxies: []string{},
+
+		ReadTimeout:     5 * time.Second,
+		WriteTimeout:    10 * time.Second,
+		IdleTimeout:     120 * time.Second,
+		ShutdownTimeout: 15 * time.Second,
+		ExportTimeout:   5 * time.Minute,
+
+		IPPerMinute:           30,
+		IPBurst:               10,
+		TokenPerMinute:        60,
+		TokenBurst:            20,
+		LevelChangesPerMinute: 10,
+		LockoutThreshold:      5,
+		LockoutBase:           30 * time.Second,
+		LockoutMax:            time.Hour,
+
+		SocketAllowedOrigins: []string{},
+		SocketMaxPerIP:       10,
+		SocketMaxTotal:       1000,
+		SocketMaxMessageSize: 4096,
+		SocketReadTimeout:    time.Minute,
+		PresenceDebounce:     time.Second,
+
+		DefaultLocale: "en",
+		LevelTemplate: "",
+
+		MQTTClientID: "jmaas",
+		MQTTTopic:    "jmaas/level",
+
+		ClusterHeartbeat:    5 * time.Second,
+		ClusterRedisAddr:    "localhost:6379",
+		ClusterRedisChannel: "jmaas",
+		ClusterPeers:        []string{},
+
+		NotifyRepeatAfter: 15 * time.Minute,
+		VAPIDKey:          "vapid.pem",
+		PushHosts: []string{
+			"fcm.googleapis.com",
+			"updates.push.services.mozilla.com",
+			"web.push.apple.com",
+			"*.notify.windows.com",
+		},
+
+		ReactionsAllowed:   []string{"👍", "😬", "😡", "😂", "noted"},
+		ReactionsPerMinute: 10,
+		ReactionsBurst:     5,
+
+		EnableHTTP2:      true,
+		EnableServerPush: true,
+		EnableTokenList:  true,
+		EnablePresence:   true,
+		EnableReactions:  true,
+		EnableBadges:     true,
+		EnableKiosk:      true,
+	}
+}
+
+type configField struct {
+	key   string
+	value interface{}
+}
+
+// secretConfigKeys are never printed by -print-config
+var secretConfigKeys = map[string]bool{
+	"mqtt.password":               true,
+	"cluster.redis_password":      true,
+	"cluster.secret":              true,
+	"notifications.smtp_password": true,
+}
+
+// fields lists every config key, in the order they are printed. Keys are
+// "section.name" in the config file and JMAAS_SECTION_NAME in the environment.
+func (c *config) fields() []configField {
+	return []configField{
+		{"data_dir", &c.DataDir},
+		{"log_level", &c.LogLevel},
+
+		{"storage.backend", &c.StorageBackend},
+		{"storage.sqlite_path", &c.SQLitePath},
+
+		{"listen.address", &c.Listen},
+		{"listen.redirect", &c.RedirectListen},
+		{"listen.dev", &c.DevListen},
+
+		{"tls.mode", &c.TLSMode},
+		{"tls.domains", &c.Domains},
+		{"tls.cert_cache", &c.CertCache},
+		{"tls.cert_file", &c.CertFile},
+		{"tls.key_file", &c.KeyFile},
+		{"tls.reload_interval", &c.ReloadInterval},
+
+		{"proxy.trusted", &c.TrustedProxies},
+		{"proxy.force_https", &c.ForceHTTPS},
+
+		{"timeouts.read", &c.ReadTimeout},
+		{"timeouts.write", &c.WriteTimeout},
+		{"timeouts.idle", &c.IdleTimeout},
+		{"timeouts.shutdown", &c.ShutdownTimeout},
+		{"timeouts.export", &c.ExportTimeout},
+
+		{"limits.ip_per_minute", &c.IPPerMinute},
+		{"limits.ip_burst", &c.IPBurst},
+		{"limits.token_per_minute", &c.TokenPerMinute},
+		{"limits.token_burst", &c.TokenBurst},
+		{"limits.level_changes_per_minute", &c.LevelChangesPerMinute},
+		{"limits.lockout_threshold", &c.LockoutThreshold},
+		{"limits.lockout_base", &c.LockoutBase},
+		{"limits.lockout_max", &c.LockoutMax},
+
+		{"sockets.allowed_origins", &c.SocketAllowedOrigins},
+		{"sockets.max_per_ip", &c.SocketMaxPerIP},
+		{"sockets.max_total", &c.SocketMaxTotal},
+		{"sockets.max_message_size", &c.SocketMaxMessageSize},
+		{"sockets.read_timeout", &c.SocketReadTimeout},
+		{"sockets.presence_debounce", &c.PresenceDebounce},
+
+		{"levels.default_locale", &c.DefaultLocale},
+		{"levels.template", &c.LevelTemplate},
+
+		{"mqtt.broker", &c.MQTTBroker},
+		{"mqtt.client_id", &c.MQTTClientID},
+		{"mqtt.username", &c.MQTTUsername},
+		{"mqtt.password", &c.MQTTPassword},
+		{"mqtt.topic", &c.MQTTTopic},
+		{"mqtt.command_topic", &c.MQTTCommandTopic},
+
+		{"cluster.backplane", &c.ClusterBackplane},
+		{"cluster.node_id", &c.ClusterNodeID},
+		{"cluster.heartbeat", &c.ClusterHeartbeat},
+		{"cluster.redis_addr", &c.ClusterRedisAddr},
+		{"cluster.redis_password", &c.ClusterRedisPassword},
+		{"cluster.redis_channel", &c.ClusterRedisChannel},
+		{"cluster.peers", &c.ClusterPeers},
+		{"cluster.secret", &c.ClusterSecret},
+
+		{"history.private", &c.HistoryPrivate},
+
+		{"notifications.base_url", &c.NotifyBaseURL},
+		{"notifications.repeat_after", &c.NotifyRepeatAfter},
+		{"notifications.smtp_addr", &c.SMTPAddr},
+		{"notifications.smtp_username", &c.SMTPUsername},
+		{"notifications.smtp_password", &c.SMTPPassword},
+		{"notifications.from", &c.SMTPFrom},
+		{"notifications.vapid_key", &c.VAPIDKey},
+		{"notifications.vapid_subject", &c.VAPIDSubject},
+		{"notifications.push_hosts", &c.PushHosts},
+
+		{"reactions.allowed", &c.ReactionsAllowed},
+		{"reactions.per_minute", &c.ReactionsPerMinute},
+		{"reactions.burst", &c.ReactionsBurst},
+
+		{"features.http2", &c.EnableHTTP2},
+		{"features.server_push", &c.EnableServerPush},
+		{"features.token_list", &c.EnableTokenList},
+		{"features.presence", &c.EnablePresence},
+		{"features.reactions", &c.EnableReactions},
+		{"features.badges", &c.EnableBadges},
+		{"features.kiosk", &c.EnableKiosk},
+		{"features.notifications", &c.EnableNotify},
+	}
+}
+
+func (c *config) field(key string) *configField {
+	for _, f := range c.fields() {
+		if f.key == key {
+			return &f
+		}
+	}
+	return nil
+}
+
+// set parses raw into the field, raw is either a string or, for values that
+// came from a config file array, a []string
+func (f *configField) set(raw interface{}) error {
+	str, isStr := raw.(string)
+	list, isList := raw.([]string)
+
+	switch v := f.value.(type) {
+	case *[]string:
+		if isList {
+			*v = list
+			return nil
+		}
+		out := []string{}
+		for _, s := range strings.Split(str, ",") {
+			if s = strings.TrimSpace(s); s != "" {
+				out = append(out, s)
+			}
+		}
+		*v = out
+		return nil
+	}
+
+	if !isStr {
+		return fmt.Errorf("%s: expected a single value, got a list", f.key)
+	}
+
+	switch v := f.value.(type) {
+	case *string:
+		*v = str
+	case *bool:
+		b, err := strconv.ParseBool(str)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a boolean", f.key, str)
+		}
+		*v = b
+	case *int:
+		i, err := strconv.Atoi(str)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not an integer", f.key, str)
+		}
+		*v = i
+	case *time.Duration:
+		d, err := time.ParseDuration(str)
+		if err != nil {
+			return fmt.Errorf("%s: %q is not a duration", f.key, str)
+		}
+		*v = d
+	default:
+		return fmt.Errorf("%s: unsupported config type %T", f.key, f.value)
+	}
+	return nil
+}
+
+func (f *configField) format() string {
+	switch v := f.value.(type) {
+	case *string:
+		return strconv.Quote(*v)
+	case *bool:
+		return strconv.FormatBool(*v)
+	case *int:
+		return strconv.Itoa(*v)
+	case *time.Duration:
+		return strconv.Quote(v.String())
+	case *[]string:
+		quoted := make([]string, len(*v))
+		for i, s := range *v {
+			quoted[i] = strconv.Quote(s)
+		}
+		return "[" + strings.Join(quoted, ", ") + "]"
+	}
+	return ""
+}
+
+func envName(key string) string {
+	return "JMAAS_" + strings.ToUpper(strings.Replace(key, ".", "_", -1))
+}
+
+// loadFile applies a TOML config file on top of c. Only the subset of TOML
+// the config needs is understood: [sections], comments, and key = value pairs
+// where the value is a string, number, boolean, or single-line string array.
+func (c *config) loadFile(r io.Reader, name string) error {
+	scanner := bufio.NewScanner(r)
+	section := ""
+	lineNum := 0
+	for scanner.Scan() {
+		lineNum++
+		line := strings.TrimSpace(stripComment(scanner.Text()))
+		if line == "" {
+			continue
+		}
+
+		if strings.HasPrefix(line, "[") && strings.HasSuffix(line, "]") {
+			section = strings.TrimSpace(line[1 : len(line)-1])
+			continue
+		}
+
+		eq := strings.Index(line, "=")
+		if eq < 0 {
+			return fmt.Errorf("%s:%d: expected key = value", name, lineNum)
+		}
+
+		key := strings.TrimSpace(line[:eq])
+		if section != "" {
+			key = section + "." + key
+		}
+
+		f := c.field(key)
+		if f == nil {
+			return fmt.Errorf("%s:%d: unknown config key %q", name, lineNum, key)
+		}
+
+		val, err := parseConfigValue(strings.TrimSpace(line[eq+1:]))
+		if err != nil {
+			return fmt.Errorf("%s:%d: %s", name, lineNum, err.Error())
+		}
+
+		if err := f.set(val); err != nil {
+			return fmt.Errorf("%s:%d: %s", name, lineNum, err.Error())
+		}
+	}
+	return scanner.Err()
+}
+
+func stripComment(line string) string {
+	inQuote := rune(0)
+	escaped := false
+	for i, r := range line {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuote == '"' && r == '\\':
+			escaped = true
+		case inQuote != 0 && r == inQuote:
+			inQuote = 0
+		case inQuote == 0 && (r == '"' || r == '\''):
+			inQuote = r
+		case inQuote == 0 && r == '#':
+			return line[:i]
+		}
+	}
+	return line
+}
+
+func parseConfigValue(raw string) (interface{}, error) {
+	if strings.HasPrefix(raw, "[") {
+		if !strings.HasSuffix(raw, "]") {
+			return nil, fmt.Errorf("unterminated array %s", raw)
+		}
+		items, err := splitArray(raw[1 : len(raw)-1])
+		if err != nil {
+			return nil, err
+		}
+		out := []string{}
+		for _, item := range items {
+			item = strings.TrimSpace(item)
+			if item == "" {
+				continue
+			}
+			if strings.HasPrefix(item, "[") {
+				return nil, fmt.Errorf("nested arrays are not supported")
+			}
+			s, err := parseConfigValue(item)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, s.(string))
+		}
+		return out, nil
+	}
+
+	if strings.HasPrefix(raw, "\"") {
+		return strconv.Unquote(raw)
+	}
+
+	if strings.HasPrefix(raw, "'") {
+		if len(raw) < 2 || !strings.HasSuffix(raw, "'") {
+			return nil, fmt.Errorf("unterminated string %s", raw)
+		}
+		return raw[1 : len(raw)-1], nil
+	}
+
+	return raw, nil
+}
+
+// splitArray splits the inside of an array on the commas that aren't in a
+// quoted string
+func splitArray(s string) ([]string, error) {
+	items := []string{}
+	inQuote := rune(0)
+	escaped := false
+	start := 0
+	for i, r := range s {
+		switch {
+		case escaped:
+			escaped = false
+		case inQuote == '"' && r == '\\':
+			escaped = true
+		case inQuote != 0 && r == inQuote:
+			inQuote = 0
+		case inQuote == 0 && (r == '"' || r == '\''):
+			inQuote = r
+		case inQuote == 0 && r == ',':
+			items = append(items, s[start:i])
+			start = i + 1
+		}
+	}
+	if inQuote != 0 {
+		return nil, fmt.Errorf("unterminated string in array [%s]", s)
+	}
+	return append(items, s[start:]), nil
+}
+
+// loadEnv applies any JMAAS_* variables set in the environment on top of c
+func (c *config) loadEnv() error {
+	for _, f := range c.fields() {
+		if val, ok := os.LookupEnv(envName(f.key)); ok {
+			if err := f.set(val); err != nil {
+				return fmt.Errorf("%s: %s", envName(f.key), err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// write prints c as a config file that loadFile would accept. Secrets that
+// are set are left commented out, so the output is safe to share.
+func (c *config) write(w io.Writer) {
+	section := ""
+	for _, f := range c.fields() {
+		name := f.key
+		if dot := strings.Index(f.key, "."); dot >= 0 {
+			if sec := f.key[:dot]; sec != section {
+				section = sec
+				fmt.Fprintf(w, "\n[%s]\n", section)
+			}
+			name = f.key[dot+1:]
+		}
+		if secretConfigKeys[f.key] && f.format() != `""` {
+			fmt.Fprintf(w, "# %s = (redacted)\n", name)
+			continue
+		}
+		fmt.Fprintf(w, "%s = %s\n", name, f.format())
+	}
+}
+
+func (c *config) validate() error {
+	switch c.TLSMode {
+	case "autocert":
+		if len(c.Domains) == 0 {
+			return fmt.Errorf("tls.mode is autocert but no tls.domains are configured")
+		}
+	case "files":
+		if c.CertFile == "" || c.KeyFile == "" {
+			return fmt.Errorf("tls.mode is files but tls.cert_file or tls.key_file is not set")
+		}
+		if c.ReloadInterval <= 0 {
+			return fmt.Errorf("tls.reload_interval must be positive")
+		}
+	case "none":
+	default:
+		return fmt.Errorf("unknown tls.mode %q, expected autocert, files, or none", c.TLSMode)
+	}
+
+	if _, err := parseTrustedProxies(c.TrustedProxies); err != nil {
+		return err
+	}
+	if c.ForceHTTPS && (c.TLSMode != "none" || len(c.TrustedProxies) == 0) {
+		return fmt.Errorf("proxy.force_https needs tls.mode none and at least one proxy.trusted address")
+	}
+
+	if c.StorageBackend != "file" && c.StorageBackend != "sqlite" {
+		return fmt.Errorf("unknown storage.backend %q, expected file or sqlite", c.StorageBackend)
+	}
+	if c.StorageBackend == "sqlite" && !hasSQLDriver("sqlite") {
+		return fmt.Errorf("storage.backend is sqlite but this build has no sqlite driver, rebuild with -tags sqlite")
+	}
+
+	if c.ExportTimeout <= 0 {
+		return fmt.Errorf("timeouts.export must be positive")
+	}
+	if c.LockoutThreshold > 0 && (c.LockoutBase <= 0 || c.LockoutMax < c.LockoutBase) {
+		return fmt.Errorf("limits.lockout_base must be positive and no more than limits.lockout_max")
+	}
+
+	if c.SocketReadTimeout < time.Second || c.SocketMaxMessageSize <= 0 {
+		return fmt.Errorf("sockets.read_timeout must be at least 1s and sockets.max_message_size positive")
+	}
+
+	if _, err := language.Parse(c.DefaultLocale); err != nil {
+		return fmt.Errorf("levels.default_locale %q is not a language tag", c.DefaultLocale)
+	}
+	if _, exists := levelTemplates[c.LevelTemplate]; c.LevelTemplate != "" && !exists {
+		return fmt.Errorf("unknown levels.template %q, expected one of %s", c.LevelTemplate, strings.Join(templateNames(), ", "))
+	}
+
+	if c.MQTTBroker != "" {
+		u, err := url.Parse(c.MQTTBroker)
+		if err != nil || u.Host == "" {
+			return fmt.Errorf("mqtt.broker %q is not a URL like tcp://host:1883", c.MQTTBroker)
+		}
+		switch u.Scheme {
+		case "tcp", "mqtt", "ssl", "tls", "mqtts":
+		default:
+			return fmt.Errorf("unknown mqtt.broker scheme %q, expected tcp or ssl", u.Scheme)
+		}
+		if c.MQTTClientID == "" || c.MQTTTopic == "" {
+			return fmt.Errorf("mqtt.client_id and mqtt.topic must be set when mqtt.broker is")
+		}
+		if strings.ContainsAny(c.MQTTTopic+c.MQTTCommandTopic, "+#") {
+			return fmt.Errorf("mqtt.topic and mqtt.command_topic can't have wildcards")
+		}
+	}
+
+	switch c.ClusterBackplane {
+	case "":
+	case "redis":
+		if c.ClusterRedisAddr == "" || c.ClusterRedisChannel == "" || c.ClusterSecret == "" {
+			return fmt.Errorf("cluster.redis_addr, cluster.redis_channel, and cluster.secret must be set for the redis backplane")
+		}
+	case "http":
+		if c.ClusterSecret == "" || len(c.ClusterPeers) == 0 {
+			return fmt.Errorf("cluster.secret and cluster.peers must be set for the http backplane")
+		}
+		for _, peer := range c.ClusterPeers {
+			if u, err := url.Parse(peer); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+				return fmt.Errorf("cluster.peers entry %q is not a URL like https://host", peer)
+			}
+		}
+	default:
+		return fmt.Errorf("unknown cluster.backplane %q, expected redis or http", c.ClusterBackplane)
+	}
+	if c.ClusterBackplane != "" && c.ClusterHeartbeat < time.Second {
+		return fmt.Errorf("cluster.heartbeat must be at least 1s")
+	}
+
+	if c.EnableNotify {
+		if u, err := url.Parse(c.NotifyBaseURL); err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+			return fmt.Errorf("features.notifications needs notifications.base_url, the board's address like https://host")
+		}
+		if c.SMTPAddr != "" {
+			if _, err := mail.ParseAddress(c.SMTPFrom); err != nil {
+				return fmt.Errorf("notifications.from must be an email address when notifications.smtp_addr is set")
+			}
+		}
+		if c.VAPIDKey == "" {
+			return fmt.Errorf("notifications.vapid_key must be set")
+		}
+		if c.NotifyRepeatAfter < 0 {
+			return fmt.Errorf("notifications.repeat_after can't be negative")
+		}
+		if c.ClusterBackplane != "" && c.ClusterNodeID == "" {
+			return fmt.Errorf("cluster.node_id must be set for features.notifications in a cluster, each subscription is notified by the node it was made on")
+		}
+	}
+
+	for _, r := range c.ReactionsAllowed {
+		if r == "" || len(r) > maxReactionLength {
+			return fmt.Errorf("reactions.allowed entries must be 1 to %d bytes", maxReactionLength)
+		}
+	}
+
+	if _, err := logLevels(c.LogLevel); err != nil {
+		return err
+	}
+	return nil
+}
+
+// loadConfig builds cfg from the defaults, the config file (from -config or
+// JMAAS_CONFIG), the environment, and any flags explicitly set. The result is
+// not validated so -print-config can show a config that won't start.
+func loadConfig() error {
+	c := defaultConfig()
+
+	path := *configPath
+	if path == "" {
+		path = os.Getenv("JMAAS_CONFIG")
+	}
+	if path != "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		err = c.loadFile(f, path)
+		f.Close()
+		if err != nil {
+			return err
+		}
+	}
+
+	if err := c.loadEnv(); err != nil {
+		return err
+	}
+
+	flag.Visit(func(fl *flag.Flag) {
+		switch fl.Name {
+		case "domain":
+			c.field("tls.domains").set(fl.Value.String())
+		case "listen":
+			c.Listen = fl.Value.String()
+		}
+	})
+
+	if *devMode {
+		c.TLSMode = "none"
+		c.Listen = c.DevListen
+	}
+
+	cfg = c
+	return nil
+}
+
+// dataPath resolves a file name inside the configured data directory
+func dataPath(name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+	return filepath.Join(cfg.DataDir, name)
+}
+
+func logLevels(name string) ([]log.Level, error) {
+	var lvl log.Level
+	if err := lvl.UnmarshalJSON([]byte(strconv.Quote(strings.ToUpper(name)))); err != nil || lvl > log.FatalLevel {
+		return nil, fmt.Errorf("unknown log_level %q", name)
+	}
+	return log.AllLevels[lvl:], nil
+}
@@ -0,0 +1,167 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseConfigValue(t *testing.T) {
+	tests := []struct {
+		raw  string
+		want interface{}
+	}{
+		{`"plain"`, "plain"},
+		{`'literal \n'`, `literal \n`},
+		{`"tab\tand \"quotes\""`, "tab\tand \"quotes\""},
+		{`42`, "42"},
+		{`[]`, []string{}},
+		{`["a", "b",]`, []string{"a", "b"}},
+		{`["a,b", 'c,d', "e\",f"]`, []string{"a,b", "c,d", "e\",f"}},
+		{`[ "x" ,'y' ]`, []string{"x", "y"}},
+	}
+
+	for _, test := range tests {
+		got, err := parseConfigValue(test.raw)
+		if err != nil {
+			t.Errorf("parseConfigValue(%s) failed: %s", test.raw, err.Error())
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("parseConfigValue(%s) = %#v, want %#v", test.raw, got, test.want)
+		}
+	}
+
+	for _, raw := range []string{`["a"`, `["a, b]`, `[["a"]]`, `'open`} {
+		if _, err := parseConfigValue(raw); err == nil {
+			t.Errorf("parseConfigValue(%s) should have failed", raw)
+		}
+	}
+}
+
+func TestStripComment(t *testing.T) {
+	tests := []struct {
+		line string
+		want string
+	}{
+		{`key = "value" # comment`, `key = "value" `},
+		{`key = "a # b"`, `key = "a # b"`},
+		{`key = 'a # b' # c`, `key = 'a # b' `},
+		{`key = "say \"#1\"" # c`, `key = "say \"#1\"" `},
+		{`key = "ends in \\" # c`, `key = "ends in \\" `},
+		{`key = 'C:\' # c`, `key = 'C:\' `},
+		{`# whole line`, ``},
+	}
+
+	for _, test := range tests {
+		if got := stripComment(test.line); got != test.want {
+			t.Errorf("stripComment(%s) = %s, want %s", test.line, got, test.want)
+		}
+	}
+}
+
+func TestLoadFile(t *testing.T) {
+	file := `
+# a comment
+data_dir = "/var/lib/jmaas" # trailing
+
+[listen]
+address = ":8443"
+
+[tls]
+mode = "none"
+domains = ["a.example.com", "b.example.com"]
+
+[timeouts]
+write = "1m"
+
+[limits]
+ip_burst = 7
+
+[features]
+http2 = false
+
+[mqtt]
+password = "p#ss\"word"
+`
+	c := defaultConfig()
+	if err := c.loadFile(strings.NewReader(file), "test.toml"); err != nil {
+		t.Fatal(err)
+	}
+
+	if c.DataDir != "/var/lib/jmaas" || c.Listen != ":8443" || c.TLSMode != "none" {
+		t.Errorf("strings were not loaded: %q %q %q", c.DataDir, c.Listen, c.TLSMode)
+	}
+	if !reflect.DeepEqual(c.Domains, []string{"a.example.com", "b.example.com"}) {
+		t.Errorf("tls.domains = %#v", c.Domains)
+	}
+	if c.WriteTimeout != time.Minute || c.IPBurst != 7 || c.EnableHTTP2 {
+		t.Errorf("typed values were not loaded: %s %d %t", c.WriteTimeout, c.IPBurst, c.EnableHTTP2)
+	}
+	if c.MQTTPassword != `p#ss"word` {
+		t.Errorf("mqtt.password = %q", c.MQTTPassword)
+	}
+
+	errors := map[string]string{
+		"nope = 1":                    "unknown config key",
+		"[limits]\nip_burst = lots":   "not an integer",
+		"[timeouts]\nread = 5":        "not a duration",
+		"[listen]\naddress = [\"a\"]": "expected a single value",
+		"data_dir":                    "expected key = value",
+	}
+	for file, want := range errors {
+		err := defaultConfig().loadFile(strings.NewReader(file), "test.toml")
+		if err == nil || !strings.Contains(err.Error(), want) {
+			t.Errorf("loading %q: got %v, want an error containing %q", file, err, want)
+		}
+	}
+}
+
+func TestWriteConfig(t *testing.T) {
+	c := defaultConfig()
+	c.Domains = []string{"a,b.example.com", `quote"d`}
+	c.MQTTPassword = "hunter2"
+	c.ClusterSecret = "shared secret"
+	c.ClusterRedisPassword = "s3cret-redis"
+	c.SMTPPassword = "s3cret-smtp"
+
+	buf := &bytes.Buffer{}
+	c.write(buf)
+	for _, secret := range []string{"hunter2", "shared secret", "s3cret-redis", "s3cret-smtp"} {
+		if strings.Contains(buf.String(), secret) {
+			t.Errorf("-print-config output contains secret %q", secret)
+		}
+	}
+
+	// Everything but the redacted secrets should load back unchanged
+	loaded := defaultConfig()
+	if err := loaded.loadFile(buf, "printed.toml"); err != nil {
+		t.Fatal(err)
+	}
+	c.MQTTPassword, c.ClusterSecret, c.ClusterRedisPassword, c.SMTPPassword = "", "", "", ""
+	if !reflect.DeepEqual(loaded, c) {
+		t.Errorf("printed config did not load back the same:\n%#v\n%#v", loaded, c)
+	}
+}
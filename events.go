@@ -0,0 +1,288 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-playground/log"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// event is something that happened in the server. Everything that reacts to
+// changes, the sockets, MQTT, and the audit log, subscribes to the bus
+// instead of being called from the handlers.
+type event interface {
+	eventType() string
+}
+
+// auditedEvent is an event that's recorded in the audit log
+type auditedEvent interface {
+	event
+	auditEntry() auditEntry
+}
+
+// levelChanged is published whenever the board's level is set, Level and
+// Previous are the same when only the level's definition changed
+type levelChanged struct {
+	Time       time.Time
+	Level      int
+	Previous   int
+	Event      int64
+	Actor      string
+	ApprovedBy string
+	Reason     string
+	// Remote is set on changes made on another node of the cluster, so
+	// they aren't sent back
+	Remote bool
+}
+
+// levelPending is a change waiting for approval, or what became of it
+type levelPending struct {
+	Change *pendingChange
+	Status string
+	By     string
+	Remote bool
+}
+
+// reactionsChanged has the counts for the event after Reaction was added,
+// Reaction is empty when only the counts are being sent
+type reactionsChanged struct {
+	Event    int64
+	Key      string
+	Counts   map[string]int
+	Reaction string
+	Remote   bool
+}
+
+type presenceChanged struct {
+	Presence presence
+}
+
+type tokenCreated struct {
+	Time  time.Time
+	Actor string
+	Token string
+	Note  string
+	Role  string
+}
+
+type tokenRevoked struct {
+	Time  time.Time
+	Actor string
+	Token string
+}
+
+type tokensImported struct {
+	Time    time.Time
+	Actor   string
+	Count   int
+	Replace bool
+}
+
+type levelsEdited struct {
+	Time    time.Time
+	Actor   string
+	Levels  int
+	Changes []levelChange
+}
+
+type socketKicked struct {
+	Time  time.Time
+	Actor string
+	ID    string
+}
+
+func (levelChanged) eventType() string     { return "level.changed" }
+func (levelPending) eventType() string     { return "level.pending" }
+func (reactionsChanged) eventType() string { return "reactions.changed" }
+func (presenceChanged) eventType() string  { return "presence.changed" }
+func (tokenCreated) eventType() string     { return "token.created" }
+func (tokenRevoked) eventType() string     { return "token.revoked" }
+func (tokensImported) eventType() string   { return "tokens.imported" }
+func (levelsEdited) eventType() string     { return "levels.edited" }
+func (socketKicked) eventType() string     { return "socket.kicked" }
+
+// Tokens in audit entries are always redacted
+func (e tokenCreated) auditEntry() auditEntry {
+	return auditEntry{Time: e.Time, Actor: e.Actor, Action: "token.create", Detail: fmt.Sprintf("%s token %s for '%s'", e.Role, redactToken(e.Token), e.Note)}
+}
+
+func (e tokenRevoked) auditEntry() auditEntry {
+	return auditEntry{Time: e.Time, Actor: e.Actor, Action: "token.revoke", Detail: redactToken(e.Token)}
+}
+
+func (e tokensImported) auditEntry() auditEntry {
+	return auditEntry{Time: e.Time, Actor: e.Actor, Action: "token.import", Detail: fmt.Sprintf("%d tokens, replace=%t", e.Count, e.Replace)}
+}
+
+func (e levelsEdited) auditEntry() auditEntry {
+	return auditEntry{Time: e.Time, Actor: e.Actor, Action: "levels.import", Detail: fmt.Sprintf("%d levels, %d changes", e.Levels, len(e.Changes))}
+}
+
+func (e socketKicked) auditEntry() auditEntry {
+	return auditEntry{Time: e.Time, Actor: e.Actor, Action: "socket.kick", Detail: e.ID}
+}
+
+// eventQueueWarning is how far behind a subscriber gets before we log it,
+// again at every multiple
+const eventQueueWarning = 1000
+
+// eventQueueLimit is how far behind a subscriber can get before its oldest
+// events are dropped, so one that's stuck can't use up all the memory. Like
+// a socket that isn't keeping up, it's better off missing some than holding
+// everything else up.
+const eventQueueLimit = 10 * eventQueueWarning
+
+// eventBus delivers every published event to every subscriber. Each
+// subscriber has its own queue and goroutine, so it sees events in the order
+// they were published, and a slow one only holds up itself, up to
+// eventQueueLimit.
+type eventBus struct {
+	mu          sync.RWMutex
+	subscribers []*eventSubscriber
+	// undelivered counts queued events across subscribers, for drain
+	undelivered int64
+}
+
+type eventSubscriber struct {
+	name string
+	fn   func(event)
+
+	mu      sync.Mutex
+	queue   []event
+	dropped int
+	wake    chan struct{}
+}
+
+var events = &eventBus{}
+
+// subscribe has fn called with every event published from now on, name is
+// only used in logs
+func (b *eventBus) subscribe(name string, fn func(event)) {
+	s := &eventSubscriber{name: name, fn: fn, wake: make(chan struct{}, 1)}
+	go s.run(b)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.subscribers = append(b.subscribers, s)
+}
+
+// publish queues e for every subscriber and returns straight away. Callers
+// that need their events ordered publish while holding whatever lock orders
+// the changes, like levelMu.
+func (b *eventBus) publish(e event) {
+	log.Debugf("event %s", e.eventType())
+
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for _, s := range b.subscribers {
+		atomic.AddInt64(&b.undelivered, 1)
+		if s.push(e) {
+			atomic.AddInt64(&b.undelivered, -1)
+		}
+	}
+}
+
+// drain waits for every queued event to be delivered, or ctx to be done
+func (b *eventBus) drain(ctx context.Context) error {
+	ticker := time.NewTicker(10 * time.Millisecond)
+	defer ticker.Stop()
+
+	for atomic.LoadInt64(&b.undelivered) > 0 {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ticker.C:
+		}
+	}
+	return nil
+}
+
+// push queues e, reporting whether the oldest event was dropped to make room
+func (s *eventSubscriber) push(e event) bool {
+	s.mu.Lock()
+	full := len(s.queue) >= eventQueueLimit
+	if full {
+		s.queue[0] = nil
+		s.queue = s.queue[1:]
+		s.dropped++
+	}
+	s.queue = append(s.queue, e)
+	queued, dropped := len(s.queue), s.dropped
+	s.mu.Unlock()
+
+	if full && (dropped == 1 || dropped%eventQueueWarning == 0) {
+		log.Warnf("Event subscriber %s is stuck, dropped %d events so far", s.name, dropped)
+	} else if !full && queued%eventQueueWarning == 0 {
+		log.Warnf("Event subscriber %s is %d events behind", s.name, queued)
+	}
+
+	select {
+	case s.wake <- struct{}{}:
+	default:
+	}
+	return full
+}
+
+func (s *eventSubscriber) run(b *eventBus) {
+	for range s.wake {
+		for {
+			s.mu.Lock()
+			if len(s.queue) == 0 {
+				s.mu.Unlock()
+				break
+			}
+			e := s.queue[0]
+			s.queue[0] = nil
+			s.queue = s.queue[1:]
+			s.mu.Unlock()
+
+			s.deliver(e)
+			atomic.AddInt64(&b.undelivered, -1)
+		}
+	}
+}
+
+// deliver calls the subscriber, a panic in one is logged rather than taking
+// the server down
+func (s *eventSubscriber) deliver(e event) {
+	defer func() {
+		if err := recover(); err != nil {
+			log.Errorf("Event subscriber %s panicked on %s: %v", s.name, e.eventType(), err)
+		}
+	}()
+	s.fn(e)
+}
+
+// auditEvents is the audit log's subscriber, failing to write an entry is
+// logged but doesn't undo the action
+func auditEvents(e event) {
+	audited, ok := e.(auditedEvent)
+	if !ok {
+		return
+	}
+	if err := store.AppendAudit(audited.auditEntry()); err != nil {
+		log.Errorf("Could not write audit entry: %s", err.Error())
+	}
+}
@@ -0,0 +1,72 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestEventBusDropsOldestWhenStuck(t *testing.T) {
+	b := &eventBus{}
+	started, release := make(chan struct{}), make(chan struct{})
+	got := []int{}
+	b.subscribe("stuck", func(e event) {
+		if len(got) == 0 {
+			close(started)
+			<-release
+		}
+		got = append(got, e.(presenceChanged).Presence.Viewers)
+	})
+
+	const extra = 100
+
+	// The stuck one doesn't hold up anyone else
+	caughtUp := make(chan struct{})
+	b.subscribe("fast", func(e event) {
+		if e.(presenceChanged).Presence.Viewers == eventQueueLimit+extra {
+			close(caughtUp)
+		}
+	})
+
+	b.publish(presenceChanged{})
+	<-started
+	for i := 1; i <= eventQueueLimit+extra; i++ {
+		b.publish(presenceChanged{Presence: presence{Viewers: i}})
+	}
+	select {
+	case <-caughtUp:
+	case <-time.After(5 * time.Second):
+		t.Fatal("the other subscriber was held up")
+	}
+	close(release)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.drain(ctx); err != nil {
+		t.Fatalf("drain: %s", err.Error())
+	}
+
+	if len(got) != eventQueueLimit+1 || got[0] != 0 || got[1] != extra+1 || got[len(got)-1] != eventQueueLimit+extra {
+		t.Errorf("the stuck subscriber got %d events, %v first and %d last", len(got), got[:2], got[len(got)-1])
+	}
+}
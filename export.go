@@ -0,0 +1,336 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// exportFlushEvery is how many rows are written between flushes, each flush
+// also gives the response another write timeout to finish in
+const exportFlushEvery = 200
+
+var errExportTimeout = errors.New("export took too long")
+
+// historyColumns and auditColumns are every column each log can export, in
+// the order they're exported by default
+var (
+	historyColumns = []string{"id", "time", "kind", "level", "title", "previous", "actor", "approved_by", "reason", "reactions"}
+	auditColumns   = []string{"time", "actor", "action", "detail"}
+)
+
+// exportWriter writes rows in one of the export formats
+type exportWriter interface {
+	begin(columns []string) error
+	row(values []interface{}) error
+	end() error
+}
+
+// csvExport has a header row, reactions are a JSON object in one cell
+type csvExport struct {
+	w *csv.Writer
+}
+
+func (e *csvExport) begin(columns []string) error {
+	return e.w.Write(columns)
+}
+
+func (e *csvExport) row(values []interface{}) error {
+	record := make([]string, len(values))
+	for i, v := range values {
+		switch v := v.(type) {
+		case string:
+			record[i] = v
+		case int:
+			record[i] = strconv.Itoa(v)
+		case int64:
+			record[i] = strconv.FormatInt(v, 10)
+		case map[string]int:
+			if len(v) > 0 {
+				j, _ := json.Marshal(v)
+				record[i] = string(j)
+			}
+		}
+	}
+	return e.w.Write(record)
+}
+
+func (e *csvExport) end() error {
+	e.w.Flush()
+	return e.w.Error()
+}
+
+// jsonExport writes objects with the columns in order, as one array or, with
+// lines set, one object per line
+type jsonExport struct {
+	w       io.Writer
+	lines   bool
+	columns []string
+	rows    int
+}
+
+func (e *jsonExport) begin(columns []string) error {
+	e.columns = columns
+	if e.lines {
+		return nil
+	}
+	_, err := io.WriteString(e.w, "[")
+	return err
+}
+
+func (e *jsonExport) row(values []interface{}) error {
+	buf := &bytes.Buffer{}
+	if !e.lines && e.rows > 0 {
+		buf.WriteString(",")
+	}
+	if !e.lines {
+		buf.WriteString("\n")
+	}
+	buf.WriteString("{")
+	for i, v := range values {
+		if i > 0 {
+			buf.WriteString(",")
+		}
+		name, _ := json.Marshal(e.columns[i])
+		value, err := json.Marshal(v)
+		if err != nil {
+			return err
+		}
+		buf.Write(name)
+		buf.WriteString(":")
+		buf.Write(value)
+	}
+	buf.WriteString("}")
+	if e.lines {
+		buf.WriteString("\n")
+	}
+	e.rows++
+	_, err := e.w.Write(buf.Bytes())
+	return err
+}
+
+func (e *jsonExport) end() error {
+	if e.lines {
+		return nil
+	}
+	_, err := io.WriteString(e.w, "\n]\n")
+	return err
+}
+
+// selectColumns checks the columns parameter against a log's columns, all
+// of them when it's empty
+func selectColumns(param string, available []string) ([]string, error) {
+	if param == "" {
+		return available, nil
+	}
+	known := map[string]bool{}
+	for _, c := range available {
+		known[c] = true
+	}
+
+	columns := []string{}
+	for _, c := range strings.Split(param, ",") {
+		c = strings.TrimSpace(c)
+		if !known[c] {
+			return nil, fmt.Errorf("unknown column %q, expected some of %s", c, strings.Join(available, ", "))
+		}
+		columns = append(columns, c)
+	}
+	return columns, nil
+}
+
+// historyExportHandler streams the history or, for admins, the audit log as
+// CSV, a JSON array, or newline-delimited JSON. It takes log (history or
+// audit), format, from and to, columns as a comma-separated list, and tz for
+// the time zone times are written in. Rows are written as they're read from
+// the store, so any range can be exported without holding it in memory, and
+// an export that takes longer than timeouts.export is cut off so a slow
+// client can't keep reading forever.
+func historyExportHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+
+	logName := query.Get("log")
+	if logName == "" {
+		logName = "history"
+	}
+	available := historyColumns
+	switch logName {
+	case "history":
+		if cfg.HistoryPrivate {
+			if _, _, ok := authToken(w, r, requestToken(r)); !ok {
+				return
+			}
+		}
+	case "audit":
+		_, attr, ok := authToken(w, r, requestToken(r))
+		if !ok {
+			return
+		}
+		if attr.role() != roleAdmin {
+			w.Header().Set("Content-Type", "text/plain")
+			w.WriteHeader(http.StatusForbidden)
+			w.Write([]byte("token is not an admin"))
+			return
+		}
+		available = auditColumns
+	default:
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("log must be history or audit"))
+		return
+	}
+
+	format := query.Get("format")
+	if format == "" {
+		format = "csv"
+	}
+	contentType := map[string]string{
+		"csv":    "text/csv; charset=utf-8",
+		"json":   "application/json",
+		"ndjson": "application/x-ndjson",
+	}[format]
+
+	from, err := parseRangeParam(r, "from")
+	to, toErr := parseRangeParam(r, "to")
+	if err == nil {
+		err = toErr
+	}
+	if err == nil && contentType == "" {
+		err = fmt.Errorf("format must be csv, json, or ndjson")
+	}
+	if err == nil && !from.IsZero() && !to.IsZero() && !to.After(from) {
+		err = fmt.Errorf("to must be after from")
+	}
+	columns, colErr := selectColumns(query.Get("columns"), available)
+	if err == nil {
+		err = colErr
+	}
+	loc := time.UTC
+	if tz := query.Get("tz"); tz != "" && err == nil {
+		if loc, err = time.LoadLocation(tz); err != nil {
+			err = fmt.Errorf("unknown time zone %q", tz)
+		}
+	}
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	levels, err := store.Levels()
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+	}
+	locale := negotiateLocale(r, levels)
+	levels = levels.localized(locale)
+
+	w.Header().Set("Content-Type", contentType)
+	w.Header().Set("Content-Disposition", fmt.Sprintf(`attachment; filename="%s-%s.%s"`, logName, time.Now().In(loc).Format("20060102"), format))
+	w.Header().Set("Cache-Control", "no-store")
+	setLocaleHeaders(w, locale)
+
+	var out exportWriter
+	if format == "csv" {
+		out = &csvExport{w: csv.NewWriter(w)}
+	} else {
+		out = &jsonExport{w: w, lines: format == "ndjson"}
+	}
+
+	deadline := time.Now().Add(cfg.ExportTimeout)
+	rc := http.NewResponseController(w)
+	rows := 0
+	write := func(values map[string]interface{}) error {
+		if time.Now().After(deadline) {
+			return errExportTimeout
+		}
+		row := make([]interface{}, len(columns))
+		for i, c := range columns {
+			row[i] = values[c]
+		}
+		if err := out.row(row); err != nil {
+			return err
+		}
+		if rows++; rows%exportFlushEvery == 0 {
+			if csvOut, isCSV := out.(*csvExport); isCSV {
+				csvOut.w.Flush()
+			}
+			writeDeadline := time.Now().Add(cfg.WriteTimeout)
+			if writeDeadline.After(deadline) {
+				writeDeadline = deadline
+			}
+			rc.SetWriteDeadline(writeDeadline)
+			rc.Flush()
+		}
+		return nil
+	}
+
+	if err := out.begin(columns); err != nil {
+		return
+	}
+	if logName == "history" {
+		err = store.History(from, to, func(entry historyEntry) error {
+			return write(map[string]interface{}{
+				"id":          entry.ID,
+				"time":        entry.Time.In(loc).Format(time.RFC3339),
+				"kind":        entry.Kind,
+				"level":       entry.Level,
+				"title":       excerpt(levels[entry.Level].Title),
+				"previous":    entry.Previous,
+				"actor":       entry.Actor,
+				"approved_by": entry.ApprovedBy,
+				"reason":      entry.Reason,
+				"reactions":   entry.Reactions,
+			})
+		})
+	} else {
+		err = store.Audit(from, to, func(entry auditEntry) error {
+			return write(map[string]interface{}{
+				"time":   entry.Time.In(loc).Format(time.RFC3339),
+				"actor":  entry.Actor,
+				"action": entry.Action,
+				"detail": entry.Detail,
+			})
+		})
+	}
+	if err != nil && time.Now().After(deadline) {
+		log.Warnf("Stopped exporting the %s log to %s after %s", logName, clientIP(r), cfg.ExportTimeout)
+		return
+	}
+	if err != nil {
+		// The status is long gone, all that can be done is stop early
+		log.Errorf("Could not export the %s log: %s", logName, err.Error())
+		return
+	}
+	if err := out.end(); err != nil {
+		log.Warnf("Could not finish exporting the %s log: %s", logName, err.Error())
+	}
+}
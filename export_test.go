@@ -0,0 +1,55 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHistoryExportTimeout(t *testing.T) {
+	setupTestServer(t)
+	start := time.Date(2026, 5, 1, 0, 0, 0, 0, time.UTC)
+	for i := 0; i < 3*exportFlushEvery; i++ {
+		if _, err := store.AppendHistory(historyEntry{Time: start.Add(time.Duration(i) * time.Minute), Level: i % 5}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	export := func() string {
+		w := httptest.NewRecorder()
+		historyExportHandler(w, httptest.NewRequest("GET", "/api/history/export?format=json&columns=id,level", nil))
+		return w.Body.String()
+	}
+
+	rows := []map[string]int{}
+	if err := json.Unmarshal([]byte(export()), &rows); err != nil || len(rows) != 3*exportFlushEvery {
+		t.Errorf("exported %d rows, want %d: %v", len(rows), 3*exportFlushEvery, err)
+	}
+
+	cfg.ExportTimeout = time.Nanosecond
+	if body := export(); strings.HasSuffix(strings.TrimSpace(body), "]") || strings.Contains(body, `"id"`) {
+		t.Errorf("an export past timeouts.export wasn't cut off:\n%.200s", body)
+	}
+}
@@ -22,18 +22,41 @@ package main
 
 import (
 	"crypto/md5"
+	"errors"
 	"fmt"
 	"github.com/go-playground/log"
 	"io/ioutil"
 	"mime"
 	"net/http"
 	"os"
+	"path"
 	"path/filepath"
 	"strings"
 	"sync"
 	"time"
 )
 
+// assetRoot is the only directory indexHandler will serve files out of
+const assetRoot = "./client"
+
+// assetExtensions is the allow-list of file types that can be served from
+// assetRoot, anything else (like the icon's .psd source) is never served
+var assetExtensions = map[string]bool{
+	".html": true,
+	".css":  true,
+	".js":   true,
+	".json": true,
+	".png":  true,
+	".jpg":  true,
+	".svg":  true,
+	".ico":  true,
+}
+
+var (
+	errAssetMissing  = errors.New("asset does not exist")
+	errAssetRejected = errors.New("asset path is not allowed")
+)
+
 type fileSum struct {
 	Time     time.Time
 	Sum      string
@@ -66,6 +89,8 @@ func serveFile(w http.ResponseWriter, r *http.Request, path string) {
 			log.Errorf("%s:%s\n", path, err.Error())
 			return
 		}
+		// Service workers are refused unless they're served as JavaScript
+		w.Header().Set("Content-Type", mime.TypeByExtension(filepath.Ext(path)))
 		w.Write(content)
 		return
 	}
@@ -82,7 +107,7 @@ func serveFile(w http.ResponseWriter, r *http.Request, path string) {
 		mod = fileSum.Modified
 	}
 
-	if strings.Contains(path, ".html") {
+	if cfg.EnableServerPush && strings.Contains(path, ".html") {
 		if pusher, ok := w.(http.Pusher); ok {
 			if err := pusher.Push("/static/style.css", nil); err != nil {
 				log.Warnf("Failed to push: %v", err)
@@ -99,7 +124,7 @@ func serveFile(w http.ResponseWriter, r *http.Request, path string) {
 	w.Header().Set("Last-Modified", mod.Format(time.RFC1123))
 	w.Header().Set("Expires", mod.Add((24*365)*time.Hour).Format(time.RFC1123))
 	w.Header().Set("ETag", sum)
-	if r.Header.Get("If-None-Match") == sum {
+	if etagMatches(r, sum) {
 		w.WriteHeader(http.StatusNotModified)
 		return
 	}
@@ -114,6 +139,51 @@ func serveFile(w http.ResponseWriter, r *http.Request, path string) {
 	return
 }
 
+// resolveAsset maps a request path onto a regular file inside assetRoot.
+// Paths containing dotfile or traversal segments, backslashes, NUL bytes, or
+// extensions not in assetExtensions return errAssetRejected, paths that are
+// allowed but don't exist on disk return errAssetMissing.
+func resolveAsset(urlPath string) (string, error) {
+	if strings.ContainsAny(urlPath, "\\\x00") {
+		return "", errAssetRejected
+	}
+
+	for _, seg := range strings.Split(urlPath, "/") {
+		if strings.HasPrefix(seg, ".") {
+			return "", errAssetRejected
+		}
+	}
+
+	clean := path.Clean("/" + urlPath)
+	if clean == "/" {
+		clean = "/index.html"
+	}
+
+	ext := strings.ToLower(path.Ext(clean))
+	if ext == "" {
+		return "", errAssetMissing
+	}
+	if !assetExtensions[ext] {
+		return "", errAssetRejected
+	}
+
+	full := assetRoot + clean
+	rel, err := filepath.Rel(assetRoot, filepath.FromSlash(full))
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return "", errAssetRejected
+	}
+
+	stat, err := os.Lstat(full)
+	if err != nil {
+		return "", errAssetMissing
+	}
+	if !stat.Mode().IsRegular() {
+		return "", errAssetRejected
+	}
+
+	return full, nil
+}
+
 func readFile(path string) ([]byte, string, time.Time, error) {
 	mu.Lock()
 	defer mu.Unlock()
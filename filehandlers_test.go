@@ -0,0 +1,87 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestResolveAsset(t *testing.T) {
+	tests := []struct {
+		path string
+		want string
+		err  error
+	}{
+		{"/", assetRoot + "/index.html", nil},
+		{"/static/style.css", assetRoot + "/static/style.css", nil},
+		{"/static//style.css", assetRoot + "/static/style.css", nil},
+		{"/static/./style.css", "", errAssetRejected},
+		{"/../main.go", "", errAssetRejected},
+		{"/static/../../main.go", "", errAssetRejected},
+		{"/static/..", "", errAssetRejected},
+		{"/static\\..\\..\\main.go", "", errAssetRejected},
+		{"/static/style.css\x00.png", "", errAssetRejected},
+		{"/.git/config", "", errAssetRejected},
+		{"/static/.hidden.css", "", errAssetRejected},
+		{"/static/icon.psd", "", errAssetRejected},
+		{"/static/ICON.PSD", "", errAssetRejected},
+		{"/static/missing.css", "", errAssetMissing},
+		{"/some/page", "", errAssetMissing},
+	}
+
+	for _, test := range tests {
+		got, err := resolveAsset(test.path)
+		if got != test.want || err != test.err {
+			t.Errorf("resolveAsset(%q) = %q, %v, want %q, %v", test.path, got, err, test.want, test.err)
+		}
+	}
+}
+
+func TestIndexHandlerEncodedPaths(t *testing.T) {
+	tests := []struct {
+		target string
+		status int
+	}{
+		{"/static/style.css", http.StatusOK},
+		{"/static/%73tyle.css", http.StatusOK},
+		{"/%2e%2e/main.go", http.StatusNotFound},
+		{"/static/%2e%2e/%2e%2e/main.go", http.StatusNotFound},
+		{"/static/%2E%2E%2F%2E%2E%2Fmain.go", http.StatusNotFound},
+		{"/static%2f..%2f..%2fmain.go", http.StatusNotFound},
+		{"/static/%5c..%5c..%5cmain.go", http.StatusNotFound},
+		{"/static/style.css%00.png", http.StatusNotFound},
+		{"/%2egit/config", http.StatusNotFound},
+		{"/static/icon%2epsd", http.StatusNotFound},
+		{"/static/missing.css", http.StatusNotFound},
+		{"/static/missing", http.StatusNotFound},
+		{"/kiosk.html", http.StatusNotFound},
+	}
+
+	for _, test := range tests {
+		w := httptest.NewRecorder()
+		indexHandler(w, httptest.NewRequest("GET", test.target, nil))
+		if w.Code != test.status {
+			t.Errorf("GET %s = %d, want %d", test.target, w.Code, test.status)
+		}
+	}
+}
@@ -0,0 +1,774 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/gob"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// fileStore keeps everything as plain files in the data directory: tokens in
+// tokens.gob, levels in levels.json, the current state in state.json, and the
+// history and audit logs as newline-delimited JSON. History IDs are line
+// numbers, and since the log is append-only, each entry's reactions live in
+// reactions/ID.json. Notification subscriptions are in subscriptions.json.
+type fileStore struct {
+	mu            sync.RWMutex
+	dir           string
+	tokens        tokenList
+	levels        levelSet
+	state         serverState
+	historyID     int64
+	reactions     map[int64]map[string]int
+	subscriptions map[string]subscription
+
+	// historyIndex marks every historyIndexStride'th line of history.jsonl,
+	// so reading from a time doesn't start at the top of the file
+	historyIndex []historyMark
+	// historyNewest is the newest time in history.jsonl, entries from other
+	// nodes aren't necessarily in order
+	historyNewest time.Time
+	lastChange    *historyMark
+	// lastAppend is how the index was before the last AppendHistory, so
+	// DeleteLastHistory can put it back
+	lastAppend *historyUndo
+}
+
+type historyUndo struct {
+	offset     int64
+	marks      int
+	newest     time.Time
+	lastChange *historyMark
+}
+
+// historyMark is where a line of history.jsonl starts. For index marks, time
+// is the newest of the entries before it, for lastChange it's the entry's own.
+type historyMark struct {
+	time   time.Time
+	offset int64
+	line   int64
+}
+
+const historyIndexStride = 1024
+
+// errLogEnd stops reading a log early
+var errLogEnd = errors.New("end of log")
+
+// fileMigrations upgrade a data directory one version at a time, the version
+// a directory is at lives in its store_version file
+var fileMigrations = []func(s *fileStore) error{
+	// 1: history and audit logs
+	func(s *fileStore) error {
+		for _, name := range []string{"history.jsonl", "audit.jsonl"} {
+			f, err := os.OpenFile(s.path(name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+			if err != nil {
+				return err
+			}
+			f.Close()
+		}
+		return nil
+	},
+	// 2: reactions split out of reactions.json into a file per entry
+	func(s *fileStore) error {
+		if err := os.MkdirAll(s.path("reactions"), 0755); err != nil {
+			return err
+		}
+
+		b, err := ioutil.ReadFile(s.path("reactions.json"))
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		all := map[int64]map[string]int{}
+		if err := json.Unmarshal(b, &all); err != nil {
+			return fmt.Errorf("could not read reactions.json: %s", err.Error())
+		}
+
+		newest := int64(0)
+		for id := range all {
+			if id > newest {
+				newest = id
+			}
+		}
+		for id, counts := range all {
+			if id <= newest-reactionsKept {
+				continue
+			}
+			if err := s.writeReactions(id, counts); err != nil {
+				return err
+			}
+		}
+		return os.Remove(s.path("reactions.json"))
+	},
+}
+
+func openFileStore(dir string) (*fileStore, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+
+	s := &fileStore{
+		dir:           dir,
+		tokens:        tokenList{},
+		levels:        levelSet{},
+		reactions:     map[int64]map[string]int{},
+		subscriptions: map[string]subscription{},
+	}
+
+	if err := s.migrate(); err != nil {
+		return nil, fmt.Errorf("could not migrate %s: %s", dir, err.Error())
+	}
+
+	if f, err := os.Open(s.path("tokens.gob")); err == nil {
+		err = gob.NewDecoder(f).Decode(&s.tokens)
+		f.Close()
+		// An empty file is what the server used to create on first start
+		if err != nil && err != io.EOF {
+			return nil, fmt.Errorf("could not read tokens.gob: %s", err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	levels, err := readLevelsFile(s.path("levels.json"))
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if levels != nil {
+		s.levels = levels
+	}
+
+	names, err := ioutil.ReadDir(s.path("reactions"))
+	if err != nil {
+		return nil, err
+	}
+	for _, info := range names {
+		id, err := strconv.ParseInt(strings.TrimSuffix(info.Name(), ".json"), 10, 64)
+		if err != nil || !strings.HasSuffix(info.Name(), ".json") {
+			continue
+		}
+		b, err := ioutil.ReadFile(s.path("reactions", info.Name()))
+		if err != nil {
+			return nil, err
+		}
+		counts := map[string]int{}
+		if err := json.Unmarshal(b, &counts); err != nil {
+			return nil, fmt.Errorf("could not read reactions/%s: %s", info.Name(), err.Error())
+		}
+		s.reactions[id] = counts
+	}
+
+	if b, err := ioutil.ReadFile(s.path("subscriptions.json")); err == nil {
+		if err := json.Unmarshal(b, &s.subscriptions); err != nil {
+			return nil, fmt.Errorf("could not read subscriptions.json: %s", err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	err = s.scanLog("history.jsonl", func(offset int64, line []byte) error {
+		entry := historyEntry{}
+		if err := json.Unmarshal(line, &entry); err != nil {
+			return err
+		}
+		s.historyID++
+		s.indexHistoryLocked(entry, offset)
+		return nil
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read history.jsonl: %s", err.Error())
+	}
+	err = s.scanLog("audit.jsonl", func(offset int64, line []byte) error {
+		return json.Unmarshal(line, &json.RawMessage{})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("could not read audit.jsonl: %s", err.Error())
+	}
+
+	if b, err := ioutil.ReadFile(s.path("state.json")); err == nil {
+		if err := json.Unmarshal(b, &s.state); err != nil {
+			return nil, fmt.Errorf("could not read state.json: %s", err.Error())
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	return s, nil
+}
+
+func (s *fileStore) path(elem ...string) string {
+	return filepath.Join(append([]string{s.dir}, elem...)...)
+}
+
+// fileStoreVersion reads dir's store_version, 0 for a new directory
+func fileStoreVersion(dir string) (int, error) {
+	b, err := ioutil.ReadFile(filepath.Join(dir, "store_version"))
+	if os.IsNotExist(err) {
+		return 0, nil
+	} else if err != nil {
+		return 0, err
+	}
+	version, err := strconv.Atoi(strings.TrimSpace(string(b)))
+	if err != nil {
+		return 0, fmt.Errorf("store_version is not a number")
+	}
+	return version, nil
+}
+
+// fileStoreCurrent reports whether opening dir won't migrate it, a store
+// newer than this build doesn't need migrating, it fails to open
+func fileStoreCurrent(dir string) (bool, error) {
+	version, err := fileStoreVersion(dir)
+	return version >= len(fileMigrations), err
+}
+
+func (s *fileStore) migrate() error {
+	version, err := fileStoreVersion(s.dir)
+	if err != nil {
+		return err
+	}
+
+	if version > len(fileMigrations) {
+		return fmt.Errorf("data directory is at version %d, this build only knows %d", version, len(fileMigrations))
+	}
+
+	for ; version < len(fileMigrations); version++ {
+		if err := fileMigrations[version](s); err != nil {
+			return err
+		}
+		if err := writeFileAtomic(s.path("store_version"), []byte(strconv.Itoa(version+1)+"\n")); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) Tokens() (tokenList, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := tokenList{}
+	for k, v := range s.tokens {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (s *fileStore) Token(token string) (tokenAttr, bool, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	attr, exists := s.tokens[token]
+	return attr, exists, nil
+}
+
+func (s *fileStore) PutToken(token string, attr tokenAttr) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.tokens[token] = attr
+	return s.saveTokens()
+}
+
+func (s *fileStore) DeleteToken(token string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.tokens[token]; !exists {
+		return false, nil
+	}
+	delete(s.tokens, token)
+	return true, s.saveTokens()
+}
+
+func (s *fileStore) saveTokens() error {
+	buf := &bytes.Buffer{}
+	if err := gob.NewEncoder(buf).Encode(s.tokens); err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path("tokens.gob"), buf.Bytes())
+}
+
+func (s *fileStore) Levels() (levelSet, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := levelSet{}
+	for k, v := range s.levels {
+		out[k] = v
+	}
+	return out, nil
+}
+
+func (s *fileStore) SetLevels(levels levelSet) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	buf := &bytes.Buffer{}
+	encoder := json.NewEncoder(buf)
+	encoder.SetEscapeHTML(false)
+	encoder.SetIndent("", "    ")
+	if err := encoder.Encode(levels); err != nil {
+		return err
+	}
+
+	if err := writeFileAtomic(s.path("levels.json"), buf.Bytes()); err != nil {
+		return err
+	}
+	s.levels = levels
+	return nil
+}
+
+func (s *fileStore) State() (serverState, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	return s.state, nil
+}
+
+func (s *fileStore) SetState(state serverState) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	b, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(s.path("state.json"), b); err != nil {
+		return err
+	}
+	s.state = state
+	return nil
+}
+
+func (s *fileStore) AppendHistory(entry historyEntry) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entry.ID = s.historyID + 1
+	entry.Reactions = nil
+	offset, err := s.appendLogLocked("history.jsonl", entry)
+	if err != nil {
+		return 0, err
+	}
+	s.lastAppend = &historyUndo{offset: offset, marks: len(s.historyIndex), newest: s.historyNewest, lastChange: s.lastChange}
+	s.historyID = entry.ID
+	s.indexHistoryLocked(entry, offset)
+	return entry.ID, nil
+}
+
+func (s *fileStore) DeleteLastHistory(id int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	undo := s.lastAppend
+	if undo == nil || id != s.historyID {
+		return fmt.Errorf("history entry %d is not the last one appended", id)
+	}
+
+	f, err := os.OpenFile(s.path("history.jsonl"), os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	if err := f.Truncate(undo.offset); err != nil {
+		return err
+	}
+	if err := f.Sync(); err != nil {
+		return err
+	}
+
+	// Readers may still hold the old index, so it's copied rather than
+	// cut down and appended over
+	s.historyIndex = append([]historyMark(nil), s.historyIndex[:undo.marks]...)
+	s.historyNewest = undo.newest
+	s.lastChange = undo.lastChange
+	s.historyID--
+	s.lastAppend = nil
+	return f.Close()
+}
+
+// indexHistoryLocked records the entry at line s.historyID, which starts at
+// offset
+func (s *fileStore) indexHistoryLocked(entry historyEntry, offset int64) {
+	mark := historyMark{time: s.historyNewest, offset: offset, line: s.historyID}
+	if (mark.line-1)%historyIndexStride == 0 {
+		s.historyIndex = append(s.historyIndex, mark)
+	}
+	if entry.Time.After(s.historyNewest) {
+		s.historyNewest = entry.Time
+	}
+	if entry.Kind == "" {
+		mark.time = entry.Time
+		s.lastChange = &mark
+	}
+}
+
+// historyMarkLocked finds the index mark that everything before t is ahead
+// of, and how many marks there are
+func (s *fileStore) historyMarkLocked(t time.Time) (int, int) {
+	i := sort.Search(len(s.historyIndex), func(i int) bool {
+		return !s.historyIndex[i].time.Before(t)
+	}) - 1
+	if i < 0 {
+		i = 0
+	}
+	return i, len(s.historyIndex)
+}
+
+func (s *fileStore) History(from, to time.Time, fn func(historyEntry) error) error {
+	s.mu.RLock()
+	start := historyMark{line: 1}
+	if i, marks := s.historyMarkLocked(from); marks > 0 {
+		start = s.historyIndex[i]
+	}
+	s.mu.RUnlock()
+
+	return s.historyFrom(start, 0, func(entry historyEntry) error {
+		if !inRange(entry.Time, from, to) {
+			return nil
+		}
+		return fn(entry)
+	})
+}
+
+// historyFrom reads up to lines entries from mark, or to the end of the file
+// if lines is 0
+func (s *fileStore) historyFrom(mark historyMark, lines int64, fn func(historyEntry) error) error {
+	line := mark.line - 1
+	err := s.readLogAt("history.jsonl", mark.offset, func(d *json.Decoder) error {
+		if lines > 0 && line-mark.line+1 == lines {
+			return errLogEnd
+		}
+		line++
+		entry := historyEntry{}
+		if err := d.Decode(&entry); err != nil {
+			return err
+		}
+
+		// Entries from before IDs were recorded are numbered by line
+		if entry.ID == 0 {
+			entry.ID = line
+		}
+		s.mu.RLock()
+		entry.Reactions = s.reactions[entry.ID]
+		s.mu.RUnlock()
+		return fn(entry)
+	})
+	if err == errLogEnd {
+		return nil
+	}
+	return err
+}
+
+func (s *fileStore) LastLevelChange(before time.Time) (historyEntry, bool, error) {
+	s.mu.RLock()
+	lastChange := s.lastChange
+	i, marks := s.historyMarkLocked(before)
+	index := s.historyIndex[:marks]
+	s.mu.RUnlock()
+
+	last, found := historyEntry{}, false
+	keep := func(entry historyEntry) error {
+		if entry.Kind == "" && entry.Time.Before(before) {
+			last, found = entry, true
+		}
+		return nil
+	}
+
+	// Usually it's the latest change, which is read straight from where it is
+	if lastChange == nil {
+		return last, false, nil
+	}
+	if lastChange.time.Before(before) {
+		err := s.historyFrom(*lastChange, 1, keep)
+		return last, found && err == nil, err
+	}
+
+	// Otherwise it's from index[i] on, or failing that the last change in
+	// an earlier stretch, since everything before index[i] is before before
+	if err := s.historyFrom(index[i], 0, keep); err != nil {
+		return last, false, err
+	}
+	for ; !found && i > 0; i-- {
+		if err := s.historyFrom(index[i-1], historyIndexStride, keep); err != nil {
+			return last, false, err
+		}
+	}
+	return last, found, nil
+}
+
+func (s *fileStore) SetHistoryReactions(id int64, reactions map[string]int) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, existing := s.reactions[id]
+	copied := map[string]int{}
+	for k, v := range reactions {
+		copied[k] = v
+	}
+	if err := s.writeReactions(id, copied); err != nil {
+		return err
+	}
+	s.reactions[id] = copied
+
+	if existing {
+		return nil
+	}
+	for old := range s.reactions {
+		if old > id-reactionsKept {
+			continue
+		}
+		if err := os.Remove(s.path("reactions", reactionsFile(old))); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		delete(s.reactions, old)
+	}
+	return nil
+}
+
+func reactionsFile(id int64) string {
+	return strconv.FormatInt(id, 10) + ".json"
+}
+
+func (s *fileStore) writeReactions(id int64, counts map[string]int) error {
+	b, err := json.Marshal(counts)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path("reactions", reactionsFile(id)), b)
+}
+
+func (s *fileStore) AppendAudit(entry auditEntry) error {
+	return s.appendLog("audit.jsonl", entry)
+}
+
+func (s *fileStore) Audit(from, to time.Time, fn func(auditEntry) error) error {
+	return s.readLog("audit.jsonl", func(d *json.Decoder) error {
+		entry := auditEntry{}
+		if err := d.Decode(&entry); err != nil {
+			return err
+		}
+		if !inRange(entry.Time, from, to) {
+			return nil
+		}
+		return fn(entry)
+	})
+}
+
+func (s *fileStore) Subscriptions() ([]subscription, error) {
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	out := []subscription{}
+	for _, sub := range s.subscriptions {
+		out = append(out, sub)
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Created.Before(out[j].Created) })
+	return out, nil
+}
+
+func (s *fileStore) PutSubscription(sub subscription) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.subscriptions[sub.ID] = sub
+	return s.saveSubscriptions()
+}
+
+func (s *fileStore) DeleteSubscription(id string) (bool, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if _, exists := s.subscriptions[id]; !exists {
+		return false, nil
+	}
+	delete(s.subscriptions, id)
+	return true, s.saveSubscriptions()
+}
+
+func (s *fileStore) saveSubscriptions() error {
+	b, err := json.Marshal(s.subscriptions)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(s.path("subscriptions.json"), b)
+}
+
+func (s *fileStore) appendLog(name string, entry interface{}) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, err := s.appendLogLocked(name, entry)
+	return err
+}
+
+// appendLogLocked adds entry as a line of the log and syncs it, returning the
+// offset the line starts at
+func (s *fileStore) appendLogLocked(name string, entry interface{}) (int64, error) {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+
+	f, err := os.OpenFile(s.path(name), os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := f.Write(append(b, '\n')); err != nil {
+		f.Truncate(offset)
+		return 0, err
+	}
+	if err := f.Sync(); err != nil {
+		return 0, err
+	}
+	return offset, f.Close()
+}
+
+// scanLog calls fn with every line of a log and where it starts. A crash
+// mid-append can leave the last line torn, it's cut off rather than keeping
+// the store from opening.
+func (s *fileStore) scanLog(name string, fn func(offset int64, line []byte) error) error {
+	f, err := os.OpenFile(s.path(name), os.O_RDWR, 0644)
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	offset := int64(0)
+	for {
+		line, readErr := r.ReadBytes('\n')
+		if readErr == io.EOF && len(line) == 0 {
+			return nil
+		}
+		if readErr != nil && readErr != io.EOF {
+			return readErr
+		}
+
+		err := errors.New("no newline")
+		if readErr == nil {
+			if len(bytes.TrimSpace(line)) == 0 {
+				offset += int64(len(line))
+				continue
+			}
+			err = fn(offset, line)
+		}
+		if err != nil {
+			if _, peekErr := r.Peek(1); peekErr != io.EOF {
+				return err
+			}
+			log.Warnf("Cutting a torn last line off %s: %s", name, err.Error())
+			if err := f.Truncate(offset); err != nil {
+				return err
+			}
+			return f.Sync()
+		}
+		offset += int64(len(line))
+	}
+}
+
+// readLog streams a log file, calling next once per entry. The file isn't
+// held locked while fn runs, entries appended meanwhile may or may not show up.
+func (s *fileStore) readLog(name string, next func(*json.Decoder) error) error {
+	return s.readLogAt(name, 0, next)
+}
+
+// readLogAt is readLog starting offset bytes in
+func (s *fileStore) readLogAt(name string, offset int64, next func(*json.Decoder) error) error {
+	s.mu.RLock()
+	f, err := os.Open(s.path(name))
+	s.mu.RUnlock()
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	if _, err := f.Seek(offset, io.SeekStart); err != nil {
+		return err
+	}
+
+	decoder := json.NewDecoder(f)
+	for decoder.More() {
+		if err := next(decoder); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (s *fileStore) Close() error {
+	return nil
+}
+
+func readLevelsFile(path string) (levelSet, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	levels := levelSet{}
+	if err := json.Unmarshal(b, &levels); err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", filepath.Base(path), err.Error())
+	}
+	if err := levels.validateLocales(); err != nil {
+		return nil, fmt.Errorf("could not read %s: %s", filepath.Base(path), err.Error())
+	}
+	return levels, nil
+}
+
+// writeFileAtomic writes through a temp file in the same directory, so a
+// crash mid-write can't leave a truncated file behind
+func writeFileAtomic(path string, b []byte) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path))
+	if err != nil {
+		return err
+	}
+
+	if _, err := tmp.Write(b); err != nil {
+		tmp.Close()
+		os.Remove(tmp.Name())
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		os.Remove(tmp.Name())
+		return err
+	}
+
+	return os.Rename(tmp.Name(), path)
+}
@@ -0,0 +1,120 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build !windows
+// +build !windows
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// handoffSignals asks the server to start a copy of its (possibly upgraded)
+// binary on the same listening sockets and then shut down gracefully
+var handoffSignals = []os.Signal{syscall.SIGUSR2}
+
+// handoffTimeout is how long the new process has to say it's ready before
+// it's killed and the old one carries on
+const handoffTimeout = time.Minute
+
+// handoff starts the new process and waits for it to write a byte to the
+// pipe in JMAAS_HANDOFF_FD, which it does once its config and store check
+// out. If it exits or times out first it's an error, and the caller keeps
+// serving. Otherwise the new process waits on the data directory lock, which
+// the caller releases once it has drained and closed the store.
+func handoff() error {
+	files, fds, err := listenerFiles()
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}()
+
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+
+	ready, readyW, err := os.Pipe()
+	if err != nil {
+		return err
+	}
+	defer ready.Close()
+
+	env := []string{}
+	for _, e := range os.Environ() {
+		if !strings.HasPrefix(e, "JMAAS_LISTEN_FDS=") && !strings.HasPrefix(e, "JMAAS_HANDOFF_FD=") {
+			env = append(env, e)
+		}
+	}
+	// The pipe goes after the listeners, which start at fd 3
+	env = append(env, "JMAAS_LISTEN_FDS="+fds, "JMAAS_HANDOFF_FD="+strconv.Itoa(len(files)+3))
+
+	p, err := os.StartProcess(exe, os.Args, &os.ProcAttr{
+		Env:   env,
+		Files: append(append([]*os.File{os.Stdin, os.Stdout, os.Stderr}, files...), readyW),
+	})
+	readyW.Close()
+	if err != nil {
+		return err
+	}
+
+	ready.SetReadDeadline(time.Now().Add(handoffTimeout))
+	if _, err := ready.Read(make([]byte, 1)); err != nil {
+		if errors.Is(err, os.ErrDeadlineExceeded) {
+			p.Kill()
+			err = fmt.Errorf("pid %d was not ready within %s", p.Pid, handoffTimeout)
+		} else {
+			err = fmt.Errorf("pid %d exited before it was ready", p.Pid)
+		}
+		go p.Wait()
+		return err
+	}
+
+	log.Infof("Handed listeners off to pid %d", p.Pid)
+	return nil
+}
+
+// handoffReady tells the process that started this one, if any, that it can
+// drain and let go of the data directory
+func handoffReady() {
+	fd, err := strconv.Atoi(os.Getenv("JMAAS_HANDOFF_FD"))
+	if err != nil {
+		return
+	}
+	os.Unsetenv("JMAAS_HANDOFF_FD")
+
+	f := os.NewFile(uintptr(fd), "handoff")
+	if _, err := f.Write([]byte{1}); err != nil {
+		log.Warnf("Could not tell the previous process we're ready: %s", err.Error())
+	}
+	f.Close()
+}
@@ -0,0 +1,126 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"golang.org/x/text/language"
+	"net/http"
+	"sort"
+)
+
+// levelText is a level's title and description in one locale, either can be
+// left out to use the default
+type levelText struct {
+	Title       string `json:"title,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// localized returns the definition with its text in locale, falling back to
+// the default strings for anything the locale doesn't have
+func (d levelDefinition) localized(locale string) levelDefinition {
+	if text, exists := d.Locales[locale]; exists {
+		if text.Title != "" {
+			d.Title = text.Title
+		}
+		if text.Description != "" {
+			d.Description = text.Description
+		}
+	}
+	d.Locales = nil
+	return d
+}
+
+// localized returns every level with its text in locale
+func (l levelSet) localized(locale string) levelSet {
+	out := levelSet{}
+	for n, def := range l {
+		out[n] = def.localized(locale)
+	}
+	return out
+}
+
+// locales lists the locales the levels have text for, the default first
+func (l levelSet) locales() []string {
+	seen := map[string]bool{cfg.DefaultLocale: true}
+	out := []string{}
+	for _, def := range l {
+		for locale := range def.Locales {
+			if !seen[locale] {
+				seen[locale] = true
+				out = append(out, locale)
+			}
+		}
+	}
+	sort.Strings(out)
+	return append([]string{cfg.DefaultLocale}, out...)
+}
+
+// validateLocales checks that every locale in the levels is a language tag
+func (l levelSet) validateLocales() error {
+	for _, n := range l.sortedLevels() {
+		for locale := range l[n].Locales {
+			if _, err := language.Parse(locale); err != nil {
+				return fmt.Errorf("level %d has an invalid locale %q: %s", n, locale, err.Error())
+			}
+		}
+	}
+	return nil
+}
+
+// negotiateLocale picks the best of the levels' locales for the request,
+// from ?lang= if it's given or Accept-Language otherwise
+func negotiateLocale(r *http.Request, levels levelSet) string {
+	available := levels.locales()
+	if len(available) == 1 {
+		return available[0]
+	}
+
+	tags := []language.Tag{}
+	for _, locale := range available {
+		tags = append(tags, language.Make(locale))
+	}
+	matcher := language.NewMatcher(tags)
+
+	var wanted []language.Tag
+	if lang := r.URL.Query().Get("lang"); lang != "" {
+		if tag, err := language.Parse(lang); err == nil {
+			wanted = []language.Tag{tag}
+		}
+	} else if accept := r.Header.Get("Accept-Language"); accept != "" {
+		wanted, _, _ = language.ParseAcceptLanguage(accept)
+	}
+	if len(wanted) == 0 {
+		return cfg.DefaultLocale
+	}
+
+	_, index, confidence := matcher.Match(wanted...)
+	if confidence == language.No {
+		return cfg.DefaultLocale
+	}
+	return available[index]
+}
+
+// setLocaleHeaders marks a response as varying by language
+func setLocaleHeaders(w http.ResponseWriter, locale string) {
+	w.Header().Add("Vary", "Accept-Language")
+	w.Header().Set("Content-Language", locale)
+}
@@ -0,0 +1,201 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"github.com/go-playground/log"
+	"html/template"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+const (
+	sparklineWidth  = 600
+	sparklineHeight = 80
+	sparklinePad    = 6
+	maxKioskHours   = 7 * 24
+)
+
+// kioskThemes are the looks /kiosk?theme= accepts, "level" fills the screen
+// with the current level's background
+var kioskThemes = map[string]bool{
+	"level": true,
+	"dark":  true,
+	"light": true,
+}
+
+// kioskData is what client/kiosk.html is rendered with
+type kioskData struct {
+	levelSnapshot
+	SiteName string
+	// Name identifies the display to admins in /api/sockets
+	Name string
+	// Cycle is how many seconds each footer panel shows, 0 keeps the first
+	Cycle  int
+	Scale  float64
+	Rotate int
+	Theme  string
+	Hours  int
+
+	Sparkline template.HTML
+}
+
+// DescriptionHTML is the current level's description, levels.json is
+// trusted to hold HTML
+func (s levelSnapshot) DescriptionHTML() template.HTML {
+	return template.HTML(s.Definition.Description)
+}
+
+// intParam reads a query parameter, falling back to def when it's missing or
+// out of range
+func intParam(r *http.Request, name string, def, min, max int) int {
+	n, err := strconv.Atoi(r.URL.Query().Get(name))
+	if err != nil || n < min || n > max {
+		return def
+	}
+	return n
+}
+
+// kioskHandler serves the full screen display for TVs. It takes cycle
+// (seconds per footer panel), scale, rotate (0, 90, 180, or 270), theme,
+// hours of history for the sparkline, and a name for the display.
+func kioskHandler(w http.ResponseWriter, r *http.Request) {
+	snap, err := currentSnapshot(r)
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+	}
+	setLocaleHeaders(w, snap.Locale)
+
+	query := r.URL.Query()
+	data := kioskData{
+		levelSnapshot: snap,
+		SiteName:      siteName,
+		Name:          truncate(cleanLine(query.Get("name")), maxSocketName),
+		Cycle:         intParam(r, "cycle", 10, 0, 3600),
+		Scale:         1,
+		Rotate:        intParam(r, "rotate", 0, 0, 270) / 90 * 90,
+		Theme:         query.Get("theme"),
+		Hours:         intParam(r, "hours", 24, 1, maxKioskHours),
+	}
+	if scale, err := strconv.ParseFloat(query.Get("scale"), 64); err == nil && scale >= 0.25 && scale <= 4 {
+		data.Scale = scale
+	}
+	if !kioskThemes[data.Theme] {
+		data.Theme = "level"
+	}
+
+	sparkline, err := renderSparkline(time.Now(), data.Hours, snap)
+	if err != nil {
+		log.Errorf("Could not render sparkline: %s", err.Error())
+	}
+	data.Sparkline = template.HTML(sparkline)
+
+	servePage(w, r, "kiosk.html", data, "/static/kiosk.css")
+}
+
+func sparklineHandler(w http.ResponseWriter, r *http.Request) {
+	snap, err := currentSnapshot(r)
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+		http.Error(w, "could not load levels", http.StatusInternalServerError)
+		return
+	}
+
+	svg, err := renderSparkline(time.Now(), intParam(r, "hours", 24, 1, maxKioskHours), snap)
+	if err != nil {
+		log.Errorf("Could not render sparkline: %s", err.Error())
+		http.Error(w, "could not render sparkline", http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "image/svg+xml")
+	w.Header().Set("Cache-Control", "no-store")
+	w.Write(svg)
+}
+
+// renderSparkline draws the level over the last hours as a step line, each
+// step in its level's color
+func renderSparkline(now time.Time, hours int, snap levelSnapshot) ([]byte, error) {
+	from := now.Add(-time.Duration(hours) * time.Hour)
+
+	type step struct {
+		at    time.Time
+		level int
+	}
+	steps := []step{}
+	err := store.History(from, now, func(entry historyEntry) error {
+		if entry.Kind != "" {
+			return nil
+		}
+		if len(steps) == 0 {
+			steps = append(steps, step{from, entry.Previous})
+		}
+		steps = append(steps, step{entry.Time, entry.Level})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(steps) == 0 {
+		steps = append(steps, step{from, snap.Level})
+	}
+
+	top := 1
+	if sorted := snap.Levels.sortedLevels(); len(sorted) > 0 && sorted[len(sorted)-1] > 0 {
+		top = sorted[len(sorted)-1]
+	}
+	x := func(t time.Time) float64 {
+		return float64(t.Sub(from)) / float64(now.Sub(from)) * sparklineWidth
+	}
+	y := func(lvl int) float64 {
+		return sparklineHeight - sparklinePad - float64(lvl)/float64(top)*(sparklineHeight-2*sparklinePad)
+	}
+	color := func(lvl int) string {
+		if bg := snap.Levels[lvl].Background; bg != "" {
+			if _, _, _, ok := parseHexColor(bg); ok {
+				return bg
+			}
+		}
+		return badgeFallbackColor
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, `<svg xmlns="http://www.w3.org/2000/svg" viewBox="0 0 %d %d" preserveAspectRatio="none" class="sparkline" role="img" aria-label="level over the last %d hours">`, sparklineWidth, sparklineHeight, hours)
+	for i, s := range steps {
+		end := now
+		if i+1 < len(steps) {
+			end = steps[i+1].at
+		}
+		fmt.Fprintf(&buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="%s" stroke-width="4" stroke-linecap="round"/>`,
+			x(s.at), y(s.level), x(end), y(s.level), color(s.level))
+		if i+1 < len(steps) {
+			fmt.Fprintf(&buf, `<line x1="%.1f" y1="%.1f" x2="%.1f" y2="%.1f" stroke="#888888" stroke-width="1"/>`,
+				x(end), y(s.level), x(end), y(steps[i+1].level))
+		}
+	}
+	last := steps[len(steps)-1].level
+	fmt.Fprintf(&buf, `<circle cx="%.1f" cy="%.1f" r="5" fill="%s"/>`, x(now)-5, y(last), color(last))
+	buf.WriteString(`</svg>`)
+	return buf.Bytes(), nil
+}
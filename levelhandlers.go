@@ -21,9 +21,17 @@
 package main
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"github.com/go-playground/log"
 	"net/http"
 	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 type socketMessage struct {
@@ -31,113 +39,328 @@ type socketMessage struct {
 	Data interface{}
 }
 
-func setLevelHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Token")
-	if token == "" {
+// maxReasonLength is how many characters a reason can have, enough for a
+// short sentence on the board
+const maxReasonLength = 140
+
+var errReasonWithoutChange = errors.New("the board is already at that level, a reason needs a change to go with")
+
+var (
+	levelMu = sync.RWMutex{}
+	// levelReason is the reason given for the current level, and
+	// levelVersion and levelEventKey are the state's place in a cluster,
+	// all guarded by levelMu like level
+	levelReason   string
+	levelVersion  int64
+	levelEventKey string
+)
+
+func getCurrentLevel() int {
+	levelMu.RLock()
+	defer levelMu.RUnlock()
+	return level
+}
+
+// levelUpdate is the levelupdate message, which carries the level's text in
+// each socket's own locale
+type levelUpdate struct {
+	level  int
+	event  int64
+	reason string
+	def    levelDefinition
+}
+
+func levelUpdateMessage(lvl int, event int64, reason string) *levelUpdate {
+	levels, err := store.Levels()
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+	}
+	return &levelUpdate{level: lvl, event: event, reason: reason, def: levels[lvl]}
+}
+
+func (u *levelUpdate) localize(locale string) *socketMessage {
+	def := u.def.localized(locale)
+	return &socketMessage{Type: "levelupdate", Data: map[string]interface{}{
+		"level":       u.level,
+		"event":       u.event,
+		"reason":      u.reason,
+		"title":       def.Title,
+		"description": def.Description,
+		"background":  def.Background,
+	}}
+}
+
+// cleanLine collapses whitespace and drops control characters and invalid
+// UTF-8, so text from clients is always a single printable line
+func cleanLine(s string) string {
+	s = strings.ToValidUTF8(s, "")
+	s = strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) || unicode.Is(unicode.Cf, r) {
+			return ' '
+		}
+		return r
+	}, s)
+	return strings.Join(strings.Fields(s), " ")
+}
+
+// sanitizeReason cleans up a reason, which has to fit on the board
+func sanitizeReason(reason string) (string, error) {
+	reason = cleanLine(reason)
+	if utf8.RuneCountInString(reason) > maxReasonLength {
+		return "", fmt.Errorf("Reason must be at most %d characters", maxReasonLength)
+	}
+	return reason, nil
+}
+
+// requestReason reads the optional Reason header, or the reason query
+// parameter for browsers that can't send UTF-8 in headers
+func requestReason(w http.ResponseWriter, r *http.Request) (string, bool) {
+	reason := r.Header.Get("Reason")
+	if reason == "" {
+		reason = r.URL.Query().Get("reason")
+	}
+
+	reason, err := sanitizeReason(reason)
+	if err != nil {
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("no token provided"))
-		w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return "", false
+	}
+	return reason, true
+}
+
+// updateLevel moves the board to whatever fn returns for the current level,
+// clamped to the defined levels, as actor holding the token with tokenID
+// actorID. Raising it to or past a level with an approval policy only
+// requests the change, which is returned, otherwise it's made straight away.
+func updateLevel(actor, actorID, reason string, fn func(current int) int) (int, *pendingChange, error) {
+	levelMu.Lock()
+	defer levelMu.Unlock()
+
+	newlvl := fn(level)
+	numlvls := getNumLevels()
+	if newlvl > numlvls-1 {
+		newlvl = numlvls - 1
+	}
+	if newlvl < 0 {
+		newlvl = 0
+	}
+
+	if newlvl > level {
+		if policy := approvalBetween(level, newlvl); policy != nil {
+			p, err := requestChangeLocked(actor, actorID, reason, newlvl, policy)
+			return level, p, err
+		}
+	}
+
+	// Reasons are kept in the history with the change they explain, one
+	// sent without a change would be lost
+	if newlvl == level && reason != "" {
+		return level, nil, errReasonWithoutChange
+	}
+
+	err := setLevelLocked(newlvl, actor, "", reason)
+	return level, nil, err
+}
+
+// setLevelLocked makes a change, recording it and its reason in the history
+// and persisting it before publishing it. A change starts a new event for
+// viewers to react to. levelMu must be held.
+func setLevelLocked(newlvl int, actor, approvedBy, reason string) error {
+	now := time.Now()
+	previous := level
+	if newlvl != level {
+		entry := historyEntry{Time: now, Level: newlvl, Previous: level, Actor: actor, ApprovedBy: approvedBy, Reason: reason}
+		id, err := store.AppendHistory(entry)
+		if err != nil {
+			return err
+		}
+
+		version := nextVersionLocked()
+		key := eventKey(id)
+		if err := store.SetState(serverState{Level: newlvl, HistoryID: id, Reason: reason, Pending: pendingLevel, Version: version, EventKey: key}); err != nil {
+			// The change didn't happen, so neither should its history
+			if err := store.DeleteLastHistory(id); err != nil {
+				log.Errorf("Could not take back history entry %d: %s", id, err.Error())
+			}
+			return err
+		}
+
+		if reason != "" {
+			log.Infof("%s updated level from %d to %d: %s", actor, level, newlvl, reason)
+		} else {
+			log.Infof("%s updated level from %d to %d", actor, level, newlvl)
+		}
+		level = newlvl
+		levelReason = reason
+		levelVersion = version
+		levelEventKey = key
+		resetReactions(id, key, nil)
+	}
+
+	events.publish(levelChanged{Time: now, Level: level, Previous: previous, Event: currentEvent(), Actor: actor, ApprovedBy: approvedBy, Reason: levelReason})
+	return nil
+}
+
+// saveStateLocked persists the current state after the pending change is
+// updated, as a new version. levelMu must be held.
+func saveStateLocked() error {
+	levelVersion = nextVersionLocked()
+	return store.SetState(currentStateLocked())
+}
+
+func currentStateLocked() serverState {
+	return serverState{Level: level, HistoryID: currentEvent(), Reason: levelReason, Pending: pendingLevel, Version: levelVersion, EventKey: levelEventKey}
+}
+
+// nextVersionLocked is the version for a change made now, always after the
+// current one even if the clock went backwards, or the version came from a
+// node whose clock is ahead. levelMu must be held.
+func nextVersionLocked() int64 {
+	version := time.Now().UnixNano()
+	if version <= levelVersion {
+		version = levelVersion + 1
+	}
+	return version
+}
+
+// allowLevelChange holds each token to limits.level_changes_per_minute, so
+// one token can't thrash the board
+func allowLevelChange(w http.ResponseWriter, token string) bool {
+	if ok, retry := levelChangeLimiter.allow(token); !ok {
+		writeTooManyRequests(w, retry, "too many level changes for this token")
+		return false
+	}
+	return true
+}
+
+// writeLevelUpdated responds to a level change, a change that is waiting on
+// approval is sent back as JSON with 202 Accepted
+func writeLevelUpdated(w http.ResponseWriter, pending *pendingChange, err error) {
+	if err == errChangePending {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusConflict)
+		w.Write([]byte(err.Error()))
 		return
 	}
-	attr, authed := isTokenAuthed(token)
-	if !authed {
+	if err == errReasonWithoutChange {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+	if err != nil {
+		log.Errorf("Could not update level: %s", err.Error())
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("token is not authed"))
-		w.WriteHeader(http.StatusUnauthorized)
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not save level"))
 		return
 	}
 
-	log.Infof("Got authed token %s with note '%s'", token, attr.Note)
+	if pending != nil {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusAccepted)
+		j, _ := json.Marshal(pending.public())
+		w.Write(j)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("Level set successfully"))
+}
+
+func setLevelHandler(w http.ResponseWriter, r *http.Request) {
+	token, attr, ok := authRequest(w, r)
+	if !ok {
+		return
+	}
+
+	log.Infof("Got authed token %s with note '%s'", redactToken(token), attr.Note)
 	lvlstr := r.Header.Get("New-Level")
 	if lvlstr == "" {
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("you must provide a New-Level header"))
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("you must provide a New-Level header"))
 		return
 	}
 
 	newlvl, err := strconv.Atoi(lvlstr)
 	if err != nil {
 		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("error processing New-Level: " + err.Error()))
 		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("error processing New-Level: " + err.Error()))
 		return
 	}
 
-	numlvls := getNumLevels()
-	if newlvl > numlvls-1 {
-		newlvl = newlvl - 1
+	reason, ok := requestReason(w, r)
+	if !ok {
+		return
 	}
 
-	level = newlvl
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("Level set successfully"))
-
-	go webSocketPool.broadcastMessage(&socketMessage{Type: "levelupdate", Data: map[string]interface{}{"level": level}})
-	return
+	if !allowLevelChange(w, token) {
+		return
+	}
 
+	_, pending, err := updateLevel(attr.Note, tokenID(token), reason, func(int) int { return newlvl })
+	writeLevelUpdated(w, pending, err)
 }
 
 func increaseLevelHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Token")
-	if token == "" {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("no token provided"))
-		w.WriteHeader(http.StatusUnauthorized)
+	token, attr, ok := authRequest(w, r)
+	if !ok {
 		return
 	}
-	_, authed := isTokenAuthed(token)
-	if !authed {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("token is not authed"))
-		w.WriteHeader(http.StatusUnauthorized)
+
+	reason, ok := requestReason(w, r)
+	if !ok {
 		return
 	}
 
-	level++
-	numlvls := getNumLevels()
-	if level > numlvls-1 {
-		level = numlvls - 1
+	if !allowLevelChange(w, token) {
+		return
 	}
 
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("Level set successfully"))
-	go webSocketPool.broadcastMessage(&socketMessage{Type: "levelupdate", Data: map[string]interface{}{"level": level}})
-	return
-
+	_, pending, err := updateLevel(attr.Note, tokenID(token), reason, func(current int) int { return current + 1 })
+	writeLevelUpdated(w, pending, err)
 }
 
 func decreaseLevelHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Token")
-	if token == "" {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("no token provided"))
-		w.WriteHeader(http.StatusUnauthorized)
+	token, attr, ok := authRequest(w, r)
+	if !ok {
 		return
 	}
-	attr, authed := isTokenAuthed(token)
-	if !authed {
-		w.Header().Set("Content-Type", "text/plain")
-		w.Write([]byte("token is not authed"))
-		w.WriteHeader(http.StatusUnauthorized)
+
+	reason, ok := requestReason(w, r)
+	if !ok {
 		return
 	}
 
-	level--
-	if level < 0 {
-		level = 0
+	if !allowLevelChange(w, token) {
+		return
 	}
-	log.Infof("%s setting updating level to %d", attr.Note, level)
-
-	w.Header().Set("Content-Type", "text/plain")
-	w.Write([]byte("Level set successfully"))
-	go webSocketPool.broadcastMessage(&socketMessage{Type: "levelupdate", Data: map[string]interface{}{"level": level}})
-	return
 
+	_, pending, err := updateLevel(attr.Note, tokenID(token), reason, func(current int) int { return current - 1 })
+	writeLevelUpdated(w, pending, err)
 }
 
 func levelHandler(w http.ResponseWriter, r *http.Request) {
+	levels, err := store.Levels()
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+		http.Error(w, "could not load levels", http.StatusInternalServerError)
+		return
+	}
+
+	locale := negotiateLocale(r, levels)
+	setLocaleHeaders(w, locale)
+	w.Header().Set("Content-Type", "application/json")
+	encoder := json.NewEncoder(w)
+	encoder.SetEscapeHTML(false)
+	encoder.Encode(levels.localized(locale))
+}
+
+func currentLevelHandler(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
-	serveFile(w, r, "levels.json")
+	w.Write([]byte(fmt.Sprintf("%d", getCurrentLevel())))
 }
@@ -0,0 +1,61 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestSetLevelReason(t *testing.T) {
+	setupTestServer(t)
+
+	setLevel := func(lvl, reason string) int {
+		r := httptest.NewRequest("POST", "/api/setlevel", nil)
+		r.Header.Set("Token", testOperatorToken)
+		r.Header.Set("New-Level", lvl)
+		r.Header.Set("Reason", reason)
+		w := httptest.NewRecorder()
+		setLevelHandler(w, r)
+		return w.Code
+	}
+
+	if code := setLevel("1", "Coffee machine is broken"); code != http.StatusOK {
+		t.Fatalf("setting level 1 returned %d", code)
+	}
+	if code := setLevel("1", "Still broken"); code != http.StatusBadRequest {
+		t.Errorf("a reason without a change returned %d, want 400", code)
+	}
+	if code := setLevel("1", ""); code != http.StatusOK {
+		t.Errorf("setting the same level without a reason returned %d", code)
+	}
+
+	reasons := []string{}
+	store.History(time.Time{}, time.Time{}, func(e historyEntry) error {
+		reasons = append(reasons, e.Reason)
+		return nil
+	})
+	if len(reasons) != 1 || reasons[0] != "Coffee machine is broken" || levelReason != reasons[0] {
+		t.Errorf("history has reasons %q, the board %q", reasons, levelReason)
+	}
+}
@@ -23,7 +23,6 @@ package main
 import (
 	"crypto/tls"
 	"encoding/gob"
-	"encoding/json"
 	"flag"
 	"fmt"
 	"github.com/go-playground/log"
@@ -40,12 +39,14 @@ import (
 const version = "1.1.0"
 
 var (
-	devMode = flag.Bool("dev", false, "Puts the server in developer mode, will bind to :34265 and will not autocert")
-	domains = flag.String("domain", "angrymills.net,happymills.net,sexymills.com", "A comma-seperaated list of domains to get a certificate for.")
-	listen  = flag.String("listen", ":https", "The address to listen on")
-	client  = &http.Client{}
-	level   = 0
-	m       autocert.Manager
+	devMode     = flag.Bool("dev", false, "Puts the server in developer mode, will bind to listen.dev (:34265) and will not autocert")
+	domains     = flag.String("domain", "", "A comma-seperated list of domains to get a certificate for, overrides tls.domains")
+	listen      = flag.String("listen", ":https", "The address to listen on, overrides listen.address")
+	configPath  = flag.String("config", "", "Path to a TOML config file, defaults to $JMAAS_CONFIG")
+	printConfig = flag.Bool("print-config", false, "Print the effective config and exit")
+	client      = &http.Client{}
+	level       = 0
+	m           autocert.Manager
 )
 
 func init() {
@@ -54,67 +55,209 @@ func init() {
 }
 
 func getNumLevels() int {
-	lvls := map[int]map[string]interface{}{}
-	f, err := os.Open("levels.json")
+	levels, err := store.Levels()
 	if err != nil {
-		panic(err)
+		log.Errorf("Could not load levels: %s", err.Error())
 	}
-	defer f.Close()
-
-	decoder := json.NewDecoder(f)
-	decoder.Decode(&lvls)
-	return len(lvls)
+	return len(levels)
 }
 
 func main() {
 	flag.Parse()
+	if err := loadConfig(); err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	if *printConfig {
+		cfg.write(os.Stdout)
+		return
+	}
+
+	switch flag.Arg(0) {
+	case "":
+	case "tokens":
+		if err := tokensCommand(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "tokens: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	case "levels":
+		if err := levelsCommand(flag.Args()[1:]); err != nil {
+			fmt.Fprintf(os.Stderr, "levels: %s\n", err.Error())
+			os.Exit(1)
+		}
+		return
+	default:
+		fmt.Fprintf(os.Stderr, "unknown command %q\n", flag.Arg(0))
+		os.Exit(2)
+	}
+
+	if err := cfg.validate(); err != nil {
+		fmt.Fprintf(os.Stderr, "config: %s\n", err.Error())
+		os.Exit(1)
+	}
+
+	setupNodeID()
+
 	cLog := console.New(true)
 	cLog.SetTimestampFormat(time.RFC3339)
-	log.AddHandler(cLog, log.AllLevels...)
+	levels, _ := logLevels(cfg.LogLevel)
+	log.AddHandler(cLog, levels...)
 
 	log.Info("Starting The Josh Mills Anger Advisory System")
 
 	mux := http.NewServeMux()
 	mux.HandleFunc("/", indexHandler)
 	mux.HandleFunc("/api/levels", levelHandler)
-	mux.HandleFunc("/api/setlevel", setLevelHandler)
-	mux.HandleFunc("/api/inclevel", increaseLevelHandler)
-	mux.HandleFunc("/api/declevel", decreaseLevelHandler)
-	mux.HandleFunc("/api/currentlevel", func(w http.ResponseWriter, r *http.Request) {
-		w.Header().Set("Content-Type", "application/json")
-		w.Write([]byte(fmt.Sprintf("%d", level)))
-	})
-
-	mux.HandleFunc("/api/tokens/list", listTokenHandler)
+	mux.HandleFunc("/api/levels/export", exportLevelsHandler)
+	mux.HandleFunc("/api/levels/import", limitMutations(importLevelsHandler))
+	mux.HandleFunc("/api/levels/templates", templatesHandler)
+	mux.HandleFunc("/api/setlevel", limitMutations(setLevelHandler))
+	mux.HandleFunc("/api/inclevel", limitMutations(increaseLevelHandler))
+	mux.HandleFunc("/api/declevel", limitMutations(decreaseLevelHandler))
+	mux.HandleFunc("/api/currentlevel", currentLevelHandler)
+	mux.HandleFunc("/api/history.ics", historyCalendarHandler)
+	mux.HandleFunc("/api/history/export", historyExportHandler)
+	if cfg.EnableBadges {
+		mux.HandleFunc("/badge.svg", badgeSVGHandler)
+		mux.HandleFunc("/status.png", statusPNGHandler)
+	}
+	mux.HandleFunc("/oembed", oembedHandler)
+	if cfg.EnableKiosk {
+		mux.HandleFunc("/kiosk", kioskHandler)
+		mux.HandleFunc("/kiosk/sparkline.svg", sparklineHandler)
+	}
+	mux.HandleFunc("/api/pending", pendingHandler)
+	mux.HandleFunc("/api/pending/confirm", limitMutations(confirmPendingHandler))
+	mux.HandleFunc("/api/pending/reject", limitMutations(rejectPendingHandler))
+
+	if cfg.EnableTokenList {
+		mux.HandleFunc("/api/tokens/list", listTokenHandler)
+	}
+	mux.HandleFunc("/api/tokens/create", limitMutations(createTokenHandler))
+	mux.HandleFunc("/api/tokens/revoke", limitMutations(revokeTokenHandler))
+	mux.HandleFunc("/api/sockets", listSocketsHandler)
+	mux.HandleFunc("/api/sockets/kick", limitMutations(kickSocketHandler))
 	mux.HandleFunc("/socket", webSocketHandler)
+	if cfg.ClusterBackplane == "http" {
+		mux.HandleFunc("/api/cluster", clusterHandler)
+	}
+	if cfg.EnableNotify {
+		mux.HandleFunc("/api/subscriptions", limitMutations(subscriptionsHandler))
+		mux.HandleFunc("/api/subscriptions/vapid", vapidHandler)
+		mux.HandleFunc("/api/subscriptions/confirm", limitMutations(confirmSubscriptionHandler))
+		mux.HandleFunc("/api/subscriptions/unsubscribe", limitMutations(unsubscribeHandler))
+	}
+
+	// A process we were handed off from holds the lock until it has drained
+	// and closed the store, so make sure ours will open before telling it to
+	// go and then wait for it, connections queue on the listeners meanwhile
+	if os.Getenv("JMAAS_LISTEN_FDS") != "" {
+		if err := probeStore(); err != nil {
+			log.Fatalf("Could not open %s store: %s", cfg.StorageBackend, err.Error())
+		}
+		handoffReady()
+		if err := lockDataDir(true); err != nil {
+			log.Fatalf("Could not lock data directory %s: %s", cfg.DataDir, err.Error())
+		}
+	} else if err := lockDataDir(false); err != nil {
+		log.Fatalf("Could not lock data directory %s: %s", cfg.DataDir, err.Error())
+	}
+
+	var err error
+	store, err = openStore()
+	if err != nil {
+		log.Fatalf("Could not open %s store: %s", cfg.StorageBackend, err.Error())
+	}
+
+	events.subscribe("sockets", webSocketPool.handleEvent)
+	events.subscribe("audit", auditEvents)
 
 	printTokens()
 
-	if *devMode {
-		srv := &http.Server{
-			Addr:    ":34265",
-			Handler: mux,
+	if getNumLevels() == 0 && cfg.LevelTemplate != "" {
+		levels, _ := levelTemplate(cfg.LevelTemplate)
+		if err := store.SetLevels(levels); err != nil {
+			log.Fatalf("Could not save levels: %s", err.Error())
 		}
+		log.Infof("Started a new board with the %s template", cfg.LevelTemplate)
+	}
+	if getNumLevels() == 0 {
+		log.Warn("No levels are defined, the board will be empty, set levels.template to start from a template")
+	}
 
-		log.Info("Listening on :34265")
-		srv.ListenAndServe()
+	state, err := store.State()
+	if err != nil {
+		log.Errorf("Could not load state, starting at level 0: %s", err.Error())
+	}
+	level = state.Level
+	levelReason = state.Reason
+	restorePending(state.Pending)
+	levelVersion = state.Version
+	levelEventKey = state.EventKey
+	if err := loadReactions(state.HistoryID, state.EventKey); err != nil {
+		log.Errorf("Could not load reactions: %s", err.Error())
 	}
+	startMQTT()
+	startCluster()
+	if err := startNotifications(); err != nil {
+		log.Fatalf("Could not start notifications: %s", err.Error())
+	}
+
+	trustedProxies, _ = parseTrustedProxies(cfg.TrustedProxies)
+	setupRateLimits()
+	handler := proxyHandler(mux)
+
+	if cfg.TLSMode == "none" {
+		srv := &http.Server{
+			Addr:    cfg.Listen,
+			Handler: handler,
+
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+		}
 
-	domainList := strings.Split(*domains, ",")
-	for i, d := range domainList {
-		domainList[i] = strings.TrimSpace(d)
+		l, err := listenOn(cfg.Listen)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		log.Infof("Listening on %s", cfg.Listen)
+		go serve(srv, l, false)
+		waitForShutdown(srv)
+		return
 	}
 
-	m = autocert.Manager{
-		Cache:      autocert.DirCache("certs"),
-		Prompt:     autocert.AcceptTOS,
-		HostPolicy: autocert.HostWhitelist(domainList...),
+	var (
+		getCertificate func(*tls.ClientHelloInfo) (*tls.Certificate, error)
+		redirect       http.Handler
+	)
+
+	switch cfg.TLSMode {
+	case "autocert":
+		m = autocert.Manager{
+			Cache:      autocert.DirCache(dataPath(cfg.CertCache)),
+			Prompt:     autocert.AcceptTOS,
+			HostPolicy: autocert.HostWhitelist(cfg.Domains...),
+		}
+		getCertificate = m.GetCertificate
+		redirect = m.HTTPHandler(nil)
+	case "files":
+		reloader, err := newCertReloader(dataPath(cfg.CertFile), dataPath(cfg.KeyFile))
+		if err != nil {
+			log.Fatalf("Could not load certificate: %s", err.Error())
+		}
+		go reloader.watch(cfg.ReloadInterval)
+		getCertificate = reloader.GetCertificate
+		redirect = http.HandlerFunc(httpRedirectHandler)
 	}
 
 	tlsConf := &tls.Config{
 		MinVersion:               tls.VersionTLS12,
 		PreferServerCipherSuites: true,
-		GetCertificate:           m.GetCertificate,
+		GetCertificate:           getCertificate,
 
 		CurvePreferences: []tls.CurveID{
 			tls.CurveP256,
@@ -132,20 +275,48 @@ func main() {
 	}
 
 	rootSrv := &http.Server{
-		Addr:      *listen,
-		Handler:   mux,
+		Addr:      cfg.Listen,
+		Handler:   handler,
 		TLSConfig: tlsConf,
 
-		ReadTimeout:  5 * time.Second,
-		WriteTimeout: 10 * time.Second,
-		IdleTimeout:  120 * time.Second,
+		ReadTimeout:  cfg.ReadTimeout,
+		WriteTimeout: cfg.WriteTimeout,
+		IdleTimeout:  cfg.IdleTimeout,
+	}
+	if cfg.EnableHTTP2 {
+		http2.ConfigureServer(rootSrv, &http2.Server{})
+	} else {
+		rootSrv.TLSNextProto = map[string]func(*http.Server, *tls.Conn, http.Handler){}
 	}
-	go http.ListenAndServe(":http", m.HTTPHandler(nil))
 
-	log.Infof("Listening on %s", *listen)
+	servers := []*http.Server{rootSrv}
 
-	http2.ConfigureServer(rootSrv, &http2.Server{})
-	log.Fatal(rootSrv.ListenAndServeTLS("", ""))
+	l, err := listenOn(cfg.Listen)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if cfg.RedirectListen != "" {
+		redirectSrv := &http.Server{
+			Addr:    cfg.RedirectListen,
+			Handler: redirect,
+
+			ReadTimeout:  cfg.ReadTimeout,
+			WriteTimeout: cfg.WriteTimeout,
+			IdleTimeout:  cfg.IdleTimeout,
+		}
+
+		rl, err := listenOn(cfg.RedirectListen)
+		if err != nil {
+			log.Fatal(err)
+		}
+		go serve(redirectSrv, rl, false)
+		servers = append(servers, redirectSrv)
+	}
+
+	log.Infof("Listening on %s", cfg.Listen)
+	go serve(rootSrv, l, true)
+	waitForShutdown(servers...)
 }
 
 func httpRedirectHandler(w http.ResponseWriter, r *http.Request) {
@@ -153,10 +324,23 @@ func httpRedirectHandler(w http.ResponseWriter, r *http.Request) {
 }
 
 func indexHandler(w http.ResponseWriter, r *http.Request) {
-	path := r.URL.Path
-	if _, err := os.Stat("./client" + path); err == nil {
-		serveFile(w, r, "./client"+path)
-	} else {
-		serveFile(w, r, "./client/index.html")
+	path, err := resolveAsset(r.URL.Path)
+	// The kiosk template is only ever served rendered, at /kiosk
+	if path == assetRoot+"/kiosk.html" {
+		http.NotFound(w, r)
+		return
+	}
+	if err == nil && path != assetRoot+"/index.html" {
+		serveFile(w, r, path)
+		return
 	}
+
+	// Only unknown page routes fall back to the client app, anything under
+	// /static/ or that was rejected outright is a real 404
+	if err == errAssetRejected || (err != nil && strings.HasPrefix(r.URL.Path, "/static/")) {
+		http.NotFound(w, r)
+		return
+	}
+
+	serveIndex(w, r)
 }
@@ -0,0 +1,84 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+const (
+	testAdminToken    = "adminadminadminadminadmin"
+	testOperatorToken = "operatoroperatoroperatorx"
+)
+
+// TestMain runs the server instead of the tests when JMAAS_TEST_NODE is set,
+// so tests can start whole servers from the test binary
+func TestMain(m *testing.M) {
+	if os.Getenv("JMAAS_TEST_NODE") != "" {
+		main()
+		return
+	}
+	os.Exit(m.Run())
+}
+
+// setupTestServer points the server's globals at a fresh file store with five
+// levels and a token of each role, at level 0, putting them back when the
+// test ends
+func setupTestServer(t *testing.T) {
+	t.Helper()
+
+	oldCfg, oldStore, oldEvents := cfg, store, events
+	cfg = defaultConfig()
+	cfg.DataDir = t.TempDir()
+	events = &eventBus{}
+
+	s, err := openFileStore(cfg.DataDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	store = s
+	t.Cleanup(func() {
+		s.Close()
+		cfg, store, events = oldCfg, oldStore, oldEvents
+	})
+
+	levels := levelSet{}
+	for i, title := range []string{"Calm", "Grumpy", "Annoyed", "Angry", "Furious"} {
+		levels[i] = levelDefinition{Title: title, Background: "#000000"}
+	}
+	if err := store.SetLevels(levels); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutToken(testAdminToken, tokenAttr{Level: 1, Note: "admin", Role: roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := store.PutToken(testOperatorToken, tokenAttr{Level: 1, Note: "operator", Role: roleOperator}); err != nil {
+		t.Fatal(err)
+	}
+
+	setupRateLimits()
+	levelMu.Lock()
+	level, levelReason, levelVersion, levelEventKey = 0, "", 0, ""
+	pendingLevel = nil
+	levelMu.Unlock()
+	resetReactions(0, "", nil)
+}
@@ -0,0 +1,476 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"io"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// The bridge speaks just enough MQTT 3.1.1 to publish the level and take
+// commands: QoS 0 in both directions, which is what lights and displays
+// subscribe with anyway, and the broker keeps the retained level for them.
+const (
+	mqttConnect    = 0x10
+	mqttConnack    = 0x20
+	mqttPublish    = 0x30
+	mqttPuback     = 0x40
+	mqttSubscribe  = 0x82
+	mqttSuback     = 0x90
+	mqttPingreq    = 0xC0
+	mqttPingresp   = 0xD0
+	mqttDisconnect = 0xE0
+
+	mqttKeepAlive = 60 * time.Second
+	// mqttMaxPacket is the most we'll read from the broker, commands are
+	// tiny and nothing else is subscribed to
+	mqttMaxPacket  = 64 << 10
+	mqttMaxBackoff = time.Minute
+
+	// mqttLockoutKey is who failed token checks on the command topic are
+	// counted against, there's no telling publishers apart
+	mqttLockoutKey = "mqtt"
+)
+
+var mqttConnackErrors = map[byte]string{
+	1: "unacceptable protocol version",
+	2: "client id rejected",
+	3: "server unavailable",
+	4: "bad username or password",
+	5: "not authorized",
+}
+
+// mqttBridge publishes every level change to mqtt.topic, and changes the
+// level on commands sent to mqtt.command_topic
+type mqttBridge struct {
+	mu      sync.Mutex
+	conn    net.Conn
+	stopped bool
+	// latest is the last level published, sent again on every reconnect so
+	// the retained message survives the broker losing it
+	latest []byte
+}
+
+var mqtt = &mqttBridge{}
+
+// mqttCommand is a message on the command topic. It sets the level when
+// Level is given, otherwise Action is "up" or "down".
+type mqttCommand struct {
+	Token  string `json:"token"`
+	Level  *int   `json:"level"`
+	Action string `json:"action"`
+	Reason string `json:"reason"`
+}
+
+// startMQTT connects to mqtt.broker if it's set, staying connected for as
+// long as the server runs
+func startMQTT() {
+	if cfg.MQTTBroker == "" {
+		return
+	}
+
+	mqtt.latest = mqttLevelPayload(levelUpdateMessage(getCurrentLevel(), currentEvent(), currentReason()))
+	events.subscribe("mqtt", mqtt.handleEvent)
+	go mqtt.run()
+}
+
+func currentReason() string {
+	levelMu.RLock()
+	defer levelMu.RUnlock()
+	return levelReason
+}
+
+// mqttLevelPayload is what's published for a level, the levelupdate message
+// in the default locale
+func mqttLevelPayload(u *levelUpdate) []byte {
+	j, _ := json.Marshal(u.localize(cfg.DefaultLocale).Data)
+	return j
+}
+
+// handleEvent is the bridge's subscriber, publishing level changes
+func (b *mqttBridge) handleEvent(e event) {
+	changed, isChange := e.(levelChanged)
+	if !isChange {
+		return
+	}
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.latest = mqttLevelPayload(levelUpdateMessage(changed.Level, changed.Event, changed.Reason))
+	if b.conn != nil {
+		if err := b.publishLocked(); err != nil {
+			log.Warnf("Could not publish level to MQTT: %s", err.Error())
+			b.conn.Close()
+		}
+	}
+}
+
+func (b *mqttBridge) publishLocked() error {
+	return b.writeLocked(mqttPublish|0x01, mqttString(cfg.MQTTTopic), b.latest)
+}
+
+// writeLocked sends one packet, b.mu must be held
+func (b *mqttBridge) writeLocked(header byte, parts ...[]byte) error {
+	body := []byte{}
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	packet := append([]byte{header}, mqttRemainingLength(len(body))...)
+	packet = append(packet, body...)
+
+	b.conn.SetWriteDeadline(time.Now().Add(socketWriteTimeout))
+	_, err := b.conn.Write(packet)
+	return err
+}
+
+// stop disconnects for good, so a process we're handing off to can take
+// over the client id without the two of us fighting over it
+func (b *mqttBridge) stop() {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	b.stopped = true
+	if b.conn != nil {
+		b.writeLocked(mqttDisconnect)
+		b.conn.Close()
+	}
+}
+
+func (b *mqttBridge) isStopped() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.stopped
+}
+
+func (b *mqttBridge) run() {
+	backoff := time.Second
+	for !b.isStopped() {
+		start := time.Now()
+		err := b.session()
+		if b.isStopped() {
+			return
+		}
+		if time.Since(start) > mqttMaxBackoff {
+			backoff = time.Second
+		}
+		log.Warnf("MQTT connection to %s lost, retrying in %s: %s", cfg.MQTTBroker, backoff, err.Error())
+		time.Sleep(backoff)
+		if backoff *= 2; backoff > mqttMaxBackoff {
+			backoff = mqttMaxBackoff
+		}
+	}
+}
+
+// session connects, publishes the current level, and handles packets until
+// the connection drops
+func (b *mqttBridge) session() error {
+	conn, err := dialMQTT(cfg.MQTTBroker)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+
+	b.mu.Lock()
+	if b.stopped {
+		b.mu.Unlock()
+		return nil
+	}
+	b.conn = conn
+	err = b.connectLocked(r)
+	if err == nil && cfg.MQTTCommandTopic != "" {
+		err = b.writeLocked(mqttSubscribe, []byte{0, 1}, mqttString(cfg.MQTTCommandTopic), []byte{0})
+	}
+	if err == nil {
+		err = b.publishLocked()
+	}
+	if err != nil {
+		b.conn = nil
+		b.mu.Unlock()
+		return err
+	}
+	b.mu.Unlock()
+	log.Infof("Connected to MQTT broker %s, publishing to %s", cfg.MQTTBroker, cfg.MQTTTopic)
+
+	defer func() {
+		b.mu.Lock()
+		b.conn = nil
+		b.mu.Unlock()
+	}()
+
+	done := make(chan struct{})
+	defer close(done)
+	go b.ping(done)
+
+	for {
+		conn.SetReadDeadline(time.Now().Add(mqttKeepAlive * 3 / 2))
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			return err
+		}
+
+		switch header & 0xF0 {
+		case mqttPublish:
+			if err := b.handlePublish(header, body); err != nil {
+				return err
+			}
+		case mqttSuback:
+			if len(body) == 3 && body[2] == 0x80 {
+				log.Errorf("MQTT broker refused the subscription to %s", cfg.MQTTCommandTopic)
+			}
+		}
+	}
+}
+
+// connectLocked sends CONNECT and waits for the broker to accept it
+func (b *mqttBridge) connectLocked(r *bufio.Reader) error {
+	flags := byte(0x02) // clean session
+	payload := mqttString(cfg.MQTTClientID)
+	if cfg.MQTTUsername != "" {
+		flags |= 0x80
+		payload = append(payload, mqttString(cfg.MQTTUsername)...)
+	}
+	if cfg.MQTTPassword != "" {
+		flags |= 0x40
+		payload = append(payload, mqttString(cfg.MQTTPassword)...)
+	}
+	keepAlive := int(mqttKeepAlive / time.Second)
+	variable := append(mqttString("MQTT"), 4, flags, byte(keepAlive>>8), byte(keepAlive))
+	if err := b.writeLocked(mqttConnect, variable, payload); err != nil {
+		return err
+	}
+
+	b.conn.SetReadDeadline(time.Now().Add(socketWriteTimeout))
+	header, body, err := readMQTTPacket(r)
+	if err != nil {
+		return err
+	}
+	if header != mqttConnack || len(body) != 2 {
+		return errors.New("broker did not send CONNACK")
+	}
+	if body[1] != 0 {
+		if msg, known := mqttConnackErrors[body[1]]; known {
+			return fmt.Errorf("broker refused the connection: %s", msg)
+		}
+		return fmt.Errorf("broker refused the connection with code %d", body[1])
+	}
+	return nil
+}
+
+// ping keeps the connection inside the keep alive until done is closed
+func (b *mqttBridge) ping(done chan struct{}) {
+	ticker := time.NewTicker(mqttKeepAlive / 2)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			b.mu.Lock()
+			if b.conn != nil {
+				if err := b.writeLocked(mqttPingreq); err != nil {
+					b.conn.Close()
+				}
+			}
+			b.mu.Unlock()
+		}
+	}
+}
+
+// handlePublish runs a command from the command topic. The subscription is
+// QoS 0, but a broker may still send QoS 1, which has to be acknowledged.
+func (b *mqttBridge) handlePublish(header byte, body []byte) error {
+	topic, rest, err := mqttReadString(body)
+	if err != nil {
+		return err
+	}
+	if qos := (header >> 1) & 0x03; qos > 0 {
+		if len(rest) < 2 {
+			return errors.New("PUBLISH is missing its packet id")
+		}
+		if qos == 1 {
+			b.mu.Lock()
+			err := b.writeLocked(mqttPuback, rest[:2])
+			b.mu.Unlock()
+			if err != nil {
+				return err
+			}
+		}
+		rest = rest[2:]
+	}
+
+	if topic == cfg.MQTTCommandTopic {
+		if err := runMQTTCommand(rest); err != nil {
+			log.Warnf("Ignored MQTT command: %s", err.Error())
+		}
+	}
+	return nil
+}
+
+// runMQTTCommand changes the level for a command, held to the same token
+// checks and limits as the HTTP API. Failed tokens lock the whole command
+// topic out, like they would an address.
+func runMQTTCommand(payload []byte) error {
+	cmd := mqttCommand{}
+	if err := json.Unmarshal(payload, &cmd); err != nil {
+		return fmt.Errorf("could not read command: %s", err.Error())
+	}
+
+	if remaining := lockout.lockedFor(mqttLockoutKey); remaining > 0 {
+		return fmt.Errorf("too many failed tokens, locked out for %s", remaining.Round(time.Second))
+	}
+	attr, authed := isTokenAuthed(cmd.Token)
+	if cmd.Token == "" || !authed {
+		lockout.fail(mqttLockoutKey)
+		return errors.New("token is not authed")
+	}
+	lockout.succeed(mqttLockoutKey)
+
+	if ok, _ := tokenLimiter.allow(cmd.Token); !ok {
+		return fmt.Errorf("too many requests for %s", attr.Note)
+	}
+	if ok, _ := levelChangeLimiter.allow(cmd.Token); !ok {
+		return fmt.Errorf("too many level changes for %s", attr.Note)
+	}
+
+	reason, err := sanitizeReason(cmd.Reason)
+	if err != nil {
+		return err
+	}
+
+	var fn func(current int) int
+	switch {
+	case cmd.Level != nil:
+		lvl := *cmd.Level
+		fn = func(int) int { return lvl }
+	case cmd.Action == "up":
+		fn = func(current int) int { return current + 1 }
+	case cmd.Action == "down":
+		fn = func(current int) int { return current - 1 }
+	default:
+		return errors.New(`command needs a level, or an action of "up" or "down"`)
+	}
+
+	_, pending, err := updateLevel(attr.Note, tokenID(cmd.Token), reason, fn)
+	if err != nil {
+		return err
+	}
+	if pending != nil {
+		log.Infof("MQTT command from %s is waiting for approval", attr.Note)
+	}
+	return nil
+}
+
+// dialMQTT connects to a broker URL like tcp://host:1883, or
+// ssl://host:8883 for TLS
+func dialMQTT(broker string) (net.Conn, error) {
+	u, err := url.Parse(broker)
+	if err != nil {
+		return nil, err
+	}
+
+	dialer := &net.Dialer{Timeout: socketWriteTimeout}
+	switch u.Scheme {
+	case "tcp", "mqtt":
+		return dialer.Dial("tcp", mqttHostPort(u, "1883"))
+	case "ssl", "tls", "mqtts":
+		return tls.DialWithDialer(dialer, "tcp", mqttHostPort(u, "8883"), &tls.Config{ServerName: u.Hostname()})
+	}
+	return nil, fmt.Errorf("unknown MQTT scheme %q, expected tcp or ssl", u.Scheme)
+}
+
+func mqttHostPort(u *url.URL, defaultPort string) string {
+	if u.Port() != "" {
+		return u.Host
+	}
+	return net.JoinHostPort(u.Hostname(), defaultPort)
+}
+
+func readMQTTPacket(r *bufio.Reader) (byte, []byte, error) {
+	header, err := r.ReadByte()
+	if err != nil {
+		return 0, nil, err
+	}
+
+	length := 0
+	for i := uint(0); ; i += 7 {
+		if i > 21 {
+			return 0, nil, errors.New("malformed remaining length")
+		}
+		b, err := r.ReadByte()
+		if err != nil {
+			return 0, nil, err
+		}
+		length |= int(b&0x7F) << i
+		if b&0x80 == 0 {
+			break
+		}
+	}
+	if length > mqttMaxPacket {
+		return 0, nil, fmt.Errorf("packet of %d bytes is too big", length)
+	}
+
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return 0, nil, err
+	}
+	return header, body, nil
+}
+
+func mqttRemainingLength(n int) []byte {
+	out := []byte{}
+	for {
+		b := byte(n % 128)
+		n /= 128
+		if n > 0 {
+			b |= 0x80
+		}
+		out = append(out, b)
+		if n == 0 {
+			return out
+		}
+	}
+}
+
+func mqttString(s string) []byte {
+	return append([]byte{byte(len(s) >> 8), byte(len(s))}, s...)
+}
+
+func mqttReadString(b []byte) (string, []byte, error) {
+	if len(b) < 2 {
+		return "", nil, errors.New("truncated string")
+	}
+	n := int(b[0])<<8 | int(b[1])
+	if len(b) < 2+n {
+		return "", nil, errors.New("truncated string")
+	}
+	return string(b[2 : 2+n]), b[2+n:], nil
+}
@@ -0,0 +1,248 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"net"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testBroker is an in-process MQTT broker for one client, answering what the
+// bridge sends and recording what it publishes
+type testBroker struct {
+	t  *testing.T
+	ln net.Listener
+
+	mu        sync.Mutex
+	conn      net.Conn
+	connected chan struct{}
+	published chan []byte
+	acked     chan []byte
+}
+
+func newTestBroker(t *testing.T) *testBroker {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	b := &testBroker{
+		t:         t,
+		ln:        ln,
+		connected: make(chan struct{}, 1),
+		published: make(chan []byte, 16),
+		acked:     make(chan []byte, 16),
+	}
+	t.Cleanup(func() { ln.Close() })
+	go b.serve()
+	return b
+}
+
+func (b *testBroker) url() string {
+	return "tcp://" + b.ln.Addr().String()
+}
+
+func (b *testBroker) serve() {
+	for {
+		conn, err := b.ln.Accept()
+		if err != nil {
+			return
+		}
+		b.mu.Lock()
+		b.conn = conn
+		b.mu.Unlock()
+		go b.handle(conn)
+	}
+}
+
+func (b *testBroker) handle(conn net.Conn) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	for {
+		header, body, err := readMQTTPacket(r)
+		if err != nil {
+			return
+		}
+
+		switch header & 0xF0 {
+		case mqttConnect:
+			b.write(mqttConnack, []byte{0, 0})
+			b.connected <- struct{}{}
+		case mqttSubscribe & 0xF0:
+			b.write(mqttSuback, body[:2], []byte{0})
+		case mqttPingreq:
+			b.write(mqttPingresp)
+		case mqttPublish:
+			topic, payload, err := mqttReadString(body)
+			if err != nil || topic != cfg.MQTTTopic || header&0x01 == 0 {
+				b.t.Errorf("bridge published %x to %q, want a retained publish to %q", header, topic, cfg.MQTTTopic)
+			}
+			b.published <- payload
+		case mqttPuback:
+			b.acked <- body
+		}
+	}
+}
+
+func (b *testBroker) write(header byte, parts ...[]byte) {
+	body := []byte{}
+	for _, p := range parts {
+		body = append(body, p...)
+	}
+	packet := append([]byte{header}, mqttRemainingLength(len(body))...)
+	packet = append(packet, body...)
+
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if _, err := b.conn.Write(packet); err != nil {
+		b.t.Errorf("could not write to the bridge: %s", err.Error())
+	}
+}
+
+// command publishes cmd to the command topic, at QoS 1 with packet id 7 when
+// qos1 is set
+func (b *testBroker) command(cmd mqttCommand, qos1 bool) {
+	payload, _ := json.Marshal(cmd)
+	if qos1 {
+		b.write(mqttPublish|0x02, mqttString(cfg.MQTTCommandTopic), []byte{0, 7}, payload)
+		return
+	}
+	b.write(mqttPublish, mqttString(cfg.MQTTCommandTopic), payload)
+}
+
+// nextLevel waits for the bridge to publish a level
+func (b *testBroker) nextLevel() int {
+	b.t.Helper()
+	select {
+	case payload := <-b.published:
+		update := struct {
+			Level *int `json:"level"`
+		}{}
+		if err := json.Unmarshal(payload, &update); err != nil || update.Level == nil {
+			b.t.Fatalf("bridge published %s, want a level", payload)
+		}
+		return *update.Level
+	case <-time.After(5 * time.Second):
+		b.t.Fatal("bridge did not publish a level")
+	}
+	return 0
+}
+
+// noLevel checks the bridge doesn't publish anything for a while
+func (b *testBroker) noLevel() {
+	b.t.Helper()
+	select {
+	case payload := <-b.published:
+		b.t.Fatalf("bridge published %s, want nothing", payload)
+	case <-time.After(200 * time.Millisecond):
+	}
+}
+
+func startTestBridge(t *testing.T) *testBroker {
+	broker := newTestBroker(t)
+	cfg.MQTTBroker = broker.url()
+	cfg.MQTTCommandTopic = "jmaas/command"
+	cfg.LockoutThreshold = 3
+
+	setupRateLimits()
+	mqtt = &mqttBridge{}
+	startMQTT()
+	t.Cleanup(mqtt.stop)
+
+	select {
+	case <-broker.connected:
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge did not connect")
+	}
+	return broker
+}
+
+func TestMQTTPublishesLevel(t *testing.T) {
+	setupTestServer(t)
+	broker := startTestBridge(t)
+
+	if lvl := broker.nextLevel(); lvl != 0 {
+		t.Errorf("bridge published level %d on connect, want 0", lvl)
+	}
+
+	lvl := 2
+	broker.command(mqttCommand{Token: testOperatorToken, Level: &lvl, Reason: "deploy"}, false)
+	if lvl := broker.nextLevel(); lvl != 2 {
+		t.Errorf("bridge published level %d after a command, want 2", lvl)
+	}
+	if current := getCurrentLevel(); current != 2 {
+		t.Errorf("level is %d after a command, want 2", current)
+	}
+
+	broker.command(mqttCommand{Token: testOperatorToken, Action: "down"}, true)
+	select {
+	case id := <-broker.acked:
+		if string(id) != "\x00\x07" {
+			t.Errorf("PUBACK for packet %x, want 0007", id)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("bridge did not acknowledge a QoS 1 command")
+	}
+	if lvl := broker.nextLevel(); lvl != 1 {
+		t.Errorf("bridge published level %d after going down, want 1", lvl)
+	}
+}
+
+func TestMQTTCommandLockout(t *testing.T) {
+	setupTestServer(t)
+	broker := startTestBridge(t)
+	broker.nextLevel()
+
+	lvl := 3
+	for i := 0; i < cfg.LockoutThreshold; i++ {
+		broker.command(mqttCommand{Token: "guessguessguessguessguess", Level: &lvl}, false)
+	}
+	broker.noLevel()
+
+	broker.command(mqttCommand{Token: testOperatorToken, Level: &lvl}, false)
+	broker.noLevel()
+	if current := getCurrentLevel(); current != 0 {
+		t.Errorf("level is %d, want a locked out command topic to be ignored", current)
+	}
+	if remaining := lockout.lockedFor(mqttLockoutKey); remaining <= 0 {
+		t.Error("command topic is not locked out after failed tokens")
+	}
+}
+
+func TestMQTTCommandRateLimit(t *testing.T) {
+	setupTestServer(t)
+	cfg.LevelChangesPerMinute = 1
+	broker := startTestBridge(t)
+	broker.nextLevel()
+
+	broker.command(mqttCommand{Token: testOperatorToken, Action: "up"}, false)
+	if lvl := broker.nextLevel(); lvl != 1 {
+		t.Errorf("bridge published level %d, want 1", lvl)
+	}
+	broker.command(mqttCommand{Token: testOperatorToken, Action: "up"}, false)
+	broker.noLevel()
+	if current := getCurrentLevel(); current != 1 {
+		t.Errorf("level is %d, want the second change to be limited", current)
+	}
+}
@@ -0,0 +1,811 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"crypto/subtle"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/go-playground/log"
+	"html/template"
+	"io"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/mail"
+	"net/smtp"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Notifications tell subscribers when the level rises to or past their
+// threshold, by email or Web Push. Each crossing is sent once, crossings
+// during a subscriber's quiet hours are held until the quiet hours end, and
+// the level bouncing around a threshold is only sent once every
+// notifications.repeat_after. Subscriptions are kept by the node they were
+// made on, like tokens.
+
+// Subscription channels
+const (
+	channelEmail = "email"
+	channelPush  = "push"
+)
+
+const (
+	// maxSubscriptions keeps anonymous subscribers from filling the store,
+	// and maxPendingSubscriptions keeps email addresses nobody confirms
+	// from taking up the confirmed ones' room
+	maxSubscriptions        = 10000
+	maxPendingSubscriptions = 1000
+	// maxSubscribeRequest is the most a subscribe request can be, a push
+	// subscription is a few hundred bytes
+	maxSubscribeRequest = 16 << 10
+	// subscriptionConfirmWithin is how long an email address has to be
+	// confirmed before the subscription is dropped
+	subscriptionConfirmWithin = 24 * time.Hour
+	// maxNotifySends is how many notifications go out at once
+	maxNotifySends = 8
+	smtpTimeout    = 30 * time.Second
+)
+
+var (
+	errNoSubscription       = errors.New("no such subscription")
+	errTooManySubscriptions = errors.New("too many subscriptions, try again later")
+)
+
+// subscription is someone asking to hear when the level reaches Threshold
+type subscription struct {
+	ID string `json:"id"`
+	// Key lets whoever subscribed cancel it, ConfirmCode is only ever sent
+	// to an email address to prove it asked
+	Key         string        `json:"key"`
+	ConfirmCode string        `json:"confirmCode,omitempty"`
+	Confirmed   bool          `json:"confirmed"`
+	Channel     string        `json:"channel"`
+	Email       string        `json:"email,omitempty"`
+	Push        *pushEndpoint `json:"push,omitempty"`
+	Threshold   int           `json:"threshold"`
+	Quiet       *quietHours   `json:"quiet,omitempty"`
+	Locale      string        `json:"locale"`
+	Created     time.Time     `json:"created"`
+	// NotifiedEvent and NotifiedAt are the last notification sent, Held
+	// is a crossing waiting for quiet hours to end
+	NotifiedEvent int64     `json:"notifiedEvent,omitempty"`
+	NotifiedAt    time.Time `json:"notifiedAt,omitempty"`
+	Held          bool      `json:"held,omitempty"`
+	// Node is the cluster node it was made on, the one that notifies it
+	Node string `json:"node,omitempty"`
+}
+
+// notifiedHere is whether this node sends sub's notifications, event IDs
+// are only meaningful on the node that sent them
+func (sub subscription) notifiedHere() bool {
+	return sub.Node == "" || sub.Node == nodeID
+}
+
+// quietHours is a daily window with no notifications, from Start to End in
+// Zone. A window that ends before it starts runs past midnight.
+type quietHours struct {
+	Start string `json:"start"`
+	End   string `json:"end"`
+	Zone  string `json:"zone"`
+}
+
+// validate checks q, writing the times as HH:MM since "7:00" parses too
+func (q *quietHours) validate() error {
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		return fmt.Errorf("quiet hours start %q is not a time like 22:00", q.Start)
+	}
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		return fmt.Errorf("quiet hours end %q is not a time like 07:00", q.End)
+	}
+	q.Start, q.End = start.Format("15:04"), end.Format("15:04")
+	if q.Zone == "" {
+		q.Zone = "UTC"
+	}
+	if _, err := time.LoadLocation(q.Zone); err != nil {
+		return fmt.Errorf("unknown time zone %q", q.Zone)
+	}
+	return nil
+}
+
+// contains is whether t is inside the quiet hours, always false for none
+func (q *quietHours) contains(t time.Time) bool {
+	if q == nil {
+		return false
+	}
+	loc, err := time.LoadLocation(q.Zone)
+	if err != nil {
+		return false
+	}
+	start, err := time.Parse("15:04", q.Start)
+	if err != nil {
+		return false
+	}
+	end, err := time.Parse("15:04", q.End)
+	if err != nil {
+		return false
+	}
+
+	t = t.In(loc)
+	now := t.Hour()*60 + t.Minute()
+	from, to := start.Hour()*60+start.Minute(), end.Hour()*60+end.Minute()
+	if from <= to {
+		return from <= now && now < to
+	}
+	return now >= from || now < to
+}
+
+// notifyChannels is which channels the page offers, nil when notifications
+// are off
+type notifyChannels struct {
+	Email bool
+	Push  bool
+}
+
+func enabledNotifyChannels() *notifyChannels {
+	if !cfg.EnableNotify {
+		return nil
+	}
+	return &notifyChannels{Email: cfg.SMTPAddr != "", Push: true}
+}
+
+// notifier guards every change to subscriptions, so a notification going out
+// can't bring back a subscription that was just cancelled
+var notifier = struct {
+	mu      sync.Mutex
+	sending chan struct{}
+}{sending: make(chan struct{}, maxNotifySends)}
+
+// startNotifications loads the VAPID key and starts watching the level, if
+// features.notifications is on
+func startNotifications() error {
+	if !cfg.EnableNotify {
+		return nil
+	}
+	if err := loadVAPIDKey(); err != nil {
+		return err
+	}
+	events.subscribe("notifications", notifyEvents)
+	go notifyTicker()
+	return nil
+}
+
+func notifyEvents(e event) {
+	changed, isChange := e.(levelChanged)
+	if !isChange || changed.Level == changed.Previous {
+		return
+	}
+	notifyCrossing(changed.Level, changed.Previous, changed.Event, changed.Reason)
+}
+
+// notifyCrossing notifies everyone whose threshold the level just reached
+func notifyCrossing(lvl, previous int, event int64, reason string) {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	subs, err := store.Subscriptions()
+	if err != nil {
+		log.Errorf("Could not load subscriptions: %s", err.Error())
+		return
+	}
+
+	now := time.Now()
+	for _, sub := range subs {
+		if !sub.notifiedHere() || !sub.Confirmed || previous >= sub.Threshold {
+			continue
+		}
+		if lvl < sub.Threshold {
+			if sub.Held {
+				sub.Held = false
+				putSubscription(sub)
+			}
+			continue
+		}
+		if sub.NotifiedEvent == event || now.Sub(sub.NotifiedAt) < cfg.NotifyRepeatAfter {
+			continue
+		}
+
+		if sub.Quiet.contains(now) {
+			if !sub.Held {
+				sub.Held = true
+				putSubscription(sub)
+			}
+			continue
+		}
+		notifyLocked(sub, lvl, event, reason)
+	}
+}
+
+// notifyTicker sends held notifications once quiet hours end, and drops
+// email subscriptions that were never confirmed
+func notifyTicker() {
+	for range time.Tick(time.Minute) {
+		levelMu.RLock()
+		lvl, event, reason := level, currentEvent(), levelReason
+		levelMu.RUnlock()
+
+		notifier.mu.Lock()
+		subs, err := store.Subscriptions()
+		if err != nil {
+			log.Errorf("Could not load subscriptions: %s", err.Error())
+		}
+		now := time.Now()
+		for _, sub := range subs {
+			switch {
+			case !sub.notifiedHere():
+			case !sub.Confirmed && now.Sub(sub.Created) > subscriptionConfirmWithin:
+				if _, err := store.DeleteSubscription(sub.ID); err != nil {
+					log.Errorf("Could not delete subscription: %s", err.Error())
+				}
+			case !sub.Held || sub.Quiet.contains(now):
+			case lvl < sub.Threshold:
+				sub.Held = false
+				putSubscription(sub)
+			default:
+				notifyLocked(sub, lvl, event, reason)
+			}
+		}
+		notifier.mu.Unlock()
+	}
+}
+
+func putSubscription(sub subscription) {
+	if err := store.PutSubscription(sub); err != nil {
+		log.Errorf("Could not save subscription: %s", err.Error())
+	}
+}
+
+// notifyLocked records that sub is being notified, then sends it in the
+// background. Recording it first means a crash can lose a notification but
+// never send one twice. notifier.mu must be held.
+func notifyLocked(sub subscription, lvl int, event int64, reason string) {
+	sub.NotifiedEvent = event
+	sub.NotifiedAt = time.Now()
+	sub.Held = false
+	if err := store.PutSubscription(sub); err != nil {
+		log.Errorf("Could not save subscription, not notifying: %s", err.Error())
+		return
+	}
+
+	n := newNotification(sub, lvl, reason)
+	go func() {
+		notifier.sending <- struct{}{}
+		defer func() { <-notifier.sending }()
+
+		if err := n.send(sub); err != nil {
+			log.Warnf("Could not notify subscription %s by %s: %s", sub.ID, sub.Channel, err.Error())
+			if err == errPushGone {
+				deleteSubscription(sub.ID)
+			}
+		}
+	}()
+}
+
+func deleteSubscription(id string) (bool, error) {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+	return store.DeleteSubscription(id)
+}
+
+// notification is what's sent, and the JSON payload of a push
+type notification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Level int    `json:"level"`
+	URL   string `json:"url"`
+}
+
+// newNotification describes lvl in the subscriber's locale, the way link
+// previews do
+func newNotification(sub subscription, lvl int, reason string) notification {
+	snap := notifySnapshot(sub.Locale, lvl)
+	snap.Reason = reason
+	return notification{
+		Title: snap.Heading(),
+		Body:  snap.Excerpt(),
+		Level: lvl,
+		URL:   strings.TrimSuffix(cfg.NotifyBaseURL, "/") + "/",
+	}
+}
+
+// notifySnapshot is lvl in locale as plain text, titles can hold HTML
+func notifySnapshot(locale string, lvl int) levelSnapshot {
+	levels, err := store.Levels()
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+	}
+	def := levels.localized(locale)[lvl]
+	def.Title = excerpt(def.Title)
+	return levelSnapshot{Level: lvl, Definition: def}
+}
+
+func (n notification) send(sub subscription) error {
+	switch sub.Channel {
+	case channelEmail:
+		body := fmt.Sprintf("%s\n\n%s\n\n%s\n\n-- \nYou asked %s to tell you when the level reaches %s.\nTo stop, visit %s\n",
+			n.Title, n.Body, n.URL, siteName, notifySnapshot(sub.Locale, sub.Threshold).Heading(), subscriptionURL("unsubscribe", sub.ID, sub.Key))
+		return sendMail(sub.Email, n.Title, body, sub)
+	case channelPush:
+		payload, _ := json.Marshal(n)
+		return sub.Push.send(payload)
+	}
+	return fmt.Errorf("unknown channel %q", sub.Channel)
+}
+
+// subscriptionURL is a link to confirm or cancel a subscription
+func subscriptionURL(action, id, code string) string {
+	return fmt.Sprintf("%s/api/subscriptions/%s?id=%s&key=%s", strings.TrimSuffix(cfg.NotifyBaseURL, "/"), action, url.QueryEscape(id), url.QueryEscape(code))
+}
+
+// sendMail sends a plain text email through notifications.smtp_addr, using
+// STARTTLS when the server offers it. An email for a subscription can be
+// unsubscribed from in one click.
+func sendMail(to, subject, body string, sub subscription) error {
+	from, _ := mail.ParseAddress(cfg.SMTPFrom)
+
+	msg := &bytes.Buffer{}
+	fmt.Fprintf(msg, "From: %s\r\n", from.String())
+	fmt.Fprintf(msg, "To: %s\r\n", to)
+	fmt.Fprintf(msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(msg, "Message-ID: <%s@%s>\r\n", randStringRunes(24), hostOf(cfg.NotifyBaseURL))
+	if sub.Confirmed {
+		fmt.Fprintf(msg, "List-Unsubscribe: <%s>\r\n", subscriptionURL("unsubscribe", sub.ID, sub.Key))
+		msg.WriteString("List-Unsubscribe-Post: List-Unsubscribe=One-Click\r\n")
+	}
+	msg.WriteString("MIME-Version: 1.0\r\n")
+	msg.WriteString("Content-Type: text/plain; charset=utf-8\r\n")
+	msg.WriteString("Content-Transfer-Encoding: quoted-printable\r\n\r\n")
+	qp := quotedprintable.NewWriter(msg)
+	qp.Write([]byte(strings.Replace(body, "\n", "\r\n", -1)))
+	qp.Close()
+
+	conn, err := net.DialTimeout("tcp", cfg.SMTPAddr, smtpTimeout)
+	if err != nil {
+		return err
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+	host, _, _ := net.SplitHostPort(cfg.SMTPAddr)
+	c, err := smtp.NewClient(conn, host)
+	if err != nil {
+		conn.Close()
+		return err
+	}
+	defer c.Close()
+
+	if ok, _ := c.Extension("STARTTLS"); ok {
+		if err := c.StartTLS(&tls.Config{ServerName: host}); err != nil {
+			return err
+		}
+	}
+	if cfg.SMTPUsername != "" {
+		if err := c.Auth(smtp.PlainAuth("", cfg.SMTPUsername, cfg.SMTPPassword, host)); err != nil {
+			return err
+		}
+	}
+	if err := c.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := c.Rcpt(to); err != nil {
+		return err
+	}
+	w, err := c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg.Bytes()); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return c.Quit()
+}
+
+func hostOf(rawurl string) string {
+	if u, err := url.Parse(rawurl); err == nil && u.Hostname() != "" {
+		return u.Hostname()
+	}
+	return "localhost"
+}
+
+// subscribeRequest is the body of POST /api/subscriptions
+type subscribeRequest struct {
+	Channel   string        `json:"channel"`
+	Email     string        `json:"email"`
+	Push      *pushEndpoint `json:"push"`
+	Threshold int           `json:"threshold"`
+	Quiet     *quietHours   `json:"quiet"`
+}
+
+// subscribeResponse has what the client needs to cancel the subscription
+type subscribeResponse struct {
+	ID        string `json:"id"`
+	Key       string `json:"key"`
+	Confirmed bool   `json:"confirmed"`
+}
+
+// newSubscription checks a request and turns it into a subscription. Email
+// subscriptions have to be confirmed from the address, push ones were
+// already allowed in the browser.
+func newSubscription(req subscribeRequest, locale string) (subscription, error) {
+	sub := subscription{
+		ID:        randStringRunes(16),
+		Key:       randStringRunes(32),
+		Channel:   req.Channel,
+		Threshold: req.Threshold,
+		Quiet:     req.Quiet,
+		Locale:    locale,
+		Created:   time.Now(),
+	}
+	if cfg.ClusterBackplane != "" {
+		sub.Node = nodeID
+	}
+
+	switch req.Channel {
+	case channelEmail:
+		if cfg.SMTPAddr == "" {
+			return sub, errors.New("email notifications are not set up")
+		}
+		addr, err := mail.ParseAddress(req.Email)
+		if err != nil || len(addr.Address) > 254 || strings.ContainsAny(addr.Address, "\r\n") {
+			return sub, errors.New("not a valid email address")
+		}
+		sub.Email = addr.Address
+		sub.ConfirmCode = randStringRunes(32)
+	case channelPush:
+		if req.Push == nil {
+			return sub, errors.New("push needs the browser's push subscription")
+		}
+		if err := req.Push.validate(); err != nil {
+			return sub, err
+		}
+		sub.Push = req.Push
+		sub.Confirmed = true
+	default:
+		return sub, fmt.Errorf("unknown channel %q, expected email or push", req.Channel)
+	}
+
+	if numlvls := getNumLevels(); req.Threshold < 1 || req.Threshold > numlvls-1 {
+		return sub, fmt.Errorf("threshold must be a level from 1 to %d", numlvls-1)
+	}
+	if sub.Quiet != nil {
+		if err := sub.Quiet.validate(); err != nil {
+			return sub, err
+		}
+	}
+	return sub, nil
+}
+
+// addSubscription saves sub. A browser subscribing again replaces its old
+// subscription, so changing the threshold doesn't notify twice.
+func addSubscription(sub subscription) error {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	subs, err := store.Subscriptions()
+	if err != nil {
+		return err
+	}
+	replaced := []string{}
+	for _, old := range subs {
+		if sub.Push != nil && old.Push != nil && old.Push.Endpoint == sub.Push.Endpoint {
+			replaced = append(replaced, old.ID)
+		}
+	}
+	if !roomForSubscription(subs, sub.Confirmed, replaced...) {
+		return errTooManySubscriptions
+	}
+	for _, id := range replaced {
+		if _, err := store.DeleteSubscription(id); err != nil {
+			return err
+		}
+	}
+	return store.PutSubscription(sub)
+}
+
+// roomForSubscription is whether another confirmed, or pending, subscription
+// fits alongside subs, not counting the ones it replaces
+func roomForSubscription(subs []subscription, confirmed bool, replaced ...string) bool {
+	count := 0
+	for _, sub := range subs {
+		isReplaced := false
+		for _, id := range replaced {
+			isReplaced = isReplaced || sub.ID == id
+		}
+		if !isReplaced && sub.Confirmed == confirmed {
+			count++
+		}
+	}
+	if confirmed {
+		return count < maxSubscriptions
+	}
+	return count < maxPendingSubscriptions
+}
+
+// secretsEqual compares a secret from a request to the one we have in
+// constant time, an empty one never matches
+func secretsEqual(have, given string) bool {
+	return have != "" && subtle.ConstantTimeCompare([]byte(have), []byte(given)) == 1
+}
+
+// confirmSubscription confirms an email subscription, replacing any others
+// for the same address
+func confirmSubscription(id, code string) error {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	subs, err := store.Subscriptions()
+	if err != nil {
+		return err
+	}
+
+	var sub *subscription
+	for i := range subs {
+		if subs[i].ID == id && secretsEqual(subs[i].ConfirmCode, code) {
+			sub = &subs[i]
+		}
+	}
+	if sub == nil {
+		return errNoSubscription
+	}
+
+	replaced := []string{}
+	for _, old := range subs {
+		if old.ID != sub.ID && old.Channel == channelEmail && strings.EqualFold(old.Email, sub.Email) {
+			replaced = append(replaced, old.ID)
+		}
+	}
+	if !roomForSubscription(subs, true, replaced...) {
+		return errTooManySubscriptions
+	}
+	for _, id := range replaced {
+		if _, err := store.DeleteSubscription(id); err != nil {
+			return err
+		}
+	}
+	sub.Confirmed = true
+	sub.ConfirmCode = ""
+	return store.PutSubscription(*sub)
+}
+
+// cancelSubscription deletes the subscription if key is its key
+func cancelSubscription(id, key string) error {
+	notifier.mu.Lock()
+	defer notifier.mu.Unlock()
+
+	subs, err := store.Subscriptions()
+	if err != nil {
+		return err
+	}
+	for _, sub := range subs {
+		if sub.ID == id && secretsEqual(sub.Key, key) {
+			_, err := store.DeleteSubscription(id)
+			return err
+		}
+	}
+	return errNoSubscription
+}
+
+// subscriptionsHandler subscribes on a POST. Admins can GET every
+// subscription, without the secrets.
+func subscriptionsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method == "GET" {
+		listSubscriptions(w, r)
+		return
+	}
+	if r.Method != "POST" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		w.Write([]byte("Subscribing needs a POST"))
+		return
+	}
+
+	req := subscribeRequest{}
+	if err := json.NewDecoder(io.LimitReader(r.Body, maxSubscribeRequest)).Decode(&req); err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Could not read subscription: " + err.Error()))
+		return
+	}
+
+	levels, err := store.Levels()
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+	}
+	sub, err := newSubscription(req, negotiateLocale(r, levels))
+	if err != nil {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if err := addSubscription(sub); err != nil {
+		status := http.StatusInternalServerError
+		if err == errTooManySubscriptions {
+			status = http.StatusServiceUnavailable
+		} else {
+			log.Errorf("Could not save subscription: %s", err.Error())
+		}
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(status)
+		w.Write([]byte(err.Error()))
+		return
+	}
+
+	if sub.Channel == channelEmail {
+		go func() {
+			body := fmt.Sprintf("Someone, hopefully you, asked %s to email this address when the level reaches %s.\n\nTo start getting emails, confirm at %s\n\nIf it wasn't you, ignore this email and nothing will be sent.\n",
+				siteName, notifySnapshot(sub.Locale, sub.Threshold).Heading(), subscriptionURL("confirm", sub.ID, sub.ConfirmCode))
+			if err := sendMail(sub.Email, "Confirm notifications from "+siteName, body, sub); err != nil {
+				log.Warnf("Could not send confirmation for subscription %s: %s", sub.ID, err.Error())
+			}
+		}()
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	j, _ := json.Marshal(subscribeResponse{ID: sub.ID, Key: sub.Key, Confirmed: sub.Confirmed})
+	w.Write(j)
+}
+
+// subscriptionSummary is a subscription as admins see it
+type subscriptionSummary struct {
+	ID         string      `json:"id"`
+	Channel    string      `json:"channel"`
+	Email      string      `json:"email,omitempty"`
+	PushHost   string      `json:"pushHost,omitempty"`
+	Threshold  int         `json:"threshold"`
+	Quiet      *quietHours `json:"quiet,omitempty"`
+	Confirmed  bool        `json:"confirmed"`
+	Created    time.Time   `json:"created"`
+	NotifiedAt time.Time   `json:"notifiedAt,omitempty"`
+}
+
+func listSubscriptions(w http.ResponseWriter, r *http.Request) {
+	_, attr, ok := authRequest(w, r)
+	if !ok {
+		return
+	}
+	if attr.role() != roleAdmin {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("token is not an admin"))
+		return
+	}
+
+	subs, err := store.Subscriptions()
+	if err != nil {
+		log.Errorf("Could not load subscriptions: %s", err.Error())
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("Could not load subscriptions"))
+		return
+	}
+
+	out := []subscriptionSummary{}
+	for _, sub := range subs {
+		summary := subscriptionSummary{ID: sub.ID, Channel: sub.Channel, Email: sub.Email, Threshold: sub.Threshold, Quiet: sub.Quiet, Confirmed: sub.Confirmed, Created: sub.Created, NotifiedAt: sub.NotifiedAt}
+		if sub.Push != nil {
+			summary.PushHost = hostOf(sub.Push.Endpoint)
+		}
+		out = append(out, summary)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	j, _ := json.Marshal(out)
+	w.Write(j)
+}
+
+// vapidHandler gives browsers the key to subscribe to push with
+func vapidHandler(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "application/json")
+	j, _ := json.Marshal(map[string]string{"publicKey": vapidPublicKey()})
+	w.Write(j)
+}
+
+// subscriptionPage is what the links in emails open. They only act on a
+// POST, so mail scanners following links don't confirm or cancel anything.
+var subscriptionPage = template.Must(template.New("subscription").Parse(`<!DOCTYPE html>
+<html>
+<head>
+  <meta charset="utf-8">
+  <meta name="viewport" content="width=device-width">
+  <title>{{.SiteName}}</title>
+  <link rel="stylesheet" href="/static/style.css" />
+</head>
+<body>
+  <div class="content">
+    <div class="container">
+      <div class="intro">
+        <h1>{{.SiteName}}</h1>
+        <p>{{.Message}}</p>
+        {{- if .Action}}
+        <form method="POST"><button>{{.Action}}</button></form>
+        {{- end}}
+      </div>
+    </div>
+  </div>
+</body>
+</html>
+`))
+
+type subscriptionPageData struct {
+	SiteName string
+	Message  string
+	Action   string
+}
+
+func writeSubscriptionPage(w http.ResponseWriter, status int, message, action string) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(status)
+	subscriptionPage.Execute(w, subscriptionPageData{SiteName: siteName, Message: message, Action: action})
+}
+
+func confirmSubscriptionHandler(w http.ResponseWriter, r *http.Request) {
+	id, key := r.URL.Query().Get("id"), r.URL.Query().Get("key")
+	if r.Method != "POST" {
+		writeSubscriptionPage(w, http.StatusOK, "Confirm that you want emails when the level changes.", "Confirm")
+		return
+	}
+
+	if err := confirmSubscription(id, key); err != nil {
+		switch err {
+		case errNoSubscription:
+			writeSubscriptionPage(w, http.StatusNotFound, "That link has expired, subscribe again from the board.", "")
+		case errTooManySubscriptions:
+			writeSubscriptionPage(w, http.StatusServiceUnavailable, "There are too many subscriptions, try again later.", "Confirm")
+		default:
+			log.Errorf("Could not confirm subscription: %s", err.Error())
+			writeSubscriptionPage(w, http.StatusNotFound, "That link has expired, subscribe again from the board.", "")
+		}
+		return
+	}
+	writeSubscriptionPage(w, http.StatusOK, "You're subscribed. Every email has a link to stop them.", "")
+}
+
+func unsubscribeHandler(w http.ResponseWriter, r *http.Request) {
+	id, key := r.URL.Query().Get("id"), r.URL.Query().Get("key")
+	if r.Method != "POST" {
+		writeSubscriptionPage(w, http.StatusOK, "Stop getting notifications about the level?", "Unsubscribe")
+		return
+	}
+
+	if err := cancelSubscription(id, key); err != nil {
+		if err != errNoSubscription {
+			log.Errorf("Could not cancel subscription: %s", err.Error())
+		}
+		writeSubscriptionPage(w, http.StatusNotFound, "That subscription doesn't exist, it may already be cancelled.", "")
+		return
+	}
+	writeSubscriptionPage(w, http.StatusOK, "You're unsubscribed.", "")
+}
@@ -0,0 +1,300 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"mime"
+	"mime/quotedprintable"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestQuietHours(t *testing.T) {
+	q := &quietHours{Start: "22:00", End: "7:00", Zone: "Europe/Berlin"}
+	if err := q.validate(); err != nil {
+		t.Fatal(err)
+	}
+	if q.Start != "22:00" || q.End != "07:00" {
+		t.Errorf("validate left the times as %s to %s, want 22:00 to 07:00", q.Start, q.End)
+	}
+
+	berlin, _ := time.LoadLocation("Europe/Berlin")
+	for _, q := range []*quietHours{q, {Start: "22:00", End: "7:00", Zone: "Europe/Berlin"}} {
+		for clock, want := range map[string]bool{
+			"21:59": false,
+			"22:00": true,
+			"23:30": true,
+			"00:00": true,
+			"06:30": true,
+			"07:00": false,
+			"12:00": false,
+		} {
+			at, _ := time.ParseInLocation("2006-01-02 15:04", "2026-03-04 "+clock, berlin)
+			if got := q.contains(at.UTC()); got != want {
+				t.Errorf("%s to %s contains %s = %t, want %t", q.Start, q.End, clock, got, want)
+			}
+		}
+	}
+
+	day := &quietHours{Start: "9:30", End: "17:00", Zone: "UTC"}
+	for clock, want := range map[string]bool{"09:29": false, "09:30": true, "16:59": true, "17:00": false} {
+		at, _ := time.Parse("2006-01-02 15:04", "2026-03-04 "+clock)
+		if got := day.contains(at); got != want {
+			t.Errorf("9:30 to 17:00 contains %s = %t, want %t", clock, got, want)
+		}
+	}
+
+	for _, bad := range []*quietHours{{Start: "25:00", End: "07:00"}, {Start: "22:00", End: "7"}, {Start: "22:00", End: "07:00", Zone: "Mars/Olympus"}} {
+		if err := bad.validate(); err == nil {
+			t.Errorf("%+v is valid, want an error", bad)
+		}
+	}
+}
+
+func TestRoomForSubscription(t *testing.T) {
+	subs := []subscription{}
+	for i := 0; i < maxPendingSubscriptions; i++ {
+		subs = append(subs, subscription{ID: randStringRunes(16)})
+	}
+	if roomForSubscription(subs, false) {
+		t.Error("room for another pending subscription when the pending ones are full")
+	}
+	if !roomForSubscription(subs, false, subs[0].ID) {
+		t.Error("no room for a pending subscription that replaces one")
+	}
+	if !roomForSubscription(subs, true) {
+		t.Error("pending subscriptions left no room for confirmed ones")
+	}
+
+	for i := 0; i < maxSubscriptions; i++ {
+		subs = append(subs, subscription{ID: randStringRunes(16), Confirmed: true})
+	}
+	if roomForSubscription(subs, true) {
+		t.Error("room for another confirmed subscription when they're full")
+	}
+}
+
+func TestSecretsEqual(t *testing.T) {
+	for _, c := range []struct {
+		have, given string
+		want        bool
+	}{
+		{"abc", "abc", true},
+		{"abc", "abd", false},
+		{"abc", "ab", false},
+		{"", "", false},
+	} {
+		if got := secretsEqual(c.have, c.given); got != c.want {
+			t.Errorf("secretsEqual(%q, %q) = %t, want %t", c.have, c.given, got, c.want)
+		}
+	}
+}
+
+func TestSubscriptionNotifiedHere(t *testing.T) {
+	defer func(id string) { nodeID = id }(nodeID)
+	nodeID = "node0"
+
+	for node, want := range map[string]bool{"": true, "node0": true, "node1": false} {
+		if got := (subscription{Node: node}).notifiedHere(); got != want {
+			t.Errorf("a subscription made on %q is notified here: %t, want %t", node, got, want)
+		}
+	}
+}
+
+// testSMTP is an SMTP server that accepts every message
+type testSMTP struct {
+	ln       net.Listener
+	messages chan *mail.Message
+}
+
+func newTestSMTP(t *testing.T) *testSMTP {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &testSMTP{ln: ln, messages: make(chan *mail.Message, 8)}
+	t.Cleanup(func() { ln.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *testSMTP) serve() {
+	for {
+		conn, err := s.ln.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(textproto.NewConn(conn))
+	}
+}
+
+func (s *testSMTP) handle(c *textproto.Conn) {
+	defer c.Close()
+	c.PrintfLine("220 test ESMTP")
+	for {
+		line, err := c.ReadLine()
+		if err != nil {
+			return
+		}
+		switch cmd := strings.ToUpper(strings.SplitN(line, " ", 2)[0]); cmd {
+		case "EHLO", "HELO":
+			c.PrintfLine("250 test")
+		case "DATA":
+			c.PrintfLine("354 go ahead")
+			data, err := c.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg, err := mail.ReadMessage(bytes.NewReader(data))
+			if err != nil {
+				c.PrintfLine("554 bad message")
+				continue
+			}
+			s.messages <- msg
+			c.PrintfLine("250 queued")
+		case "QUIT":
+			c.PrintfLine("221 bye")
+			return
+		default:
+			c.PrintfLine("250 ok")
+		}
+	}
+}
+
+// next waits for a message, returning its subject and decoded body
+func (s *testSMTP) next(t *testing.T) (*mail.Message, string, string) {
+	t.Helper()
+	select {
+	case msg := <-s.messages:
+		subject, _ := new(mime.WordDecoder).DecodeHeader(msg.Header.Get("Subject"))
+		body, err := ioutil.ReadAll(quotedprintable.NewReader(msg.Body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return msg, subject, string(body)
+	case <-time.After(5 * time.Second):
+		t.Fatal("no email was sent")
+	}
+	return nil, "", ""
+}
+
+var subscriptionLink = regexp.MustCompile(`https://board\.example/api/subscriptions/(confirm|unsubscribe)\?\S+`)
+
+// postSubscriptionLink follows a confirm or unsubscribe link from an email
+func postSubscriptionLink(t *testing.T, link string, key string) int {
+	u, err := url.Parse(link)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if key != "" {
+		q := u.Query()
+		q.Set("key", key)
+		u.RawQuery = q.Encode()
+	}
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", u.String(), nil)
+	if strings.Contains(u.Path, "/confirm") {
+		confirmSubscriptionHandler(w, r)
+	} else {
+		unsubscribeHandler(w, r)
+	}
+	return w.Code
+}
+
+func TestEmailSubscription(t *testing.T) {
+	setupTestServer(t)
+	smtp := newTestSMTP(t)
+	cfg.EnableNotify = true
+	cfg.SMTPAddr = smtp.ln.Addr().String()
+	cfg.SMTPFrom = "Board <board@example.com>"
+	cfg.NotifyBaseURL = "https://board.example"
+	events.subscribe("notifications", notifyEvents)
+
+	w := httptest.NewRecorder()
+	r := httptest.NewRequest("POST", "/api/subscriptions", strings.NewReader(`{"channel":"email","email":"sam@example.com","threshold":3,"quiet":{"start":"0:00","end":"0:00"}}`))
+	subscriptionsHandler(w, r)
+	if w.Code != http.StatusCreated {
+		t.Fatalf("subscribing answered %d: %s", w.Code, w.Body)
+	}
+
+	msg, subject, body := smtp.next(t)
+	if to := msg.Header.Get("To"); to != "sam@example.com" {
+		t.Errorf("confirmation went to %q", to)
+	}
+	if !strings.Contains(subject, "Confirm") || msg.Header.Get("List-Unsubscribe") != "" {
+		t.Errorf("confirmation has subject %q and List-Unsubscribe %q", subject, msg.Header.Get("List-Unsubscribe"))
+	}
+	confirm := subscriptionLink.FindString(body)
+	if !strings.Contains(confirm, "/confirm?") {
+		t.Fatalf("confirmation has no confirm link:\n%s", body)
+	}
+
+	// Nothing is sent before the address is confirmed
+	if _, _, err := updateLevel("operator", "", "", func(int) int { return 3 }); err != nil {
+		t.Fatal(err)
+	}
+	select {
+	case <-smtp.messages:
+		t.Fatal("an unconfirmed subscription was notified")
+	case <-time.After(200 * time.Millisecond):
+	}
+	updateLevel("operator", "", "", func(int) int { return 0 })
+
+	if code := postSubscriptionLink(t, confirm, "wrong"); code != http.StatusNotFound {
+		t.Errorf("confirming with the wrong code answered %d, want 404", code)
+	}
+	if code := postSubscriptionLink(t, confirm, ""); code != http.StatusOK {
+		t.Fatalf("confirming answered %d", code)
+	}
+
+	if _, _, err := updateLevel("operator", "", "Server fire", func(int) int { return 4 }); err != nil {
+		t.Fatal(err)
+	}
+	msg, subject, body = smtp.next(t)
+	if subject != "Level 4: Furious" || !strings.Contains(body, "Server fire") {
+		t.Errorf("notification has subject %q and body:\n%s", subject, body)
+	}
+	unsubscribe := strings.Trim(msg.Header.Get("List-Unsubscribe"), "<>")
+	if unsubscribe != subscriptionLink.FindString(body) {
+		t.Errorf("List-Unsubscribe is %q, want the link in the body", unsubscribe)
+	}
+
+	if code := postSubscriptionLink(t, unsubscribe, "wrong"); code != http.StatusNotFound {
+		t.Errorf("unsubscribing with the wrong key answered %d, want 404", code)
+	}
+	if code := postSubscriptionLink(t, unsubscribe, ""); code != http.StatusOK {
+		t.Errorf("unsubscribing answered %d", code)
+	}
+	if subs, err := store.Subscriptions(); err != nil || len(subs) != 0 {
+		t.Errorf("subscriptions left after unsubscribing: %v, %v", subs, err)
+	}
+}
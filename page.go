@@ -0,0 +1,366 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"github.com/go-playground/log"
+	"hash/fnv"
+	"html"
+	"html/template"
+	"net/http"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf8"
+)
+
+const (
+	siteName = "The Josh Mills Anger Advisory System"
+	// maxExcerptLength is how much of a level's description previews show
+	maxExcerptLength = 200
+)
+
+// pageTemplates are the pages in assetRoot rendered as templates, each is
+// parsed again whenever it changes on disk so the client can be edited
+// without a restart
+var pageTemplates = struct {
+	mu       sync.Mutex
+	tmpl     map[string]*template.Template
+	modified map[string]time.Time
+}{
+	tmpl:     map[string]*template.Template{},
+	modified: map[string]time.Time{},
+}
+
+func loadPageTemplate(name string) (*template.Template, time.Time, error) {
+	path := assetRoot + "/" + name
+	stat, err := os.Stat(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+
+	pageTemplates.mu.Lock()
+	defer pageTemplates.mu.Unlock()
+
+	if tmpl := pageTemplates.tmpl[name]; tmpl != nil && stat.ModTime().Equal(pageTemplates.modified[name]) {
+		return tmpl, pageTemplates.modified[name], nil
+	}
+
+	tmpl, err := template.ParseFiles(path)
+	if err != nil {
+		return nil, time.Time{}, err
+	}
+	pageTemplates.tmpl[name] = tmpl
+	pageTemplates.modified[name] = stat.ModTime()
+	return tmpl, stat.ModTime(), nil
+}
+
+// levelSnapshot is the current level and everything about it a page needs,
+// with the text in the request's locale
+type levelSnapshot struct {
+	Level      int
+	Event      int64
+	Reason     string
+	Locale     string
+	Definition levelDefinition
+	Pending    *pendingChange
+	Levels     levelSet
+}
+
+func currentSnapshot(r *http.Request) (levelSnapshot, error) {
+	levelMu.RLock()
+	snap := levelSnapshot{Level: level, Event: currentEvent(), Reason: levelReason, Pending: pendingLevel, Locale: cfg.DefaultLocale}
+	levelMu.RUnlock()
+
+	levels, err := store.Levels()
+	if err != nil {
+		return snap, err
+	}
+	snap.Locale = negotiateLocale(r, levels)
+	snap.Levels = levels.localized(snap.Locale)
+	snap.Definition = snap.Levels[snap.Level]
+	return snap, nil
+}
+
+// Heading is how previews title the current level, like "Level 3: High"
+func (s levelSnapshot) Heading() string {
+	if s.Definition.Title == "" {
+		return fmt.Sprintf("Level %d", s.Level)
+	}
+	return fmt.Sprintf("Level %d: %s", s.Level, s.Definition.Title)
+}
+
+// Excerpt is the start of the level's description as plain text, with the
+// reason for the change in front of it
+func (s levelSnapshot) Excerpt() string {
+	text := excerpt(s.Definition.Description)
+	if s.Reason != "" {
+		text = strings.TrimSpace(s.Reason + ". " + text)
+	}
+	return truncate(text, maxExcerptLength)
+}
+
+// Color is the level's background, or the fallback when it isn't a color
+func (s levelSnapshot) Color() string {
+	if _, _, _, ok := parseHexColor(s.Definition.Background); !ok {
+		return badgeFallbackColor
+	}
+	return s.Definition.Background
+}
+
+var (
+	tagRe   = regexp.MustCompile(`<[^>]*>`)
+	blockRe = regexp.MustCompile(`(?i)</p>|<br\s*/?>`)
+)
+
+// excerpt turns a level description's HTML into one line of plain text
+func excerpt(s string) string {
+	s = blockRe.ReplaceAllString(s, " ")
+	s = html.UnescapeString(tagRe.ReplaceAllString(s, ""))
+	return strings.Join(strings.Fields(s), " ")
+}
+
+func truncate(s string, n int) string {
+	if utf8.RuneCountInString(s) <= n {
+		return s
+	}
+	return strings.TrimSpace(string([]rune(s)[:n-1])) + "…"
+}
+
+// baseURL is the board's address as the client sees it
+func baseURL(r *http.Request) string {
+	return requestScheme(r) + "://" + r.Host
+}
+
+// PendingTitle is the title of the level a pending change is asking for
+func (s levelSnapshot) PendingTitle() string {
+	if s.Pending == nil {
+		return ""
+	}
+	if title := s.Levels[s.Pending.Level].Title; title != "" {
+		return title
+	}
+	return fmt.Sprintf("level %d", s.Pending.Level)
+}
+
+// pageLevel is one item of the chart. Titles and descriptions come from
+// levels.json, which is trusted to hold HTML.
+type pageLevel struct {
+	Number      int
+	Background  string
+	Title       template.HTML
+	Description template.HTML
+	Current     bool
+}
+
+// Chart is every level, lowest first, the client stacks them bottom up
+func (s levelSnapshot) Chart() []pageLevel {
+	out := []pageLevel{}
+	for _, n := range s.Levels.sortedLevels() {
+		def := s.Levels[n]
+		out = append(out, pageLevel{
+			Number:      n,
+			Background:  def.Background,
+			Title:       template.HTML(def.Title),
+			Description: template.HTML(def.Description),
+			Current:     n == s.Level,
+		})
+	}
+	return out
+}
+
+// pageData is what client/index.html is rendered with
+type pageData struct {
+	levelSnapshot
+	SiteName  string
+	URL       string
+	ImageURL  string
+	OEmbedURL string
+	// Refresh, when set, reloads the page every so many seconds for
+	// displays without JavaScript
+	Refresh int
+	// Notifications is which ways of subscribing the page offers
+	Notifications *notifyChannels
+}
+
+const (
+	minPageRefresh = 5
+	maxPageRefresh = 3600
+)
+
+// serveIndex renders the whole board, with preview metadata for the current
+// level so link unfurls show the real status. The page works without
+// JavaScript, the client script only keeps it live.
+func serveIndex(w http.ResponseWriter, r *http.Request) {
+	snap, err := currentSnapshot(r)
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+	}
+	setLocaleHeaders(w, snap.Locale)
+
+	base := baseURL(r)
+	data := pageData{
+		levelSnapshot: snap,
+		SiteName:      siteName,
+		URL:           base + "/",
+		OEmbedURL:     base + "/oembed?format=json&url=" + url.QueryEscape(base+"/"),
+		Notifications: enabledNotifyChannels(),
+	}
+	if cfg.EnableBadges {
+		data.ImageURL = base + "/status.png?scale=4"
+	}
+	if refresh, err := strconv.Atoi(r.URL.Query().Get("refresh")); err == nil && refresh > 0 {
+		if refresh < minPageRefresh {
+			refresh = minPageRefresh
+		}
+		if refresh > maxPageRefresh {
+			refresh = maxPageRefresh
+		}
+		data.Refresh = refresh
+	}
+
+	servePage(w, r, "index.html", data, "/static/style.css", "/static/josh.png")
+}
+
+// servePage renders the page template name with data, pushing the assets in
+// push. The ETag covers the template and everything it's rendered from, so
+// clients revalidate cheaply until the level changes.
+func servePage(w http.ResponseWriter, r *http.Request, name string, data interface{}, push ...string) {
+	tmpl, modified, err := loadPageTemplate(name)
+	if err != nil {
+		log.Errorf("Could not load %s: %s", name, err.Error())
+		http.Error(w, "Could not read file", http.StatusInternalServerError)
+		return
+	}
+
+	h := fnv.New32a()
+	json.NewEncoder(h).Encode(data)
+	etag := fmt.Sprintf(`"%d.%08x"`, modified.Unix(), h.Sum32())
+
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("ETag", etag)
+	if etagMatches(r, etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	var buf bytes.Buffer
+	if err := tmpl.Execute(&buf, data); err != nil {
+		log.Errorf("Could not render %s: %s", name, err.Error())
+		w.Header().Del("ETag")
+		http.Error(w, "Could not render page", http.StatusInternalServerError)
+		return
+	}
+
+	if cfg.EnableServerPush {
+		if pusher, ok := w.(http.Pusher); ok {
+			for _, asset := range push {
+				if err := pusher.Push(asset, nil); err != nil {
+					log.Warnf("Failed to push: %v", err)
+				}
+			}
+		}
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Write(buf.Bytes())
+}
+
+// oembedResponse is an oEmbed response, https://oembed.com/
+type oembedResponse struct {
+	Type            string `json:"type"`
+	Version         string `json:"version"`
+	Title           string `json:"title"`
+	ProviderName    string `json:"provider_name"`
+	ProviderURL     string `json:"provider_url"`
+	CacheAge        int    `json:"cache_age"`
+	HTML            string `json:"html,omitempty"`
+	Width           int    `json:"width,omitempty"`
+	Height          int    `json:"height,omitempty"`
+	ThumbnailURL    string `json:"thumbnail_url,omitempty"`
+	ThumbnailWidth  int    `json:"thumbnail_width,omitempty"`
+	ThumbnailHeight int    `json:"thumbnail_height,omitempty"`
+}
+
+// oembedHandler describes the board for link unfurls. Only the board's own
+// URLs are answered, and only as JSON.
+func oembedHandler(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	if format := query.Get("format"); format != "" && format != "json" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusNotImplemented)
+		w.Write([]byte("only the json format is supported"))
+		return
+	}
+
+	target, err := url.Parse(query.Get("url"))
+	if err != nil || !strings.EqualFold(target.Host, r.Host) {
+		http.NotFound(w, r)
+		return
+	}
+
+	snap, err := currentSnapshot(r)
+	if err != nil {
+		log.Errorf("Could not load levels: %s", err.Error())
+		http.Error(w, "could not load levels", http.StatusInternalServerError)
+		return
+	}
+	setLocaleHeaders(w, snap.Locale)
+
+	base := baseURL(r)
+	resp := oembedResponse{
+		Type:         "link",
+		Version:      "1.0",
+		Title:        snap.Heading(),
+		ProviderName: siteName,
+		ProviderURL:  base + "/",
+		CacheAge:     60,
+	}
+
+	// With badges the embed is the badge, linking back to the board
+	if cfg.EnableBadges {
+		b := snap.badge()
+		labelWidth, messageWidth := b.svgWidths()
+		resp.Type = "rich"
+		resp.Width = labelWidth + messageWidth
+		resp.Height = badgeHeight
+		resp.HTML = fmt.Sprintf(`<a href="%s"><img src="%s" alt="%s" width="%d" height="%d"></a>`,
+			html.EscapeString(base+"/"), html.EscapeString(base+"/badge.svg"), html.EscapeString(snap.Heading()), resp.Width, resp.Height)
+
+		labelWidth, messageWidth = b.pngWidths()
+		resp.ThumbnailURL = base + "/status.png?scale=4"
+		resp.ThumbnailWidth = (labelWidth + messageWidth) * 4
+		resp.ThumbnailHeight = badgeHeight * 4
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-cache")
+	j, _ := json.Marshal(resp)
+	w.Write(j)
+}
@@ -0,0 +1,112 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// presence is who's watching the board: how many anonymous viewers and
+// kiosk displays there are, and the notes of every operator with an
+// authenticated socket
+type presence struct {
+	Viewers   int      `json:"viewers"`
+	Kiosks    int      `json:"kiosks"`
+	Operators []string `json:"operators"`
+}
+
+// presenceMaxWait is how many sockets.presence_debounce a steady stream of
+// joins and leaves can hold presence back for
+const presenceMaxWait = 5
+
+var presenceTimer = struct {
+	mu    sync.Mutex
+	timer *time.Timer
+	// deadline is when the pending update goes out however busy it is
+	deadline time.Time
+	// generation counts timers, so one that fired while being replaced
+	// knows it's stale
+	generation uint64
+}{}
+
+// schedulePresence publishes presence once things have been quiet for
+// sockets.presence_debounce, so a burst of joins is one message, but never
+// later than presenceMaxWait debounces after the first change. In a cluster
+// it's everyone watching on every node.
+func schedulePresence() {
+	if !cfg.EnablePresence {
+		return
+	}
+
+	presenceTimer.mu.Lock()
+	defer presenceTimer.mu.Unlock()
+
+	wait := cfg.PresenceDebounce
+	if presenceTimer.timer != nil {
+		presenceTimer.timer.Stop()
+		if untilDeadline := time.Until(presenceTimer.deadline); untilDeadline < wait {
+			wait = untilDeadline
+		}
+	} else {
+		presenceTimer.deadline = time.Now().Add(presenceMaxWait * cfg.PresenceDebounce)
+	}
+
+	presenceTimer.generation++
+	generation := presenceTimer.generation
+	presenceTimer.timer = time.AfterFunc(wait, func() {
+		presenceTimer.mu.Lock()
+		if presenceTimer.generation != generation {
+			presenceTimer.mu.Unlock()
+			return
+		}
+		presenceTimer.timer = nil
+		presenceTimer.mu.Unlock()
+
+		events.publish(presenceChanged{Presence: clusterPresenceTotal(webSocketPool.presence())})
+	})
+}
+
+func (p *socketConnectionPool) presence() presence {
+	p.mu.RLock()
+	defer p.mu.RUnlock()
+
+	out := presence{Operators: []string{}}
+	seen := map[string]bool{}
+	for _, c := range p.connections {
+		note := c.operator()
+		if c.kind == socketKindKiosk && note == "" {
+			out.Kiosks++
+			continue
+		}
+		if note == "" {
+			out.Viewers++
+			continue
+		}
+		if !seen[note] {
+			seen[note] = true
+			out.Operators = append(out.Operators, note)
+		}
+	}
+	sort.Strings(out.Operators)
+	return out
+}
@@ -0,0 +1,154 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"github.com/go-playground/log"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+var trustedProxies = []*net.IPNet{}
+
+// parseTrustedProxies turns the proxy.trusted list of IPs and CIDRs into
+// networks, a bare IP is treated as a single-address network
+func parseTrustedProxies(list []string) ([]*net.IPNet, error) {
+	out := []*net.IPNet{}
+	for _, s := range list {
+		if !strings.Contains(s, "/") {
+			ip := net.ParseIP(s)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid proxy.trusted address %q", s)
+			}
+			bits := 32
+			if ip.To4() == nil {
+				bits = 128
+			}
+			out = append(out, &net.IPNet{IP: ip, Mask: net.CIDRMask(bits, bits)})
+			continue
+		}
+
+		_, n, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, fmt.Errorf("invalid proxy.trusted network %q", s)
+		}
+		out = append(out, n)
+	}
+	return out, nil
+}
+
+func isTrustedProxy(ip net.IP) bool {
+	if ip == nil || cfg.TLSMode != "none" {
+		return false
+	}
+	for _, n := range trustedProxies {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+func remoteIP(r *http.Request) net.IP {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return net.ParseIP(host)
+}
+
+// clientIP returns the address of the client that made r. When r came from a
+// trusted proxy, X-Forwarded-For is walked from the right and the first
+// address that isn't itself a trusted proxy is the client.
+func clientIP(r *http.Request) string {
+	ip := remoteIP(r)
+	if !isTrustedProxy(ip) {
+		if ip == nil {
+			return r.RemoteAddr
+		}
+		return ip.String()
+	}
+
+	hops := strings.Split(strings.Join(r.Header["X-Forwarded-For"], ","), ",")
+	for i := len(hops) - 1; i >= 0; i-- {
+		hop := net.ParseIP(strings.TrimSpace(hops[i]))
+		if hop == nil {
+			break
+		}
+		ip = hop
+		if !isTrustedProxy(hop) {
+			break
+		}
+	}
+	return ip.String()
+}
+
+// requestScheme is the scheme the client used to reach us, which is only
+// different from the connection's own scheme behind a trusted proxy
+func requestScheme(r *http.Request) string {
+	if r.TLS != nil {
+		return "https"
+	}
+
+	if isTrustedProxy(remoteIP(r)) {
+		proto := strings.ToLower(strings.TrimSpace(strings.Split(r.Header.Get("X-Forwarded-Proto"), ",")[0]))
+		if proto == "https" || proto == "http" {
+			return proto
+		}
+	}
+	return "http"
+}
+
+// loggedURI is the request URI with the secrets that can be in a query,
+// tokens for the calendar feed and keys for subscriptions, redacted
+func loggedURI(u *url.URL) string {
+	query := u.Query()
+	redacted := false
+	for _, name := range []string{"token", "key"} {
+		if value := query.Get(name); value != "" {
+			query.Set(name, redactToken(value))
+			redacted = true
+		}
+	}
+	if !redacted {
+		return u.RequestURI()
+	}
+	return u.EscapedPath() + "?" + query.Encode()
+}
+
+// proxyHandler logs each request with its real client address and, when
+// proxy.force_https is set, redirects requests that reached the proxy over
+// plain HTTP
+func proxyHandler(h http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		log.Debugf("%s %s %s://%s%s", clientIP(r), r.Method, requestScheme(r), r.Host, loggedURI(r.URL))
+
+		if cfg.ForceHTTPS && requestScheme(r) != "https" {
+			httpRedirectHandler(w, r)
+			return
+		}
+
+		h.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,246 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a set of token buckets, one per key, each refilling at
+// perMinute and holding at most burst
+type rateLimiter struct {
+	mu        sync.Mutex
+	perMinute int
+	burst     int
+	buckets   map[string]*bucket
+	lastSweep time.Time
+}
+
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(perMinute, burst int) *rateLimiter {
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{
+		perMinute: perMinute,
+		burst:     burst,
+		buckets:   map[string]*bucket{},
+		lastSweep: time.Now(),
+	}
+}
+
+// allow takes one token from key's bucket, when there are none left it
+// returns false and how long until there will be. A limiter with perMinute
+// of 0 allows everything.
+func (l *rateLimiter) allow(key string) (bool, time.Duration) {
+	if l == nil || l.perMinute <= 0 {
+		return true, 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	perSecond := float64(l.perMinute) / 60
+	l.sweep(now, perSecond)
+
+	b, exists := l.buckets[key]
+	if !exists {
+		b = &bucket{tokens: float64(l.burst), last: now}
+		l.buckets[key] = b
+	}
+
+	b.tokens = math.Min(float64(l.burst), b.tokens+now.Sub(b.last).Seconds()*perSecond)
+	b.last = now
+
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / perSecond * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// sweep drops buckets that have refilled completely, they're the same as
+// a missing bucket
+func (l *rateLimiter) sweep(now time.Time, perSecond float64) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	full := time.Duration(float64(l.burst) / perSecond * float64(time.Second))
+	for k, b := range l.buckets {
+		if now.Sub(b.last) > full {
+			delete(l.buckets, k)
+		}
+	}
+}
+
+// authLockout locks out addresses that keep failing to authenticate. After
+// threshold failures each further failure doubles the lockout, starting at
+// base and capped at max. An address that stays quiet for max is forgiven.
+type authLockout struct {
+	mu        sync.Mutex
+	threshold int
+	base      time.Duration
+	max       time.Duration
+	addrs     map[string]*lockoutState
+	lastSweep time.Time
+}
+
+type lockoutState struct {
+	failures int
+	until    time.Time
+	last     time.Time
+}
+
+func newAuthLockout(threshold int, base, maxLockout time.Duration) *authLockout {
+	return &authLockout{
+		threshold: threshold,
+		base:      base,
+		max:       maxLockout,
+		addrs:     map[string]*lockoutState{},
+		lastSweep: time.Now(),
+	}
+}
+
+// lockedFor returns how much longer addr is locked out for
+func (l *authLockout) lockedFor(addr string) time.Duration {
+	if l == nil || l.threshold <= 0 {
+		return 0
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	state, exists := l.addrs[addr]
+	if !exists {
+		return 0
+	}
+	if remaining := time.Until(state.until); remaining > 0 {
+		return remaining
+	}
+	return 0
+}
+
+func (l *authLockout) fail(addr string) {
+	if l == nil || l.threshold <= 0 {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	state, exists := l.addrs[addr]
+	if !exists || now.Sub(state.last) > l.max {
+		state = &lockoutState{}
+		l.addrs[addr] = state
+	}
+
+	state.failures++
+	state.last = now
+	if state.failures < l.threshold {
+		return
+	}
+
+	wait := l.max
+	if shift := uint(state.failures - l.threshold); shift < 32 {
+		if d := l.base << shift; d > 0 && d < l.max {
+			wait = d
+		}
+	}
+	state.until = now.Add(wait)
+}
+
+func (l *authLockout) succeed(addr string) {
+	if l == nil {
+		return
+	}
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.addrs, addr)
+}
+
+func (l *authLockout) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < time.Minute {
+		return
+	}
+	l.lastSweep = now
+
+	for k, state := range l.addrs {
+		if now.Sub(state.last) > l.max && now.After(state.until) {
+			delete(l.addrs, k)
+		}
+	}
+}
+
+var (
+	ipLimiter          *rateLimiter
+	tokenLimiter       *rateLimiter
+	levelChangeLimiter *rateLimiter
+	lockout            *authLockout
+)
+
+func setupRateLimits() {
+	ipLimiter = newRateLimiter(cfg.IPPerMinute, cfg.IPBurst)
+	tokenLimiter = newRateLimiter(cfg.TokenPerMinute, cfg.TokenBurst)
+	levelChangeLimiter = newRateLimiter(cfg.LevelChangesPerMinute, cfg.LevelChangesPerMinute)
+	reactionLimiter = newRateLimiter(cfg.ReactionsPerMinute, cfg.ReactionsBurst)
+	lockout = newAuthLockout(cfg.LockoutThreshold, cfg.LockoutBase, cfg.LockoutMax)
+}
+
+func writeTooManyRequests(w http.ResponseWriter, retry time.Duration, msg string) {
+	seconds := int(math.Ceil(retry.Seconds()))
+	if seconds < 1 {
+		seconds = 1
+	}
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Header().Set("Retry-After", strconv.Itoa(seconds))
+	w.WriteHeader(http.StatusTooManyRequests)
+	w.Write([]byte(fmt.Sprintf("%s, retry in %ds", msg, seconds)))
+}
+
+// limitMutations applies the per-address rate limit to a handler that
+// changes state
+func limitMutations(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if ok, retry := ipLimiter.allow(clientIP(r)); !ok {
+			writeTooManyRequests(w, retry, "too many requests")
+			return
+		}
+
+		h(w, r)
+	}
+}
@@ -0,0 +1,180 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/go-playground/log"
+	"sync"
+	"time"
+)
+
+// maxReactionLength keeps reactions to an emoji or a short word
+const maxReactionLength = 16
+
+// reactions are the counts for the current level-change event. Each address
+// can send each reaction once per event, so reconnecting doesn't allow
+// another, on top of the per-address limit.
+var reactions = struct {
+	mu    sync.Mutex
+	event int64
+	// key is the event's name across a cluster, see serverState.EventKey
+	key    string
+	counts map[string]int
+	sent   map[string]map[string]bool
+}{
+	counts: map[string]int{},
+	sent:   map[string]map[string]bool{},
+}
+
+var reactionLimiter *rateLimiter
+
+func isAllowedReaction(reaction string) bool {
+	for _, r := range cfg.ReactionsAllowed {
+		if r == reaction {
+			return true
+		}
+	}
+	return false
+}
+
+// currentEvent is the history entry viewers are reacting to, 0 before the
+// level has ever changed
+func currentEvent() int64 {
+	reactions.mu.Lock()
+	defer reactions.mu.Unlock()
+	return reactions.event
+}
+
+// resetReactions starts counting for a new event
+func resetReactions(event int64, key string, counts map[string]int) {
+	reactions.mu.Lock()
+	defer reactions.mu.Unlock()
+
+	reactions.event = event
+	reactions.key = key
+	reactions.counts = map[string]int{}
+	for k, v := range counts {
+		reactions.counts[k] = v
+	}
+	reactions.sent = map[string]map[string]bool{}
+}
+
+// loadReactions picks the counts for event back up from the history, so a
+// restart doesn't reset them
+func loadReactions(event int64, key string) error {
+	var counts map[string]int
+	if event > 0 {
+		err := store.History(time.Time{}, time.Time{}, func(entry historyEntry) error {
+			if entry.ID == event {
+				counts = entry.Reactions
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	resetReactions(event, key, counts)
+	return nil
+}
+
+func reactionsMessage() *socketMessage {
+	reactions.mu.Lock()
+	defer reactions.mu.Unlock()
+	return reactionsChangedLocked().message()
+}
+
+// reactionsChangedLocked copies the current counts, reactions.mu must be
+// held
+func reactionsChangedLocked() reactionsChanged {
+	counts := map[string]int{}
+	for k, v := range reactions.counts {
+		counts[k] = v
+	}
+	return reactionsChanged{Event: reactions.event, Key: reactions.key, Counts: counts}
+}
+
+func (e reactionsChanged) message() *socketMessage {
+	return &socketMessage{Type: "reactions", Data: map[string]interface{}{
+		"event":     e.Event,
+		"reactions": e.Counts,
+		"allowed":   cfg.ReactionsAllowed,
+	}}
+}
+
+// react counts reaction from c against event, which has to be the current
+// one. Accepted reactions are saved with the history entry and published.
+func (c *socketConnection) react(event int64, reaction string) error {
+	if !isAllowedReaction(reaction) {
+		return fmt.Errorf("unknown reaction")
+	}
+
+	reactions.mu.Lock()
+	defer reactions.mu.Unlock()
+
+	if reactions.event == 0 {
+		return fmt.Errorf("there is nothing to react to yet")
+	}
+	if event != 0 && event != reactions.event {
+		return fmt.Errorf("the level has changed since")
+	}
+	if reactions.sent[c.remoteAddr][reaction] {
+		return fmt.Errorf("already reacted")
+	}
+	if ok, _ := reactionLimiter.allow(c.remoteAddr); !ok {
+		return fmt.Errorf("too many reactions, slow down")
+	}
+
+	reactions.counts[reaction]++
+	if err := store.SetHistoryReactions(reactions.event, reactions.counts); err != nil {
+		reactions.counts[reaction]--
+		log.Errorf("Could not save reactions: %s", err.Error())
+		return fmt.Errorf("could not save reaction")
+	}
+
+	if reactions.sent[c.remoteAddr] == nil {
+		reactions.sent[c.remoteAddr] = map[string]bool{}
+	}
+	reactions.sent[c.remoteAddr][reaction] = true
+
+	changed := reactionsChangedLocked()
+	changed.Reaction = reaction
+	events.publish(changed)
+	return nil
+}
+
+func handleSocketReact(c *socketConnection, data json.RawMessage) {
+	react := struct {
+		Event    int64  `json:"event"`
+		Reaction string `json:"reaction"`
+	}{}
+	json.Unmarshal(data, &react)
+
+	reply := map[string]interface{}{"ok": true}
+	if !cfg.EnableReactions {
+		reply = map[string]interface{}{"ok": false, "error": "reactions are disabled"}
+	} else if err := c.react(react.Event, react.Reaction); err != nil {
+		reply = map[string]interface{}{"ok": false, "error": err.Error()}
+	}
+	c.reply(&socketMessage{Type: "react", Data: reply})
+}
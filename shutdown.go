@@ -0,0 +1,195 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"github.com/go-playground/log"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// listeners holds every socket the server is accepting on, keyed by the
+// address it was configured with, so they can be handed to a new process
+var listeners = struct {
+	mu    sync.Mutex
+	addrs []string
+	byKey map[string]net.Listener
+}{byKey: map[string]net.Listener{}}
+
+// listenOn returns a listener for addr, reusing one inherited from a parent
+// process through JMAAS_LISTEN_FDS ("addr=fd,addr=fd") when there is one
+func listenOn(addr string) (net.Listener, error) {
+	var (
+		l   net.Listener
+		err error
+	)
+
+	if fd, ok := inheritedFD(addr); ok {
+		f := os.NewFile(uintptr(fd), addr)
+		l, err = net.FileListener(f)
+		f.Close()
+		if err != nil {
+			return nil, fmt.Errorf("could not use inherited listener for %s: %s", addr, err.Error())
+		}
+		log.Infof("Inherited listener for %s", addr)
+	} else {
+		l, err = net.Listen("tcp", addr)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+	listeners.addrs = append(listeners.addrs, addr)
+	listeners.byKey[addr] = l
+	return l, nil
+}
+
+func inheritedFD(addr string) (int, bool) {
+	for _, pair := range strings.Split(os.Getenv("JMAAS_LISTEN_FDS"), ",") {
+		eq := strings.LastIndex(pair, "=")
+		if eq < 0 || pair[:eq] != addr {
+			continue
+		}
+		fd, err := strconv.Atoi(pair[eq+1:])
+		if err != nil {
+			return 0, false
+		}
+		return fd, true
+	}
+	return 0, false
+}
+
+// serve runs srv on l until it is shut down, anything other than a clean
+// shutdown is fatal
+func serve(srv *http.Server, l net.Listener, useTLS bool) {
+	var err error
+	if useTLS {
+		err = srv.ServeTLS(l, "", "")
+	} else {
+		err = srv.Serve(l)
+	}
+	if err != http.ErrServerClosed {
+		log.Fatal(err)
+	}
+}
+
+// waitForShutdown blocks until the process is asked to stop, then stops
+// accepting connections, disconnects from MQTT, tells every socket we're
+// restarting, drains in-flight requests until timeouts.shutdown, and closes
+// the store. A handoff signal first starts a replacement process on the same
+// sockets and waits for it to be serving.
+func waitForShutdown(servers ...*http.Server) {
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, append([]os.Signal{os.Interrupt, syscall.SIGTERM}, handoffSignals...)...)
+
+	for s := range sig {
+		if isHandoffSignal(s) {
+			if err := handoff(); err != nil {
+				log.Errorf("Could not hand off listeners, staying up: %s", err.Error())
+				continue
+			}
+		}
+		log.Infof("Got %s, shutting down", s)
+		break
+	}
+	signal.Stop(sig)
+
+	ctx, cancel := context.WithTimeout(context.Background(), cfg.ShutdownTimeout)
+	defer cancel()
+
+	wg := sync.WaitGroup{}
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(srv *http.Server) {
+			defer wg.Done()
+			if err := srv.Shutdown(ctx); err != nil {
+				log.Warnf("Server on %s did not drain in time: %s", srv.Addr, err.Error())
+			}
+		}(srv)
+	}
+
+	mqtt.stop()
+	stopCluster()
+	webSocketPool.closeAll("server restarting")
+	if err := webSocketPool.wait(ctx); err != nil {
+		log.Warnf("Sockets did not close in time: %s", err.Error())
+	}
+	wg.Wait()
+
+	if err := events.drain(ctx); err != nil {
+		log.Warnf("Events were not all delivered in time: %s", err.Error())
+	}
+	if err := store.Close(); err != nil {
+		log.Errorf("Could not close store: %s", err.Error())
+	}
+	unlockDataDir()
+
+	log.Info("Shutdown complete")
+}
+
+func isHandoffSignal(s os.Signal) bool {
+	for _, h := range handoffSignals {
+		if s == h {
+			return true
+		}
+	}
+	return false
+}
+
+// listenerFiles duplicates every listener's socket so it can be passed to a
+// child process, returning the files in order along with JMAAS_LISTEN_FDS
+func listenerFiles() ([]*os.File, string, error) {
+	listeners.mu.Lock()
+	defer listeners.mu.Unlock()
+
+	files := []*os.File{}
+	pairs := []string{}
+	for i, addr := range listeners.addrs {
+		fl, ok := listeners.byKey[addr].(interface {
+			File() (*os.File, error)
+		})
+		if !ok {
+			return nil, "", fmt.Errorf("listener for %s can not be handed off", addr)
+		}
+
+		f, err := fl.File()
+		if err != nil {
+			for _, f := range files {
+				f.Close()
+			}
+			return nil, "", err
+		}
+		files = append(files, f)
+		// ExtraFiles start at fd 3 in the child
+		pairs = append(pairs, fmt.Sprintf("%s=%d", addr, i+3))
+	}
+	return files, strings.Join(pairs, ","), nil
+}
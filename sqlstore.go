@@ -0,0 +1,541 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"math"
+	"os"
+	"time"
+)
+
+// sqlStore keeps everything in a SQL database. Level definitions, state, and
+// log entries are stored as JSON so new fields don't need a migration.
+type sqlStore struct {
+	db *sql.DB
+}
+
+const (
+	// sqliteOptions has readers work alongside the one writer (WAL),
+	// writers wait their turn rather than failing, and transactions take
+	// the write lock up front so two can't deadlock upgrading to it
+	sqliteOptions = "?_pragma=journal_mode(WAL)&_pragma=busy_timeout(5000)&_txlock=immediate"
+	// sqlMaxConns lets a few reads run while another request writes
+	sqlMaxConns = 4
+	// sqlPageSize is how many log entries are read per query. Logs are
+	// read a page at a time so a slow reader, like an export to a slow
+	// client, never holds a connection for long.
+	sqlPageSize = 500
+)
+
+// sqlMigrations upgrade the schema one version at a time, each runs in its
+// own transaction along with the bump of schema_version
+var sqlMigrations = [][]string{
+	// 1: initial schema
+	{
+		`CREATE TABLE tokens (token TEXT PRIMARY KEY, level INTEGER NOT NULL, note TEXT NOT NULL, role TEXT NOT NULL)`,
+		`CREATE TABLE levels (level INTEGER PRIMARY KEY, definition TEXT NOT NULL)`,
+		`CREATE TABLE state (id INTEGER PRIMARY KEY CHECK (id = 1), data TEXT NOT NULL)`,
+		`CREATE TABLE history (id INTEGER PRIMARY KEY AUTOINCREMENT, time INTEGER NOT NULL, data TEXT NOT NULL)`,
+		`CREATE INDEX history_time ON history (time)`,
+		`CREATE TABLE audit (id INTEGER PRIMARY KEY AUTOINCREMENT, time INTEGER NOT NULL, data TEXT NOT NULL)`,
+		`CREATE INDEX audit_time ON audit (time)`,
+	},
+	// 2: reactions to level changes
+	{
+		`ALTER TABLE history ADD COLUMN reactions TEXT`,
+	},
+	// 3: notification subscriptions
+	{
+		`CREATE TABLE subscriptions (id TEXT PRIMARY KEY, created INTEGER NOT NULL, data TEXT NOT NULL)`,
+	},
+}
+
+// hasSQLDriver reports whether the driver was linked into this build
+func hasSQLDriver(driver string) bool {
+	for _, d := range sql.Drivers() {
+		if d == driver {
+			return true
+		}
+	}
+	return false
+}
+
+func openSQLStore(driver, dsn string) (*sqlStore, error) {
+	if !hasSQLDriver(driver) {
+		return nil, fmt.Errorf("this build has no %s driver, rebuild with -tags %s", driver, driver)
+	}
+
+	db, err := sql.Open(driver, dsn+sqliteOptions)
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(sqlMaxConns)
+
+	s := &sqlStore{db: db}
+	if err := s.migrate(); err != nil {
+		db.Close()
+		return nil, fmt.Errorf("could not migrate %s: %s", dsn, err.Error())
+	}
+
+	if err := s.seedLevels(); err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return s, nil
+}
+
+// sqlStoreCurrent reports whether opening the database won't migrate it
+func sqlStoreCurrent(driver, dsn string) (bool, error) {
+	if _, err := os.Stat(dsn); os.IsNotExist(err) {
+		return false, nil
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return false, err
+	}
+	defer db.Close()
+
+	version := 0
+	if err := db.QueryRow(`SELECT version FROM schema_version`).Scan(&version); err != nil {
+		// No schema_version table yet is a database that needs migrating
+		return false, nil
+	}
+	return version >= len(sqlMigrations), nil
+}
+
+func (s *sqlStore) migrate() error {
+	if _, err := s.db.Exec(`CREATE TABLE IF NOT EXISTS schema_version (version INTEGER NOT NULL)`); err != nil {
+		return err
+	}
+
+	version := 0
+	err := s.db.QueryRow(`SELECT version FROM schema_version`).Scan(&version)
+	if err == sql.ErrNoRows {
+		if _, err := s.db.Exec(`INSERT INTO schema_version (version) VALUES (0)`); err != nil {
+			return err
+		}
+	} else if err != nil {
+		return err
+	}
+
+	if version > len(sqlMigrations) {
+		return fmt.Errorf("database is at version %d, this build only knows %d", version, len(sqlMigrations))
+	}
+
+	for ; version < len(sqlMigrations); version++ {
+		tx, err := s.db.Begin()
+		if err != nil {
+			return err
+		}
+		for _, stmt := range sqlMigrations[version] {
+			if _, err := tx.Exec(stmt); err != nil {
+				tx.Rollback()
+				return fmt.Errorf("migration %d: %s", version+1, err.Error())
+			}
+		}
+		if _, err := tx.Exec(`UPDATE schema_version SET version = ?`, version+1); err != nil {
+			tx.Rollback()
+			return err
+		}
+		if err := tx.Commit(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// seedLevels copies levels.json from the data directory into an empty
+// database, so switching backends keeps the chart
+func (s *sqlStore) seedLevels() error {
+	count := 0
+	if err := s.db.QueryRow(`SELECT COUNT(*) FROM levels`).Scan(&count); err != nil || count > 0 {
+		return err
+	}
+
+	levels, err := readLevelsFile(dataPath("levels.json"))
+	if os.IsNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return s.SetLevels(levels)
+}
+
+func (s *sqlStore) Tokens() (tokenList, error) {
+	rows, err := s.db.Query(`SELECT token, level, note, role FROM tokens`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	tokens := tokenList{}
+	for rows.Next() {
+		var (
+			token string
+			attr  tokenAttr
+		)
+		if err := rows.Scan(&token, &attr.Level, &attr.Note, &attr.Role); err != nil {
+			return nil, err
+		}
+		tokens[token] = attr
+	}
+	return tokens, rows.Err()
+}
+
+func (s *sqlStore) Token(token string) (tokenAttr, bool, error) {
+	attr := tokenAttr{}
+	err := s.db.QueryRow(`SELECT level, note, role FROM tokens WHERE token = ?`, token).Scan(&attr.Level, &attr.Note, &attr.Role)
+	if err == sql.ErrNoRows {
+		return attr, false, nil
+	}
+	return attr, err == nil, err
+}
+
+func (s *sqlStore) PutToken(token string, attr tokenAttr) error {
+	_, err := s.db.Exec(`INSERT OR REPLACE INTO tokens (token, level, note, role) VALUES (?, ?, ?, ?)`, token, attr.Level, attr.Note, attr.Role)
+	return err
+}
+
+func (s *sqlStore) DeleteToken(token string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM tokens WHERE token = ?`, token)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func (s *sqlStore) Levels() (levelSet, error) {
+	rows, err := s.db.Query(`SELECT level, definition FROM levels`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	levels := levelSet{}
+	for rows.Next() {
+		var (
+			n    int
+			data string
+			def  levelDefinition
+		)
+		if err := rows.Scan(&n, &data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &def); err != nil {
+			return nil, err
+		}
+		levels[n] = def
+	}
+	return levels, rows.Err()
+}
+
+func (s *sqlStore) SetLevels(levels levelSet) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+
+	if _, err := tx.Exec(`DELETE FROM levels`); err != nil {
+		tx.Rollback()
+		return err
+	}
+	for n, def := range levels {
+		data, err := json.Marshal(def)
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+		if _, err := tx.Exec(`INSERT INTO levels (level, definition) VALUES (?, ?)`, n, string(data)); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) State() (serverState, error) {
+	state := serverState{}
+	data := ""
+	err := s.db.QueryRow(`SELECT data FROM state WHERE id = 1`).Scan(&data)
+	if err == sql.ErrNoRows {
+		return state, nil
+	}
+	if err != nil {
+		return state, err
+	}
+	return state, json.Unmarshal([]byte(data), &state)
+}
+
+func (s *sqlStore) SetState(state serverState) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO state (id, data) VALUES (1, ?)`, string(data))
+	return err
+}
+
+func (s *sqlStore) AppendHistory(entry historyEntry) (int64, error) {
+	entry.Reactions = nil
+	return s.appendLog("history", entry.Time, entry)
+}
+
+func (s *sqlStore) DeleteLastHistory(id int64) error {
+	_, err := s.db.Exec(`DELETE FROM history WHERE id = ?`, id)
+	return err
+}
+
+func (s *sqlStore) History(from, to time.Time, fn func(historyEntry) error) error {
+	lo, hi := timeBounds(from, to)
+	for after := int64(0); ; {
+		page := make([]historyEntry, 0, sqlPageSize)
+		err := s.queryRows(func(rows *sql.Rows) error {
+			entry, err := scanHistoryEntry(rows)
+			page = append(page, entry)
+			return err
+		}, `SELECT id, data, reactions FROM history WHERE time >= ? AND time < ? AND id > ? ORDER BY id LIMIT ?`, lo, hi, after, sqlPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, entry := range page {
+			if err := fn(entry); err != nil {
+				return err
+			}
+		}
+		if len(page) < sqlPageSize {
+			return nil
+		}
+		after = page[len(page)-1].ID
+	}
+}
+
+// LastLevelChange reads back from before on the time index, requests and
+// approvals in between are rare so it only reads a few rows
+func (s *sqlStore) LastLevelChange(before time.Time) (historyEntry, bool, error) {
+	_, hi := timeBounds(time.Time{}, before)
+	rows, err := s.db.Query(`SELECT id, data, reactions FROM history WHERE time < ? ORDER BY time DESC, id DESC`, hi)
+	if err != nil {
+		return historyEntry{}, false, err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		entry, err := scanHistoryEntry(rows)
+		if err != nil {
+			return historyEntry{}, false, err
+		}
+		if entry.Kind == "" {
+			return entry, true, nil
+		}
+	}
+	return historyEntry{}, false, rows.Err()
+}
+
+// scanHistoryEntry reads a row of id, data, and reactions
+func scanHistoryEntry(rows *sql.Rows) (historyEntry, error) {
+	var (
+		id        int64
+		data      string
+		reactions sql.NullString
+		entry     historyEntry
+	)
+	if err := rows.Scan(&id, &data, &reactions); err != nil {
+		return entry, err
+	}
+	if err := json.Unmarshal([]byte(data), &entry); err != nil {
+		return entry, err
+	}
+	entry.ID = id
+	if reactions.Valid {
+		if err := json.Unmarshal([]byte(reactions.String), &entry.Reactions); err != nil {
+			return entry, err
+		}
+	}
+	return entry, nil
+}
+
+func (s *sqlStore) SetHistoryReactions(id int64, reactions map[string]int) error {
+	data, err := json.Marshal(reactions)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	existing := false
+	if err := tx.QueryRow(`SELECT reactions IS NOT NULL FROM history WHERE id = ?`, id).Scan(&existing); err != nil && err != sql.ErrNoRows {
+		return err
+	}
+	if _, err := tx.Exec(`UPDATE history SET reactions = ? WHERE id = ?`, string(data), id); err != nil {
+		return err
+	}
+	// Only the first reaction to an entry can push another one out
+	if !existing {
+		if _, err := tx.Exec(`UPDATE history SET reactions = NULL WHERE id <= ? AND reactions IS NOT NULL`, id-reactionsKept); err != nil {
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+func (s *sqlStore) AppendAudit(entry auditEntry) error {
+	_, err := s.appendLog("audit", entry.Time, entry)
+	return err
+}
+
+func (s *sqlStore) Audit(from, to time.Time, fn func(auditEntry) error) error {
+	return s.readLog("audit", from, to, func(data []byte) error {
+		entry := auditEntry{}
+		if err := json.Unmarshal(data, &entry); err != nil {
+			return err
+		}
+		return fn(entry)
+	})
+}
+
+func (s *sqlStore) Subscriptions() ([]subscription, error) {
+	rows, err := s.db.Query(`SELECT data FROM subscriptions ORDER BY created`)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	subs := []subscription{}
+	for rows.Next() {
+		var (
+			data string
+			sub  subscription
+		)
+		if err := rows.Scan(&data); err != nil {
+			return nil, err
+		}
+		if err := json.Unmarshal([]byte(data), &sub); err != nil {
+			return nil, err
+		}
+		subs = append(subs, sub)
+	}
+	return subs, rows.Err()
+}
+
+func (s *sqlStore) PutSubscription(sub subscription) error {
+	data, err := json.Marshal(sub)
+	if err != nil {
+		return err
+	}
+	_, err = s.db.Exec(`INSERT OR REPLACE INTO subscriptions (id, created, data) VALUES (?, ?, ?)`, sub.ID, sub.Created.UnixNano(), string(data))
+	return err
+}
+
+func (s *sqlStore) DeleteSubscription(id string) (bool, error) {
+	res, err := s.db.Exec(`DELETE FROM subscriptions WHERE id = ?`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+// appendLog and readLog are only ever called with the history or audit
+// table names, never anything user supplied. The ID stored in a history
+// entry's JSON is always 0, the row id is the real one.
+func (s *sqlStore) appendLog(table string, t time.Time, entry interface{}) (int64, error) {
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return 0, err
+	}
+	res, err := s.db.Exec(`INSERT INTO `+table+` (time, data) VALUES (?, ?)`, t.UnixNano(), string(data))
+	if err != nil {
+		return 0, err
+	}
+	return res.LastInsertId()
+}
+
+func timeBounds(from, to time.Time) (int64, int64) {
+	lo, hi := int64(math.MinInt64), int64(math.MaxInt64)
+	if !from.IsZero() {
+		lo = from.UnixNano()
+	}
+	if !to.IsZero() {
+		hi = to.UnixNano()
+	}
+	return lo, hi
+}
+
+func (s *sqlStore) readLog(table string, from, to time.Time, fn func([]byte) error) error {
+	lo, hi := timeBounds(from, to)
+	for after := int64(0); ; {
+		ids, page := []int64{}, []string{}
+		err := s.queryRows(func(rows *sql.Rows) error {
+			var (
+				id   int64
+				data string
+			)
+			err := rows.Scan(&id, &data)
+			ids, page = append(ids, id), append(page, data)
+			return err
+		}, `SELECT id, data FROM `+table+` WHERE time >= ? AND time < ? AND id > ? ORDER BY id LIMIT ?`, lo, hi, after, sqlPageSize)
+		if err != nil {
+			return err
+		}
+
+		for _, data := range page {
+			if err := fn([]byte(data)); err != nil {
+				return err
+			}
+		}
+		if len(page) < sqlPageSize {
+			return nil
+		}
+		after = ids[len(ids)-1]
+	}
+}
+
+// queryRows calls scan for every row of a query, and is done with the
+// connection by the time it returns
+func (s *sqlStore) queryRows(scan func(*sql.Rows) error, query string, args ...interface{}) error {
+	rows, err := s.db.Query(query, args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		if err := scan(rows); err != nil {
+			return err
+		}
+	}
+	return rows.Err()
+}
+
+func (s *sqlStore) Close() error {
+	return s.db.Close()
+}
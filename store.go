@@ -0,0 +1,220 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"time"
+)
+
+// Store persists everything the server needs to survive a restart. Every
+// implementation has to behave the same, see the file and sql stores.
+type Store interface {
+	Tokens() (tokenList, error)
+	Token(token string) (tokenAttr, bool, error)
+	PutToken(token string, attr tokenAttr) error
+	// DeleteToken returns false if the token didn't exist
+	DeleteToken(token string) (bool, error)
+
+	Levels() (levelSet, error)
+	SetLevels(levels levelSet) error
+
+	State() (serverState, error)
+	SetState(state serverState) error
+
+	// AppendHistory returns the new entry's ID, IDs only ever increase
+	AppendHistory(entry historyEntry) (int64, error)
+	// DeleteLastHistory takes back entry id, the last one appended, when
+	// the change it records couldn't be saved
+	DeleteLastHistory(id int64) error
+	// History calls fn for every entry with from <= Time < to, oldest first.
+	// A zero from or to leaves that end of the range open.
+	History(from, to time.Time, fn func(historyEntry) error) error
+	// LastLevelChange returns the newest entry with no Kind from before t,
+	// the change that set the level t was at. False if there isn't one.
+	LastLevelChange(before time.Time) (historyEntry, bool, error)
+	// SetHistoryReactions replaces one entry's reaction counts. Only the
+	// newest reactionsKept entries keep theirs, reacting to a new entry
+	// drops them from the entries that falls behind.
+	SetHistoryReactions(id int64, reactions map[string]int) error
+
+	AppendAudit(entry auditEntry) error
+	// Audit calls fn like History does
+	Audit(from, to time.Time, fn func(auditEntry) error) error
+
+	Subscriptions() ([]subscription, error)
+	PutSubscription(sub subscription) error
+	// DeleteSubscription returns false if the subscription didn't exist
+	DeleteSubscription(id string) (bool, error)
+
+	Close() error
+}
+
+var store Store
+
+// reactionsKept is how many history entries back reactions are kept for
+var reactionsKept int64 = 1000
+
+// openStore opens the backend named by storage.backend
+func openStore() (Store, error) {
+	switch cfg.StorageBackend {
+	case "file":
+		return openFileStore(cfg.DataDir)
+	case "sqlite":
+		return openSQLStore("sqlite", dataPath(cfg.SQLitePath))
+	}
+	return nil, fmt.Errorf("unknown storage.backend %q", cfg.StorageBackend)
+}
+
+// probeStore checks the store named by storage.backend opens, without
+// holding the data directory lock. A process being handed the listeners
+// calls it before telling its parent to drain. A store that still needs
+// migrating is left alone, migrations only run once the lock is held.
+func probeStore() error {
+	var (
+		s       Store
+		current bool
+		err     error
+	)
+	switch cfg.StorageBackend {
+	case "file":
+		if current, err = fileStoreCurrent(cfg.DataDir); err == nil && current {
+			s, err = openFileStore(cfg.DataDir)
+		}
+	case "sqlite":
+		if current, err = sqlStoreCurrent("sqlite", dataPath(cfg.SQLitePath)); err == nil && current {
+			s, err = openSQLStore("sqlite", dataPath(cfg.SQLitePath))
+		}
+	default:
+		return fmt.Errorf("unknown storage.backend %q", cfg.StorageBackend)
+	}
+	if err != nil || s == nil {
+		return err
+	}
+	return s.Close()
+}
+
+// levelDefinition is one level of the chart, as found in levels.json
+type levelDefinition struct {
+	Background  string `json:"background"`
+	Description string `json:"description"`
+	Title       string `json:"title"`
+	// Locales holds the title and description in other languages, keyed by
+	// language tag like "de" or "pt-BR"
+	Locales map[string]levelText `json:"locales,omitempty"`
+	// Approval, when set, makes raising the level to this one wait for a
+	// second operator to confirm
+	Approval *levelApproval `json:"approval,omitempty"`
+}
+
+// levelApproval is written in levels.json as "approval": {"within": "15m"}
+type levelApproval struct {
+	Within jsonDuration `json:"within"`
+}
+
+// jsonDuration is a time.Duration written as a string like "15m"
+type jsonDuration time.Duration
+
+func (d jsonDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *jsonDuration) UnmarshalJSON(b []byte) error {
+	var s string
+	if err := json.Unmarshal(b, &s); err != nil {
+		return err
+	}
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	if parsed <= 0 {
+		return fmt.Errorf("duration %q must be positive", s)
+	}
+	*d = jsonDuration(parsed)
+	return nil
+}
+
+type levelSet map[int]levelDefinition
+
+// sortedLevels returns the level numbers lowest first
+func (l levelSet) sortedLevels() []int {
+	keys := []int{}
+	for k := range l {
+		keys = append(keys, k)
+	}
+	sort.Ints(keys)
+	return keys
+}
+
+// serverState is the part of the server's in-memory state that needs to
+// survive a restart
+type serverState struct {
+	Level int `json:"level"`
+	// HistoryID is the history entry for the change to Level
+	HistoryID int64 `json:"historyId"`
+	// Reason is what the operator gave for the change, if anything
+	Reason string `json:"reason,omitempty"`
+	// Pending is a change waiting for a second operator
+	Pending *pendingChange `json:"pending,omitempty"`
+	// Version orders changes across a cluster, the newest state wins
+	Version int64 `json:"version,omitempty"`
+	// EventKey names the change to Level across a cluster, where each
+	// node has its own history IDs
+	EventKey string `json:"eventKey,omitempty"`
+}
+
+// History entry kinds, an empty kind is a change of the level
+const (
+	historyRequested = "requested"
+	historyRejected  = "rejected"
+	historyExpired   = "expired"
+)
+
+// historyEntry records one change of the current level, along with the
+// reactions viewers had to it. Changes that need approval also record when
+// they were requested, and rejected or expired, with Level as the requested
+// level.
+type historyEntry struct {
+	ID         int64          `json:"id"`
+	Kind       string         `json:"kind,omitempty"`
+	Time       time.Time      `json:"time"`
+	Level      int            `json:"level"`
+	Previous   int            `json:"previous"`
+	Actor      string         `json:"actor"`
+	ApprovedBy string         `json:"approvedBy,omitempty"`
+	Reason     string         `json:"reason,omitempty"`
+	Reactions  map[string]int `json:"reactions,omitempty"`
+}
+
+// auditEntry records an administrative action, like creating a token
+type auditEntry struct {
+	Time   time.Time `json:"time"`
+	Actor  string    `json:"actor"`
+	Action string    `json:"action"`
+	Detail string    `json:"detail"`
+}
+
+func inRange(t, from, to time.Time) bool {
+	return (from.IsZero() || !t.Before(from)) && (to.IsZero() || t.Before(to))
+}
@@ -0,0 +1,576 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// storeBackends opens each backend on an empty directory, the same suite
+// runs against all of them
+var storeBackends = map[string]func(dir string) (Store, error){
+	"file": func(dir string) (Store, error) {
+		return openFileStore(dir)
+	},
+	"sqlite": func(dir string) (Store, error) {
+		return openSQLStore("sqlite", filepath.Join(dir, "jmaas.db"))
+	},
+}
+
+func TestStoreConformance(t *testing.T) {
+	for name, open := range storeBackends {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			if name == "sqlite" && !hasSQLDriver("sqlite") {
+				t.Skip("no sqlite driver, run with -tags sqlite")
+			}
+
+			dir := t.TempDir()
+			defer func(dataDir string) { cfg.DataDir = dataDir }(cfg.DataDir)
+			cfg.DataDir = dir
+
+			s, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			testStore(t, s)
+			if err := s.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// Everything has to survive being reopened
+			s, err = open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			testStoreReopened(t, s)
+		})
+	}
+}
+
+var (
+	storeTestStart  = time.Date(2026, 1, 2, 3, 4, 5, 0, time.UTC)
+	storeTestLevels = levelSet{
+		0: {Title: "Calm", Background: "#00ff00"},
+		1: {Title: "Angry", Background: "#ff0000", Locales: map[string]levelText{"de": {Title: "Wütend"}}},
+		2: {Title: "Furious", Approval: &levelApproval{Within: jsonDuration(15 * time.Minute)}},
+	}
+)
+
+func testStore(t *testing.T, s Store) {
+	// Tokens
+	if tokens, err := s.Tokens(); err != nil || len(tokens) != 0 {
+		t.Fatalf("new store has tokens %v, %v", tokens, err)
+	}
+	if err := s.PutToken("tok-a", tokenAttr{Level: 1, Note: "alice", Role: roleAdmin}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutToken("tok-b", tokenAttr{Level: 1, Note: "bob", Role: roleOperator}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.PutToken("tok-b", tokenAttr{Level: 1, Note: "bobby", Role: roleOperator}); err != nil {
+		t.Fatal(err)
+	}
+	if attr, ok, err := s.Token("tok-b"); err != nil || !ok || attr.Note != "bobby" {
+		t.Errorf("Token(tok-b) = %v, %t, %v, want the replaced token", attr, ok, err)
+	}
+	if _, ok, err := s.Token("nope"); err != nil || ok {
+		t.Errorf("Token(nope) = %t, %v, want not found", ok, err)
+	}
+	if ok, err := s.DeleteToken("tok-b"); err != nil || !ok {
+		t.Errorf("DeleteToken(tok-b) = %t, %v", ok, err)
+	}
+	if ok, err := s.DeleteToken("tok-b"); err != nil || ok {
+		t.Errorf("deleting tok-b twice = %t, %v, want false", ok, err)
+	}
+
+	// Levels
+	if levels, err := s.Levels(); err != nil || len(levels) != 0 {
+		t.Fatalf("new store has levels %v, %v", levels, err)
+	}
+	if err := s.SetLevels(levelSet{5: {Title: "replaced"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.SetLevels(storeTestLevels); err != nil {
+		t.Fatal(err)
+	}
+	if levels, err := s.Levels(); err != nil || !reflect.DeepEqual(levels, storeTestLevels) {
+		t.Errorf("Levels() = %#v, %v", levels, err)
+	}
+
+	// State
+	if state, err := s.State(); err != nil || !reflect.DeepEqual(state, serverState{}) {
+		t.Errorf("new store has state %#v, %v", state, err)
+	}
+	state := serverState{
+		Level:     2,
+		HistoryID: 3,
+		Reason:    "because",
+		Pending:   &pendingChange{ID: 4, Level: 2, Requester: "alice", Expires: storeTestStart},
+		Version:   99,
+		EventKey:  "node/3",
+	}
+	if err := s.SetState(state); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := s.State(); err != nil || !reflect.DeepEqual(normalizeState(got), normalizeState(state)) {
+		t.Errorf("State() = %#v, %v, want %#v", got, err, state)
+	}
+
+	// History
+	lastID := int64(0)
+	for i := 0; i < 5; i++ {
+		entry := historyEntry{
+			Time:     storeTestStart.Add(time.Duration(i) * time.Hour),
+			Level:    i % 3,
+			Previous: (i + 2) % 3,
+			Actor:    "alice",
+			Reason:   "step",
+		}
+		if i == 3 {
+			entry.Kind = historyRequested
+		}
+		id, err := s.AppendHistory(entry)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if id <= lastID {
+			t.Errorf("AppendHistory returned id %d after %d", id, lastID)
+		}
+		lastID = id
+	}
+	if err := s.SetHistoryReactions(lastID, map[string]int{"😠": 2}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Audit
+	for i := 0; i < 3; i++ {
+		entry := auditEntry{Time: storeTestStart.Add(time.Duration(i) * time.Minute), Actor: "alice", Action: "token.create", Detail: "detail"}
+		if err := s.AppendAudit(entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Subscriptions
+	subs := []subscription{
+		{ID: "s1", Key: "k1", Channel: "email", Email: "a@example.com", Threshold: 1, Locale: "en", Created: storeTestStart},
+		{ID: "s2", Key: "k2", Channel: "push", Push: &pushEndpoint{Endpoint: "https://push.example.com/x"}, Threshold: 2, Quiet: &quietHours{Start: "22:00", End: "07:00", Zone: "UTC"}, Created: storeTestStart.Add(time.Minute)},
+	}
+	for _, sub := range subs {
+		if err := s.PutSubscription(sub); err != nil {
+			t.Fatal(err)
+		}
+	}
+	subs[0].Confirmed = true
+	if err := s.PutSubscription(subs[0]); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := s.DeleteSubscription("missing"); err != nil || ok {
+		t.Errorf("DeleteSubscription(missing) = %t, %v, want false", ok, err)
+	}
+
+	testStoreReopened(t, s)
+}
+
+// testStoreReopened checks what testStore left behind
+func testStoreReopened(t *testing.T, s Store) {
+	if tokens, err := s.Tokens(); err != nil || !reflect.DeepEqual(tokens, tokenList{"tok-a": {Level: 1, Note: "alice", Role: roleAdmin}}) {
+		t.Errorf("Tokens() = %v, %v", tokens, err)
+	}
+	if levels, err := s.Levels(); err != nil || !reflect.DeepEqual(levels, storeTestLevels) {
+		t.Errorf("Levels() = %#v, %v", levels, err)
+	}
+	if state, err := s.State(); err != nil || state.Version != 99 || state.Pending == nil || !state.Pending.Expires.Equal(storeTestStart) {
+		t.Errorf("State() = %#v, %v", state, err)
+	}
+
+	history := func(from, to time.Time) []historyEntry {
+		entries := []historyEntry{}
+		if err := s.History(from, to, func(e historyEntry) error {
+			entries = append(entries, e)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		return entries
+	}
+	all := history(time.Time{}, time.Time{})
+	if len(all) != 5 {
+		t.Fatalf("History has %d entries, want 5", len(all))
+	}
+	for i, e := range all {
+		if !e.Time.Equal(storeTestStart.Add(time.Duration(i)*time.Hour)) || e.Level != i%3 || e.Actor != "alice" {
+			t.Errorf("history entry %d is %#v", i, e)
+		}
+		if i > 0 && e.ID <= all[i-1].ID {
+			t.Errorf("history is not in order at entry %d", i)
+		}
+	}
+	if all[3].Kind != historyRequested {
+		t.Errorf("history entry 3 has kind %q", all[3].Kind)
+	}
+	if !reflect.DeepEqual(all[4].Reactions, map[string]int{"😠": 2}) || len(all[3].Reactions) != 0 {
+		t.Errorf("reactions are %v and %v", all[3].Reactions, all[4].Reactions)
+	}
+
+	// from is inclusive, to exclusive
+	ranged := history(storeTestStart.Add(time.Hour), storeTestStart.Add(3*time.Hour))
+	if len(ranged) != 2 || ranged[0].ID != all[1].ID || ranged[1].ID != all[2].ID {
+		t.Errorf("History(1h, 3h) = %#v", ranged)
+	}
+	if open := history(storeTestStart.Add(4*time.Hour), time.Time{}); len(open) != 1 {
+		t.Errorf("History(4h, open) has %d entries, want 1", len(open))
+	}
+
+	// The level at a time was set by the last change before it, requests
+	// don't count
+	for _, c := range []struct {
+		before time.Duration
+		want   int
+	}{
+		{0, -1},
+		{time.Hour, 0},
+		{3*time.Hour + 30*time.Minute, 2},
+		{4 * time.Hour, 2},
+		{4*time.Hour + 1, 4},
+	} {
+		entry, found, err := s.LastLevelChange(storeTestStart.Add(c.before))
+		switch {
+		case err != nil:
+			t.Errorf("LastLevelChange(%s) failed: %s", c.before, err.Error())
+		case c.want < 0 && found:
+			t.Errorf("LastLevelChange(%s) = %#v, want none", c.before, entry)
+		case c.want >= 0 && (!found || entry.ID != all[c.want].ID || !reflect.DeepEqual(entry, all[c.want])):
+			t.Errorf("LastLevelChange(%s) = %#v, %t, want entry %d", c.before, entry, found, c.want)
+		}
+	}
+
+	audit := []auditEntry{}
+	if err := s.Audit(storeTestStart.Add(time.Minute), time.Time{}, func(e auditEntry) error {
+		audit = append(audit, e)
+		return nil
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(audit) != 2 || !audit[0].Time.Equal(storeTestStart.Add(time.Minute)) || audit[1].Action != "token.create" {
+		t.Errorf("Audit(1m, open) = %#v", audit)
+	}
+
+	subs, err := s.Subscriptions()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(subs) != 2 || subs[0].ID != "s1" || !subs[0].Confirmed || subs[1].Push == nil || subs[1].Quiet == nil || subs[1].Quiet.End != "07:00" {
+		t.Errorf("Subscriptions() = %#v", subs)
+	}
+}
+
+// normalizeState drops the monotonic clock and location from times, which
+// don't survive being stored
+func normalizeState(s serverState) serverState {
+	if s.Pending != nil {
+		p := *s.Pending
+		p.Expires = p.Expires.UTC().Round(0)
+		s.Pending = &p
+	}
+	return s
+}
+
+func TestStoreReactionsKept(t *testing.T) {
+	defer func(kept int64) { reactionsKept = kept }(reactionsKept)
+	reactionsKept = 2
+
+	for name, open := range storeBackends {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			if name == "sqlite" && !hasSQLDriver("sqlite") {
+				t.Skip("no sqlite driver, run with -tags sqlite")
+			}
+
+			dir := t.TempDir()
+			s, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			ids := []int64{}
+			for i := 0; i < 4; i++ {
+				id, err := s.AppendHistory(historyEntry{Time: storeTestStart.Add(time.Duration(i) * time.Minute), Level: i})
+				if err != nil {
+					t.Fatal(err)
+				}
+				ids = append(ids, id)
+				if err := s.SetHistoryReactions(id, map[string]int{"👍": i + 1}); err != nil {
+					t.Fatal(err)
+				}
+			}
+			// Reacting again to an old entry doesn't prune anything
+			if err := s.SetHistoryReactions(ids[2], map[string]int{"👍": 9}); err != nil {
+				t.Fatal(err)
+			}
+
+			got := map[int64]int{}
+			s.History(time.Time{}, time.Time{}, func(e historyEntry) error {
+				got[e.ID] = e.Reactions["👍"]
+				return nil
+			})
+			want := map[int64]int{ids[0]: 0, ids[1]: 0, ids[2]: 9, ids[3]: 4}
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("reactions are %v, want %v", got, want)
+			}
+		})
+	}
+}
+
+// TestStoreLongLogs reads logs longer than a page, using the store from
+// inside the callback the way an export to a slow client would
+func TestStoreLongLogs(t *testing.T) {
+	const n = 2*sqlPageSize + 1
+
+	for name, open := range storeBackends {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			if name == "sqlite" && !hasSQLDriver("sqlite") {
+				t.Skip("no sqlite driver, run with -tags sqlite")
+			}
+
+			s, err := open(t.TempDir())
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+
+			for i := 0; i < n; i++ {
+				at := storeTestStart.Add(time.Duration(i) * time.Second)
+				if _, err := s.AppendHistory(historyEntry{Time: at, Level: i % 5}); err != nil {
+					t.Fatal(err)
+				}
+				if err := s.AppendAudit(auditEntry{Time: at, Action: "token.create", Detail: strconv.Itoa(i)}); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			read, lastID := 0, int64(0)
+			err = s.History(time.Time{}, time.Time{}, func(e historyEntry) error {
+				if e.ID <= lastID || e.Level != read%5 {
+					t.Fatalf("history entry %d is %#v after id %d", read, e, lastID)
+				}
+				read, lastID = read+1, e.ID
+				if _, err := s.Levels(); err != nil {
+					return err
+				}
+				return s.PutToken("tok", tokenAttr{Level: 1, Note: strconv.Itoa(read)})
+			})
+			if err != nil || read != n {
+				t.Errorf("read %d of %d history entries: %v", read, n, err)
+			}
+
+			read = 0
+			err = s.Audit(storeTestStart.Add(time.Second), time.Time{}, func(e auditEntry) error {
+				if e.Detail != strconv.Itoa(read+1) {
+					t.Fatalf("audit entry %d is %#v", read, e)
+				}
+				read++
+				_, _, err := s.Token("tok")
+				return err
+			})
+			if err != nil || read != n-1 {
+				t.Errorf("read %d of %d audit entries: %v", read, n-1, err)
+			}
+		})
+	}
+}
+
+func TestFileStoreMigratesReactions(t *testing.T) {
+	dir := t.TempDir()
+	for name, content := range map[string]string{
+		"store_version":  "1\n",
+		"history.jsonl":  `{"id":1,"time":"2026-01-02T03:04:05Z","level":1}` + "\n",
+		"reactions.json": `{"1":{"👍":3}}`,
+	} {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	s, err := openFileStore(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := []historyEntry{}
+	s.History(time.Time{}, time.Time{}, func(e historyEntry) error {
+		entries = append(entries, e)
+		return nil
+	})
+	if len(entries) != 1 || entries[0].Reactions["👍"] != 3 {
+		t.Errorf("history after migrating is %#v", entries)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "reactions.json")); !os.IsNotExist(err) {
+		t.Errorf("reactions.json is still there: %v", err)
+	}
+}
+
+func TestFileStoreTornHistory(t *testing.T) {
+	dir := t.TempDir()
+	good := `{"id":1,"time":"2026-01-02T03:04:05Z","level":1}` + "\n" + `{"id":2,"time":"2026-01-02T04:04:05Z","level":2}` + "\n"
+	for _, torn := range []string{`{"id":3,"time":"2026-01-0`, `{"id":3,"time":"2026-01-0` + "\n", "\x00\x00\x00\n"} {
+		if err := ioutil.WriteFile(filepath.Join(dir, "history.jsonl"), []byte(good+torn), 0644); err != nil {
+			t.Fatal(err)
+		}
+
+		s, err := openFileStore(dir)
+		if err != nil {
+			t.Fatalf("opening with torn line %q: %s", torn, err.Error())
+		}
+		if b, _ := ioutil.ReadFile(filepath.Join(dir, "history.jsonl")); string(b) != good {
+			t.Errorf("history.jsonl is %q after opening", b)
+		}
+		if id, err := s.AppendHistory(historyEntry{Time: storeTestStart, Level: 3}); err != nil || id != 3 {
+			t.Errorf("AppendHistory() = %d, %v, want 3", id, err)
+		}
+	}
+
+	// Only the last line can be torn, anything else is corruption
+	if err := ioutil.WriteFile(filepath.Join(dir, "history.jsonl"), []byte(`{"id":1,"ti`+"\n"+good), 0644); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := openFileStore(dir); err == nil {
+		t.Error("opened a store with a bad line in the middle of history.jsonl")
+	}
+}
+
+func TestFileStoreHistoryIndex(t *testing.T) {
+	const n = 3*historyIndexStride + 10
+
+	s, err := openFileStore(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Changes are rare, and one from another node's clock is out of order
+	all := []historyEntry{}
+	for i := 0; i < n; i++ {
+		entry := historyEntry{Time: storeTestStart.Add(time.Duration(i) * time.Minute), Kind: historyRequested}
+		if i%700 == 0 {
+			entry.Kind = ""
+		}
+		if i == 2100 {
+			entry.Time = storeTestStart.Add(10 * time.Minute)
+		}
+		if entry.ID, err = s.AppendHistory(entry); err != nil {
+			t.Fatal(err)
+		}
+		all = append(all, entry)
+	}
+
+	s, err = openFileStore(s.dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, minutes := range []int{0, 1, 11, 700, 1500, 2100, n - 5, n + 5} {
+		at := storeTestStart.Add(time.Duration(minutes) * time.Minute)
+
+		want := []int64{}
+		var wantLast int64
+		for _, e := range all {
+			if !e.Time.Before(at) {
+				want = append(want, e.ID)
+			} else if e.Kind == "" {
+				wantLast = e.ID
+			}
+		}
+		got := []int64{}
+		if err := s.History(at, time.Time{}, func(e historyEntry) error {
+			got = append(got, e.ID)
+			return nil
+		}); err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("History(%dm) has %d entries, want %d", minutes, len(got), len(want))
+		}
+
+		last, found, err := s.LastLevelChange(at)
+		if err != nil || found != (wantLast > 0) || last.ID != wantLast {
+			t.Errorf("LastLevelChange(%dm) = %d, %t, %v, want %d", minutes, last.ID, found, err, wantLast)
+		}
+	}
+}
+
+func TestStoreDeleteLastHistory(t *testing.T) {
+	for name, open := range storeBackends {
+		open := open
+		t.Run(name, func(t *testing.T) {
+			if name == "sqlite" && !hasSQLDriver("sqlite") {
+				t.Skip("no sqlite driver, run with -tags sqlite")
+			}
+
+			dir := t.TempDir()
+			s, err := open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			first, err := s.AppendHistory(historyEntry{Time: storeTestStart, Level: 1})
+			if err != nil {
+				t.Fatal(err)
+			}
+			taken, err := s.AppendHistory(historyEntry{Time: storeTestStart.Add(time.Hour), Level: 2})
+			if err != nil {
+				t.Fatal(err)
+			}
+			if err := s.DeleteLastHistory(taken); err != nil {
+				t.Fatal(err)
+			}
+
+			last, found, err := s.LastLevelChange(storeTestStart.Add(2 * time.Hour))
+			if err != nil || !found || last.ID != first {
+				t.Errorf("LastLevelChange() = %#v, %t, %v after deleting, want entry %d", last, found, err, first)
+			}
+			next, err := s.AppendHistory(historyEntry{Time: storeTestStart.Add(2 * time.Hour), Level: 3})
+			if err != nil {
+				t.Fatal(err)
+			}
+			s.Close()
+
+			s, err = open(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer s.Close()
+			levels := []int{}
+			s.History(time.Time{}, time.Time{}, func(e historyEntry) error {
+				levels = append(levels, e.Level)
+				return nil
+			})
+			if !reflect.DeepEqual(levels, []int{1, 3}) || next <= first {
+				t.Errorf("history is levels %v, entry %d after %d", levels, next, first)
+			}
+		})
+	}
+}
@@ -0,0 +1,142 @@
+// Copyright (c) 2017 Henry Slawniak <https://henry.computer/>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the "Software"), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED "AS IS", WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import (
+	"sort"
+	"time"
+)
+
+// levelTemplates are the scales that ship with the server. levels.template
+// picks one to start a new board with, and any of them can be imported over
+// an existing board.
+var levelTemplates = map[string]levelSet{
+	// jmaas is the board's original six level scale
+	"jmaas": {
+		0: {
+			Background:  "#757575",
+			Description: "<p>Playing rocket league.</p><p>Yelling at kids about the good ol' days.</p>",
+			Title:       "Almost Relaxed",
+		},
+		1: {
+			Background:  "#43A047",
+			Description: "<p>Sitting on couch petting kitty.</p><p>Fresh case of beer.</p>",
+			Title:       "Low",
+		},
+		2: {
+			Background:  "#039BE5",
+			Description: "<p>In the office, browsing imgur.</p>",
+			Title:       "Guarded",
+		},
+		3: {
+			Background:  "#FDD835",
+			Description: "<p>UPS, FedEx, and CEVA trucks in the dock.</p><p>Servers that are bigger than the cabinet.</p><p>LOAs with wrong information.</p>",
+			Title:       "Elevated",
+		},
+		4: {
+			Background:  "#FB8C00",
+			Description: "<p>Mislabeled cables.\nRack nuts under the nail.</p><p>Calls from Kathy.</p>",
+			Title:       "High",
+		},
+		5: {
+			Background:  "#E53935",
+			Description: "<p>Having to redo work due to other departments' mistakes.</p><p>Cardboard box to the head.</p>",
+			Title:       "Severe",
+		},
+	},
+
+	// defcon counts down from DEFCON 5 at level 0, with the top level
+	// needing a second operator
+	"defcon": {
+		0: {
+			Background:  "#1565C0",
+			Description: "<p>Lowest state of readiness.</p>",
+			Title:       "DEFCON 5",
+		},
+		1: {
+			Background:  "#43A047",
+			Description: "<p>Increased intelligence watch.</p>",
+			Title:       "DEFCON 4",
+		},
+		2: {
+			Background:  "#FDD835",
+			Description: "<p>Increase in force readiness.</p>",
+			Title:       "DEFCON 3",
+		},
+		3: {
+			Background:  "#E53935",
+			Description: "<p>Next step to maximum readiness.</p>",
+			Title:       "DEFCON 2",
+		},
+		4: {
+			Background:  "#FAFAFA",
+			Description: "<p>Maximum readiness.</p>",
+			Title:       "DEFCON 1",
+			Approval:    &levelApproval{Within: jsonDuration(15 * time.Minute)},
+		},
+	},
+
+	"traffic-light": {
+		0: {
+			Background:  "#43A047",
+			Description: "<p>All good.</p>",
+			Title:       "Green",
+		},
+		1: {
+			Background:  "#FFB300",
+			Description: "<p>Proceed with caution.</p>",
+			Title:       "Amber",
+		},
+		2: {
+			Background:  "#E53935",
+			Description: "<p>Stop.</p>",
+			Title:       "Red",
+		},
+	},
+}
+
+// templateNames lists the built-in templates alphabetically
+func templateNames() []string {
+	names := []string{}
+	for name := range levelTemplates {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// levelTemplate returns a copy of the named template, so callers can't
+// change the built-in one
+func levelTemplate(name string) (levelSet, bool) {
+	tmpl, exists := levelTemplates[name]
+	if !exists {
+		return nil, false
+	}
+	levels := levelSet{}
+	for n, def := range tmpl {
+		if def.Approval != nil {
+			approval := *def.Approval
+			def.Approval = &approval
+		}
+		levels[n] = def
+	}
+	return levels, true
+}
@@ -21,127 +21,284 @@
 package main
 
 import (
-	"encoding/gob"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"github.com/go-playground/log"
-	"math/rand"
+	"math/big"
 	"net/http"
-	"os"
+	"sort"
+	"time"
+)
+
+const (
+	roleOperator = "operator"
+	roleAdmin    = "admin"
 )
 
 type tokenAttr struct {
 	Level int
 	Note  string
+	Role  string
+}
+
+// role is the token's role, tokens from before roles existed could do
+// everything so they're treated as admins
+func (a tokenAttr) role() string {
+	if a.Role == "" {
+		return roleAdmin
+	}
+	return a.Role
+}
+
+func isValidRole(role string) bool {
+	return role == roleOperator || role == roleAdmin
 }
 
 type tokenList map[string]tokenAttr
 
+// sortedTokens returns the tokens ordered by note, then by token
+func (t tokenList) sortedTokens() []string {
+	keys := []string{}
+	for k := range t {
+		keys = append(keys, k)
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		if t[keys[i]].Note != t[keys[j]].Note {
+			return t[keys[i]].Note < t[keys[j]].Note
+		}
+		return keys[i] < keys[j]
+	})
+	return keys
+}
+
 var letterRunes = []rune("abcdefghijklmnopqrstuvwxyzABCDEFGHIJKLMNOPQRSTUVWXYZ")
 
 func randStringRunes(n int) string {
 	b := make([]rune, n)
+	max := big.NewInt(int64(len(letterRunes)))
 	for i := range b {
-		b[i] = letterRunes[rand.Intn(len(letterRunes))]
+		idx, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			panic(err)
+		}
+		b[i] = letterRunes[idx.Int64()]
 	}
 	return string(b)
 }
 
-func printTokens() {
-	f, err := os.OpenFile("tokens.gob", os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		panic(err)
-	}
-	defer f.Close()
-
-	tokens := tokenList{}
-	decoder := gob.NewDecoder(f)
-	decoder.Decode(&tokens)
-
-	log.Debug(tokens)
+// tokenID identifies a token without revealing it, notes can't be used to
+// tell operators apart since they don't have to be unique
+func tokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:16])
 }
 
-func getTokenList() *tokenList {
-	f, err := os.OpenFile("tokens.gob", os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		panic(err)
+// redactToken keeps just enough of a token to tell it apart in logs
+func redactToken(token string) string {
+	if len(token) <= 4 {
+		return "****"
 	}
-	defer f.Close()
-
-	tokens := tokenList{}
-	decoder := gob.NewDecoder(f)
-	decoder.Decode(&tokens)
-
-	return &tokens
+	return token[:4] + "****"
 }
 
-func addNewAuthedToken(note string) string {
-	f, err := os.OpenFile("tokens.gob", os.O_RDWR|os.O_CREATE, 0755)
+func printTokens() {
+	tokens, err := store.Tokens()
 	if err != nil {
-		panic(err)
+		log.Errorf("Could not load tokens: %s", err.Error())
+		return
 	}
 
-	tokens := tokenList{}
-	decoder := gob.NewDecoder(f)
-	decoder.Decode(&tokens)
-	f.Close()
+	log.Infof("Loaded %d tokens", len(tokens))
+	for _, k := range tokens.sortedTokens() {
+		attr := tokens[k]
+		log.Debugf("token %s: note '%s', role %s, level %d", redactToken(k), attr.Note, attr.role(), attr.Level)
+	}
+}
 
+func addNewAuthedToken(note, role string) (string, error) {
 	token := randStringRunes(25)
-	tokens[token] = tokenAttr{Level: 1, Note: note}
+	if err := store.PutToken(token, tokenAttr{Level: 1, Note: note, Role: role}); err != nil {
+		return "", err
+	}
+	return token, nil
+}
 
-	f, err = os.OpenFile("tokens.gob", os.O_RDWR|os.O_CREATE, 0755)
+func isTokenAuthed(token string) (tokenAttr, bool) {
+	attr, exists, err := store.Token(token)
 	if err != nil {
-		panic(err)
+		log.Errorf("Could not look up token: %s", err.Error())
+		return attr, false
 	}
+	return attr, exists && attr.Level > 0
+}
 
-	encoder := gob.NewEncoder(f)
-	encoder.Encode(tokens)
-	f.Close()
-
-	return token
+// authRequest checks the request's Token header, writing the error response
+// when it's missing or invalid. Failures count towards locking the client's
+// address out, and valid tokens are held to the per-token rate limit.
+func authRequest(w http.ResponseWriter, r *http.Request) (string, tokenAttr, bool) {
+	return authToken(w, r, r.Header.Get("Token"))
 }
 
-func isTokenAuthed(token string) (tokenAttr, bool) {
-	f, err := os.OpenFile("tokens.gob", os.O_RDWR|os.O_CREATE, 0755)
-	if err != nil {
-		panic(err)
+// authToken checks a token from somewhere other than the Token header, with
+// the same lockout and limits
+func authToken(w http.ResponseWriter, r *http.Request, token string) (string, tokenAttr, bool) {
+	ip := clientIP(r)
+	if remaining := lockout.lockedFor(ip); remaining > 0 {
+		writeTooManyRequests(w, remaining, "too many failed authentication attempts")
+		return "", tokenAttr{}, false
 	}
-	defer f.Close()
 
-	tokens := tokenList{}
-	decoder := gob.NewDecoder(f)
-	decoder.Decode(&tokens)
+	if token == "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("no token provided"))
+		return "", tokenAttr{}, false
+	}
 
-	attr, exists := tokens[token]
-	return attr, exists && attr.Level > 0
+	attr, authed := isTokenAuthed(token)
+	if !authed {
+		lockout.fail(ip)
+		log.Warnf("Failed authentication from %s", ip)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusUnauthorized)
+		w.Write([]byte("token is not authed"))
+		return "", tokenAttr{}, false
+	}
+	lockout.succeed(ip)
+
+	if ok, retry := tokenLimiter.allow(token); !ok {
+		writeTooManyRequests(w, retry, "too many requests for this token")
+		return "", tokenAttr{}, false
+	}
+
+	return token, attr, true
 }
 
 func listTokenHandler(w http.ResponseWriter, r *http.Request) {
-	token := r.Header.Get("Token")
-	if token == "" {
+	_, attr, ok := authRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if attr.role() != roleAdmin {
 		w.Header().Set("Content-Type", "text/plain")
-		j, _ := json.Marshal("no token provided")
+		j, _ := json.Marshal("token is not an admin")
+		w.WriteHeader(http.StatusForbidden)
 		w.Write(j)
-		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
-	_, authed := isTokenAuthed(token)
-	if !authed {
+	tokens, err := store.Tokens()
+	if err != nil {
+		log.Errorf("Could not load tokens: %s", err.Error())
 		w.Header().Set("Content-Type", "text/plain")
-		j, _ := json.Marshal("token is not authed")
+		j, _ := json.Marshal("could not load tokens")
+		w.WriteHeader(http.StatusInternalServerError)
 		w.Write(j)
-		w.WriteHeader(http.StatusUnauthorized)
 		return
 	}
 
 	if r.URL.Query().Get("pretty") == "true" {
 		w.Header().Set("Content-Type", "text/plain")
-		j, _ := json.MarshalIndent(getTokenList(), "", "  ")
+		j, _ := json.MarshalIndent(tokens, "", "  ")
 		w.Write(j)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/json")
-	j, _ := json.Marshal(getTokenList())
+	j, _ := json.Marshal(tokens)
+	w.Write(j)
+}
+
+func createTokenHandler(w http.ResponseWriter, r *http.Request) {
+	_, attr, ok := authRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if attr.role() != roleAdmin {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("token is not an admin"))
+		return
+	}
+
+	note := r.Header.Get("Note")
+	if note == "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("you must provide a Note header"))
+		return
+	}
+
+	role := r.Header.Get("Role")
+	if role == "" {
+		role = roleOperator
+	}
+	if !isValidRole(role) {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("Role must be operator or admin"))
+		return
+	}
+
+	newToken, err := addNewAuthedToken(note, role)
+	if err != nil {
+		log.Errorf("Could not save token: %s", err.Error())
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not save token"))
+		return
+	}
+	log.Infof("%s created a %s token with note '%s'", attr.Note, role, note)
+	events.publish(tokenCreated{Time: time.Now(), Actor: attr.Note, Token: newToken, Note: note, Role: role})
+
+	w.Header().Set("Content-Type", "application/json")
+	j, _ := json.Marshal(tokenList{newToken: tokenAttr{Level: 1, Note: note, Role: role}})
 	w.Write(j)
 }
+
+func revokeTokenHandler(w http.ResponseWriter, r *http.Request) {
+	_, attr, ok := authRequest(w, r)
+	if !ok {
+		return
+	}
+
+	if attr.role() != roleAdmin {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusForbidden)
+		w.Write([]byte("token is not an admin"))
+		return
+	}
+
+	revoke := r.Header.Get("Revoke-Token")
+	if revoke == "" {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusBadRequest)
+		w.Write([]byte("you must provide a Revoke-Token header"))
+		return
+	}
+
+	revoked, err := store.DeleteToken(revoke)
+	if err != nil {
+		log.Errorf("Could not revoke token: %s", err.Error())
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusInternalServerError)
+		w.Write([]byte("could not revoke token"))
+		return
+	}
+	if !revoked {
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusNotFound)
+		w.Write([]byte("token does not exist"))
+		return
+	}
+
+	log.Infof("%s revoked a token", attr.Note)
+	events.publish(tokenRevoked{Time: time.Now(), Actor: attr.Note, Token: revoke})
+
+	w.Header().Set("Content-Type", "text/plain")
+	w.Write([]byte("Token revoked successfully"))
+}